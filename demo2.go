@@ -6,20 +6,90 @@ import (
   "fmt"
   "os"
   "bufio"
+  "strings"
   "flag"
+  "time"
+  "context"
+  "os/signal"
+  "syscall"
 )
 
 // TODO: remove commented-out test prints and make proper test files
 
 func main() {
+  if len(os.Args) > 1 && os.Args[1] == "run-scenario" {
+    os.Exit(runScenarios(os.Args[2:]))
+  }
   fmt.Println("Starting demo2 simulation")
   testingFlagPtr := flag.Bool("testing", true, "a boolean to turn on testing")
+  guestsFlagPtr := flag.Bool("guest-sessions", false, "a boolean to let clients request test chain rides as anonymous guests without signing in")
   portFlagPtr := flag.String("port", "8000", "a string to hold port number")
+  baseFareFlagPtr := flag.Float64("base-fare", sim2.DefaultFareRates.Base, "flat MoovCoin amount charged per ride")
+  distanceFareFlagPtr := flag.Float64("fare-per-distance", sim2.DefaultFareRates.PerDistance, "MoovCoins charged per unit of routed distance")
+  timeFareFlagPtr := flag.Float64("fare-per-second", sim2.DefaultFareRates.PerSecond, "MoovCoins charged per second of estimated travel time")
+  enforceFaresFlagPtr := flag.Bool("enforce-fares", false, "a boolean to make cars refuse rides paying less than the quoted fare")
+  surgeFlagPtr := flag.Bool("surge", true, "a boolean to turn on surge pricing by map zone")
+  surgeZoneFlagPtr := flag.Float64("surge-zone-size", sim2.DefaultSurgeConfig.ZoneSize, "width and height of a surge pricing zone in map units")
+  rebalanceFlagPtr := flag.String("rebalance", "random", "where idle cars go: random, park, depot or demand")
+  depotsFlagPtr := flag.String("depots", "", "depot locations for idle cars as x,y;x,y")
+  carsFlagPtr := flag.Uint("cars", 6, "number of cars in the fleet")
+  placementFlagPtr := flag.String("placement", "random", "where cars start: random, depots or positions")
+  placementSpacingFlagPtr := flag.Float64("placement-spacing", sim2.DefaultPlacementSpacing, "road distance kept between cars placed at random or around depots")
+  placementPositionsFlagPtr := flag.String("placement-positions", "", "start positions of the cars as x,y;x,y, for positions placement")
+  routingFlagPtr := flag.String("routing", "distance", "what cars route by: distance, or congestion for travel times observed on each road")
+  smoothingFlagPtr := flag.Float64("travel-time-smoothing", sim2.DefaultTravelTimeSmoothing, "weight of the latest traversal in the smoothed travel time of a road, between 0 and 1")
+  capacityFlagPtr := flag.Uint("capacity", 1, "number of riders a car serves at once")
+  maxDetourFlagPtr := flag.Float64("max-detour", 400, "distance a pooled rider may add to a car's route beyond their own trip")
+  scheduleLeadFlagPtr := flag.Duration("schedule-lead", sim2.DefaultSchedulerConfig.Lead, "time allowed beyond the closest car's ETA to dispatch a scheduled ride")
+  adminsFlagPtr := flag.String("admins", "", "comma separated addresses allowed to control the simulation once signed in")
+  logFormatFlagPtr := flag.String("log-format", "text", "format of log entries: text or json")
+  logLevelFlagPtr := flag.String("log-level", "info", "log level, optionally per component as info,car=debug,websrv=warn")
+  analyticsDirFlagPtr := flag.String("analytics-dir", "", "directory to export ride and fleet analytics CSVs to on exit, none if empty")
+  demandRatesFlagPtr := flag.String("demand-rates", "", "generate ride requests per minute, each rate lasting for a duration as 10:5m,60:2m; none if empty")
+  demandOriginsFlagPtr := flag.String("demand-origins", "uniform", "where generated rides start: uniform or hotspot")
+  demandDestinationsFlagPtr := flag.String("demand-destinations", "uniform", "where generated rides end: uniform or hotspot")
+  demandHotspotsFlagPtr := flag.String("demand-hotspots", "", "hotspots of generated rides as x,y;x,y")
+  demandRadiusFlagPtr := flag.Float64("demand-hotspot-radius", 200, "distance from a hotspot of the generated rides near it")
+  demandAmountFlagPtr := flag.Uint64("demand-amount", 0, "MoovCoins offered for each generated ride, the quoted fare if 0")
+  demandSeedFlagPtr := flag.Int64("demand-seed", 0, "seed of the generated rides, random if 0")
+  demandRiderKeysFlagPtr := flag.String("demand-rider-keys", "rider_keys.txt", "file of the private keys, one per line, of the rider accounts requesting generated rides without testing")
   flag.Parse()
+  logFormat := sim2.TextFormat
+  if *logFormatFlagPtr == "json" {
+    logFormat = sim2.JSONFormat
+  }
+  logger := sim2.NewLogger(os.Stderr, logFormat)
+  if err := logger.SetLevels(*logLevelFlagPtr); err != nil {
+    log.Fatalln("error: invalid log level:", err)
+  }
+  sim2.SetDefaultLogger(logger)
+  admins, err := sim2.ParseAddresses(*adminsFlagPtr)
+  if err != nil {
+    log.Fatalln("error: invalid admins:", err)
+  }
 
   // Instantiate world
+  fps := float64(25)
   graph := sim2.GetDigraphFromFile("maps/final.map")
-  world := sim2.NewWorld(25, graph)
+  world := sim2.NewWorld(fps, graph)
+  world.SetLogger(logger)
+  if *smoothingFlagPtr <= 0 || *smoothingFlagPtr > 1 {
+    log.Fatalln("error: travel time smoothing must be above 0 and at most 1")
+  }
+  world.TravelTimes().SetSmoothing(*smoothingFlagPtr)
+  if err := graph.SetRouting(*routingFlagPtr, world.TravelTimes()); err != nil {
+    log.Fatalln("error: invalid routing:", err)
+  }
+  metrics := sim2.NewMetrics()
+  world.SetMetrics(metrics)
+  if !world.RegisterCarObserver(metrics) {
+    log.Fatalln("error: failed to register metrics")
+  }
+  pricing := sim2.NewPricingService(graph, fps, sim2.FareRates{
+    Base:*baseFareFlagPtr,
+    PerDistance:*distanceFareFlagPtr,
+    PerSecond:*timeFareFlagPtr,
+  })
 
   // Instantiate JSON web output
   webChan, ok := world.RegisterWeb()
@@ -31,6 +101,7 @@ func main() {
   var existingMrmAddress string
   var scanner *bufio.Scanner
   var testChain *sim2.TestChain
+  var demand sim2.RideDemand
   if (!*testingFlagPtr) {
     keys, err := os.Open("keys.txt")
     if err != nil {
@@ -49,32 +120,193 @@ func main() {
   } else {
    testChain = sim2.NewTestChain()
     web = sim2.NewTestChainWebSrv(webChan, testChain.RecvServer)
+    if (*guestsFlagPtr) {
+      web.EnableGuests()
+    }
+  }
+  web.EnablePricing(pricing)
+  web.EnableRoadControl(graph)
+  web.SetLogger(logger)
+  sessions := sim2.NewSessions(admins)
+  web.SetSessions(sessions)
+  // Decide where cars start
+  numCars := *carsFlagPtr
+  placementPositions, err := sim2.ParseLocations(*placementPositionsFlagPtr)
+  if err != nil {
+    log.Fatalln("error: invalid placement positions:", err)
   }
+  placement, err := sim2.NewFleetPlacement(*placementFlagPtr, graph, *placementSpacingFlagPtr, placementPositions, time.Now().UnixNano())
+  if err != nil {
+    log.Fatalln("error: failed to create placement:", err)
+  }
+  positions, err := placement.Place(numCars)
+  if err != nil {
+    log.Fatalln("error: failed to place cars:", err)
+  }
+
   // Instantiate cars
-  numCars := uint(6)
   cars := make([]*sim2.Car, numCars)
+  carGraphs := make([]*sim2.Digraph, numCars)
   for i := uint(0); i < numCars; i++ {
     // Request to register new car from World
     id, syncChan, updateChan, ok := world.RegisterCar()
     if !ok {
       log.Fatalln("error: failed to register car")
     }
-		graph = sim2.GetDigraphFromFile("maps/final.map")
+		carGraphs[i] = sim2.GetDigraphFromFile("maps/final.map")
+    carGraphs[i].ShareRoadConditions(graph)  // Cars route around the roads closed on the world's map
+    if err := carGraphs[i].SetRouting(*routingFlagPtr, world.TravelTimes()); err != nil {
+      log.Fatalln("error: invalid routing:", err)
+    }
     if (!*testingFlagPtr) {
       scanner.Scan()
       scanner.Scan()
       carPrivateKey := scanner.Text()
       eth := sim2.NewEthApi(existingMrmAddress, carPrivateKey)
-      cars[i] = sim2.NewCar(id, graph, eth, syncChan, updateChan, webChan)
+      eth.SetMetrics(metrics)
+      eth.SetLogger(logger)
+      if demand == nil {
+        demand = eth  // Any car's connection can list the open ride requests
+      }
+      cars[i] = sim2.NewCar(id, carGraphs[i], eth, syncChan, updateChan, webChan)
     } else {
     	fmt.Println("TESTING")
       testchainApi := testChain.RegisterBlockchainInteractor()
-      cars[i] = sim2.NewCar(id, graph, testchainApi, syncChan, updateChan, webChan)
+      cars[i] = sim2.NewCar(id, carGraphs[i], testchainApi, syncChan, updateChan, webChan)
     }
+    if *enforceFaresFlagPtr {
+      cars[i].EnforceFares(pricing)
+    }
+    cars[i].PlaceAt(positions[i])
+    cars[i].EnablePooling(*capacityFlagPtr, *maxDetourFlagPtr)
+    cars[i].SetMetrics(metrics)
+    cars[i].SetLogger(logger)
+    cars[i].AddRideObserver(metrics)
+    cars[i].AddRideObserver(world)  // Riders walk to their pick up
   }
 	if (*testingFlagPtr) {
 		testChain.StartTestChain()
+		demand = testChain
 	}
+
+  // Instantiate demand history shared by rebalancing and surge pricing
+  history := sim2.NewDemandHistory(graph, demand, *surgeZoneFlagPtr, time.Minute * 2)
+  go history.LoopDemand(time.Second)
+
+  // Instantiate idle car rebalancing
+  depots, err := sim2.ParseLocations(*depotsFlagPtr)
+  if err != nil {
+    log.Fatalln("error: invalid depots:", err)
+  }
+  if len(depots) == 0 {
+    depots = graph.DepotPositions()  // Idle cars return to the depots of the map
+  }
+  for i := uint(0); i < numCars; i++ {
+    policy, err := sim2.NewRebalancePolicy(*rebalanceFlagPtr, carGraphs[i], history, depots)
+    if err != nil {
+      log.Fatalln("error: failed to create rebalance policy:", err)
+    }
+    cars[i].SetRebalancePolicy(policy)
+  }
+
+  // Instantiate surge pricing
+  if *surgeFlagPtr {
+    surgeConfig := sim2.DefaultSurgeConfig
+    surgeConfig.ZoneSize = *surgeZoneFlagPtr
+    surge := sim2.NewSurgeMonitor(graph, surgeConfig, history, webChan)
+    if !world.RegisterCarObserver(surge) {
+      log.Fatalln("error: failed to register surge pricing")
+    }
+    pricing.ApplySurge(surge)
+    go surge.LoopSurge(time.Second)
+  }
+
+  // Instantiate scheduled rides
+  var dispatcher sim2.RideDispatcher = sim2.NewRiderDispatcher(webChan)
+  if (*testingFlagPtr) {
+    dispatcher = testChain
+  }
+  scheduleConfig := sim2.DefaultSchedulerConfig
+  scheduleConfig.Lead = *scheduleLeadFlagPtr
+  scheduler := sim2.NewRideScheduler(graph, fps, scheduleConfig, dispatcher, webChan)
+  if !world.RegisterCarObserver(scheduler) {
+    log.Fatalln("error: failed to register ride scheduler")
+  }
+  for i := uint(0); i < numCars; i++ {
+    cars[i].AddRideObserver(scheduler)
+  }
+  web.EnableScheduling(scheduler)
+  go scheduler.LoopScheduler(time.Second)
+
+  // Instantiate synthetic ride demand
+  if *demandRatesFlagPtr != "" {
+    rates, err := sim2.ParseRates(*demandRatesFlagPtr)
+    if err != nil {
+      log.Fatalln("error: invalid demand rates:", err)
+    }
+    hotspots, err := sim2.ParseLocations(*demandHotspotsFlagPtr)
+    if err != nil {
+      log.Fatalln("error: invalid demand hotspots:", err)
+    }
+    origins, err := sim2.NewLocationDistribution(*demandOriginsFlagPtr, graph, hotspots, *demandRadiusFlagPtr)
+    if err != nil {
+      log.Fatalln("error: invalid demand origins:", err)
+    }
+    destinations, err := sim2.NewLocationDistribution(*demandDestinationsFlagPtr, graph, hotspots, *demandRadiusFlagPtr)
+    if err != nil {
+      log.Fatalln("error: invalid demand destinations:", err)
+    }
+    seed := *demandSeedFlagPtr
+    if seed == 0 {
+      seed = time.Now().UnixNano()
+    }
+    var requester sim2.RideRequester = testChain
+    if (!*testingFlagPtr) {
+      riderKeys, err := readKeys(*demandRiderKeysFlagPtr)
+      if err != nil {
+        log.Fatalln("error: failed to read rider keys for generated rides:", err)
+      }
+      riders, err := sim2.NewContractRiders(existingMrmAddress, riderKeys)
+      if err != nil {
+        log.Fatalln("error: failed to create rider accounts for generated rides:", err)
+      }
+      riders.SetMetrics(metrics)
+      requester = riders
+    }
+    generator := sim2.NewDemandGenerator(sim2.DemandConfig{
+      Origins:origins,
+      Destinations:destinations,
+      Rates:rates,
+      Amount:*demandAmountFlagPtr,
+      MinDistance:100, // Rides shorter than a block are not worth a car
+      Seed:seed,
+    }, requester)
+    if *demandAmountFlagPtr == 0 {
+      generator.QuoteFares(pricing)
+    }
+    go generator.LoopGenerator(time.Second)
+  }
+
+  // Instantiate REST API
+  rides := sim2.NewRideTracker()
+  rides.SetRequestTimes(history)
+  for i := uint(0); i < numCars; i++ {
+    cars[i].AddRideObserver(rides)
+  }
+  analytics := sim2.NewFleetAnalytics(rides)
+  if !world.RegisterCarObserver(analytics) {
+    log.Fatalln("error: failed to register fleet analytics")
+  }
+  api := sim2.NewAPI(world, graph, history, rides)
+  if (*testingFlagPtr) {
+    api.EnableRideRequests(testChain)
+  }
+  api.EnableScheduling(scheduler)
+  api.SetSessions(sessions)
+  api.EnableAnalytics(analytics)
+  web.EnableAPI(api)
+  web.EnableMetrics(metrics)
+
   // Begin World operation
   go world.LoopWorld()
 
@@ -86,6 +318,75 @@ func main() {
   // Begin JSON web output operation
   go web.LoopWebSrv(*portFlagPtr)
 
-  select{}  // Do work in the coroutines, main has nothing left to do
+  // Do work in the coroutines until interrupted, then export the run's analytics
+  interrupt := make(chan os.Signal, 1)
+  signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+  <-interrupt
+  if *analyticsDirFlagPtr != "" {
+    if err := analytics.Export(*analyticsDirFlagPtr); err != nil {
+      log.Println("error: failed to export analytics:", err)
+    } else {
+      logger.Info("Exported analytics", sim2.Fields{"dir":*analyticsDirFlagPtr})
+    }
+  }
+  ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+  defer cancel()
+  web.Shutdown(ctx)
+}
+
+// runScenarios - Run each scenario file named in args headlessly and report it, returning the exit code:
+//   0 if every scenario passed, 1 if any failed and 2 if any could not be run.
+func runScenarios(args []string) int {
+  flags := flag.NewFlagSet("run-scenario", flag.ExitOnError)
+  logLevelFlagPtr := flags.String("log-level", "warn", "log level, optionally per component as warn,scenario=info")
+  flags.Usage = func() {
+    fmt.Fprintln(os.Stderr, "usage: demo2 run-scenario [-log-level level] scenario.json ...")
+    flags.PrintDefaults()
+  }
+  flags.Parse(args)
+  if flags.NArg() == 0 {
+    flags.Usage()
+    return 2
+  }
+  logger := sim2.NewLogger(os.Stderr, sim2.TextFormat)
+  if err := logger.SetLevels(*logLevelFlagPtr); err != nil {
+    fmt.Fprintln(os.Stderr, "error: invalid log level:", err)
+    return 2
+  }
+  sim2.SetDefaultLogger(logger)
+
+  code := 0
+  for _, path := range flags.Args() {
+    scenario, err := sim2.LoadScenario(path)
+    if err == nil {
+      var result *sim2.ScenarioResult
+      if result, err = scenario.Run(); err == nil {
+        result.WriteReport(os.Stdout)
+        if !result.Passed && code == 0 {
+          code = 1
+        }
+        continue
+      }
+    }
+    fmt.Fprintf(os.Stderr, "error: scenario %s: %v\n", path, err)
+    code = 2
+  }
+  return code
+}
+
+// readKeys - the private keys in the file at path, one per line, skipping blank lines.
+func readKeys(path string) (keys []string, err error) {
+  file, err := os.Open(path)
+  if err != nil {
+    return nil, err
+  }
+  defer file.Close()
+  scanner := bufio.NewScanner(file)
+  for scanner.Scan() {
+    if key := strings.TrimSpace(scanner.Text()); key != "" {
+      keys = append(keys, key)
+    }
+  }
+  return keys, scanner.Err()
 }
 //*/
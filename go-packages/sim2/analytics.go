@@ -0,0 +1,163 @@
+package sim2
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// analytics - Describes per-ride and per-car analytics of a run, exported as CSV for KPI reporting
+
+// utilizationStates - path states whose time is reported per car, in column order.
+var utilizationStates = []PathState{DrivingAtRandom, ToPickUp, ToDropOff, Waiting, Stopped}
+
+// FleetAnalytics - accumulates the time each car spends in each path state and exports it along with
+//   the rides recorded by a RideTracker.
+type FleetAnalytics struct {
+	rides        *RideTracker
+	mutex        sync.Mutex
+	lastObserved time.Time
+	lastStates   map[uint]PathState
+	stateTimes   map[uint]map[PathState]time.Duration
+}
+
+// NewFleetAnalytics - Constructor for a valid FleetAnalytics object exporting the rides of rides.
+func NewFleetAnalytics(rides *RideTracker) *FleetAnalytics {
+	a := new(FleetAnalytics)
+	a.rides = rides
+	a.lastStates = make(map[uint]PathState)
+	a.stateTimes = make(map[uint]map[PathState]time.Duration)
+	return a
+}
+
+// ObserveCars - Credit the time since the previous observation to the state each car was in then.
+func (a *FleetAnalytics) ObserveCars(cars []CarInfo) {
+	a.observe(cars, time.Now())
+}
+
+func (a *FleetAnalytics) observe(cars []CarInfo, now time.Time) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.lastObserved.IsZero() {
+		elapsed := now.Sub(a.lastObserved)
+		for id, state := range a.lastStates {
+			a.stateTimes[id][state] += elapsed
+		}
+	}
+	for _, car := range cars {
+		if _, ok := a.stateTimes[car.ID]; !ok {
+			a.stateTimes[car.ID] = make(map[PathState]time.Duration)
+		}
+		a.lastStates[car.ID] = car.State
+	}
+	a.lastObserved = now
+}
+
+// WriteRidesCSV - Write one row per ride recorded so far, oldest first.
+func (a *FleetAnalytics) WriteRidesCSV(out io.Writer) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"rider", "car_id", "status", "requested_at", "assigned_at", "picked_up_at", "dropped_off_at",
+		"wait_seconds", "trip_seconds", "route_distance", "fare", "pick_up_edge", "drop_off_edge", "pick_up", "drop_off"})
+	for _, record := range a.rides.Rides() {
+		dropOffEdge, dropOff := "", ""
+		if record.Status == RideDroppedOff {
+			dropOffEdge, dropOff = strconv.Itoa(int(record.DropOffEdge)), formatCoords(record.DropOff)
+		}
+		w.Write([]string{
+			record.Rider,
+			strconv.Itoa(int(record.CarID)),
+			rideStatusNames[record.Status],
+			formatTime(record.RequestedAt),
+			formatTime(record.AssignedAt),
+			formatTime(record.PickedUpAt),
+			formatTime(record.DroppedOffAt),
+			formatInterval(record.RequestedAt, record.PickedUpAt), // Empty if the request was not seen
+			formatInterval(record.PickedUpAt, record.DroppedOffAt),
+			strconv.FormatFloat(record.Distance, 'f', 1, 64),
+			strconv.FormatUint(record.Fare, 10),
+			strconv.Itoa(int(record.PickUpEdge)),
+			dropOffEdge,
+			formatCoords(record.PickUp),
+			dropOff,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// WriteFleetCSV - Write one row per car with the seconds it spent in each path state and the share of
+//   time it spent serving riders.
+func (a *FleetAnalytics) WriteFleetCSV(out io.Writer) error {
+	a.mutex.Lock()
+	ids := make([]int, 0, len(a.stateTimes))
+	for id := range a.stateTimes {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	rows := [][]string{{"car_id", "driving_at_random_seconds", "to_pick_up_seconds", "to_drop_off_seconds",
+		"waiting_seconds", "stopped_seconds", "total_seconds", "utilization"}}
+	for _, id := range ids {
+		times := a.stateTimes[uint(id)]
+		row := []string{strconv.Itoa(id)}
+		var total time.Duration
+		for _, state := range utilizationStates {
+			row = append(row, strconv.FormatFloat(times[state].Seconds(), 'f', 1, 64))
+			total += times[state]
+		}
+		utilization := 0.0
+		if total > 0 {
+			utilization = float64(times[ToPickUp]+times[ToDropOff]) / float64(total)
+		}
+		row = append(row, strconv.FormatFloat(total.Seconds(), 'f', 1, 64), strconv.FormatFloat(utilization, 'f', 3, 64))
+		rows = append(rows, row)
+	}
+	a.mutex.Unlock()
+
+	w := csv.NewWriter(out)
+	w.WriteAll(rows)
+	return w.Error()
+}
+
+// Export - Write rides.csv and fleet.csv into dir, creating it if needed.
+func (a *FleetAnalytics) Export(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(dir, "rides.csv"), a.WriteRidesCSV); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, "fleet.csv"), a.WriteFleetCSV)
+}
+
+func writeFile(name string, write func(io.Writer) error) error {
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// formatTime - t in RFC 3339, empty if it is zero.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// formatInterval - seconds from start to end, empty unless both are known.
+func formatInterval(start time.Time, end time.Time) string {
+	if start.IsZero() || end.IsZero() {
+		return ""
+	}
+	return strconv.FormatFloat(end.Sub(start).Seconds(), 'f', 1, 64)
+}
@@ -0,0 +1,68 @@
+package sim2
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+)
+
+func TestFleetAnalytics_WriteFleetCSV(t *testing.T) {
+	analytics := NewFleetAnalytics(NewRideTracker())
+	start := time.Now()
+	analytics.observe([]CarInfo{{ID: 0, State: DrivingAtRandom}, {ID: 1, State: ToPickUp}}, start)
+	analytics.observe([]CarInfo{{ID: 0, State: ToPickUp}, {ID: 1, State: ToDropOff}}, start.Add(time.Second*10))
+	analytics.observe([]CarInfo{{ID: 0, State: ToPickUp}, {ID: 1, State: ToDropOff}}, start.Add(time.Second*40))
+
+	var out bytes.Buffer
+	if err := analytics.WriteFleetCSV(&out); err != nil {
+		t.Fatalf("Could not write fleet CSV %v \n", err)
+	}
+	rows, _ := csv.NewReader(&out).ReadAll()
+	if len(rows) != 3 {
+		t.Fatalf("Expected a header and one row per car, got %d rows \n", len(rows))
+	}
+	if car := rows[1]; car[1] != "10.0" || car[2] != "30.0" || car[6] != "40.0" || car[7] != "0.750" {
+		t.Errorf("Car 0 time by state does not match its observed states, got %v \n", car)
+	}
+	if car := rows[2]; car[2] != "10.0" || car[3] != "30.0" || car[7] != "1.000" {
+		t.Errorf("Car 1 time by state does not match its observed states, got %v \n", car)
+	}
+}
+
+func TestFleetAnalytics_WriteRidesCSV(t *testing.T) {
+	graph := NewDigraph()
+	graph.Vertices[0] = &Vertex{ID: 0, Pos: Coords{0, 0}}
+	history := NewDemandHistory(graph, nil, 100, time.Minute)
+	start := time.Now()
+	history.observe([]RideRequest{{Rider: "0xA", From: "10,10"}}, start)
+
+	rides := NewRideTracker()
+	rides.SetRequestTimes(history)
+	pickUp := Location{intersect: Coords{10, 10}, edge: Edge{ID: 4}}
+	dropOff := Location{intersect: Coords{90, 10}, edge: Edge{ID: 9}}
+	rides.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xa", CarID: 2, Time: start.Add(time.Second * 5), Location: pickUp, Amount: 30, Distance: 80})
+	rides.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xa", CarID: 2, Time: start.Add(time.Second * 25), Location: pickUp})
+	rides.ObserveRide(RideEvent{Type: RideDroppedOff, Rider: "0xa", CarID: 2, Time: start.Add(time.Second * 65), Location: dropOff})
+	rides.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xb", CarID: 1, Time: start, Location: pickUp}) // Request not seen
+	rides.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xb", CarID: 1, Time: start.Add(time.Second * 5), Location: pickUp})
+
+	var out bytes.Buffer
+	if err := NewFleetAnalytics(rides).WriteRidesCSV(&out); err != nil {
+		t.Fatalf("Could not write rides CSV %v \n", err)
+	}
+	rows, _ := csv.NewReader(&out).ReadAll()
+	if len(rows) != 3 {
+		t.Fatalf("Expected a header and one row per ride, got %d rows \n", len(rows))
+	}
+	ride := rows[1]
+	if ride[1] != "2" || ride[2] != "DroppedOff" || ride[3] == "" || ride[7] != "25.0" || ride[8] != "40.0" {
+		t.Errorf("Ride times do not match its events, got %v \n", ride)
+	}
+	if ride[9] != "80.0" || ride[10] != "30" || ride[11] != "4" || ride[12] != "9" || ride[14] != "90,10" {
+		t.Errorf("Ride route, fare and edges do not match its events, got %v \n", ride)
+	}
+	if ride := rows[2]; ride[3] != "" || ride[7] != "" {
+		t.Errorf("Expected no wait for a ride whose request was not seen, got %v \n", ride)
+	}
+}
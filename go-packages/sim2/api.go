@@ -0,0 +1,524 @@
+package sim2
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// api - Describes a JSON REST API for pulling world state, cars, intersections and rides
+
+// RideRequester - opens ride requests on behalf of riders.
+type RideRequester interface {
+	// RequestRide - open a ride request for rider, or for a rider the requester picks if rider is "", and
+	//   return the rider address it was opened for, "" if it could not be opened.
+	RequestRide(rider string, from string, to string, amount uint64) string
+}
+
+// API - serves snapshots of the simulation as JSON under /api/.
+type API struct {
+	world     *World
+	graph     *Digraph
+	demand    RideDemand
+	rides     *RideTracker
+	requester RideRequester   // Opens rides posted to the API, nil when riders request rides themselves
+	scheduler *RideScheduler  // Holds posted rides with a pick up time, nil when scheduling is disabled
+	sessions  *Sessions       // Riders whose bearer tokens may post their own rides, and admins who see every rider; nil to let anyone
+	analytics *FleetAnalytics // Exports rides and fleet utilization as CSV, nil when disabled
+}
+
+// CarView - state of one car.
+type CarView struct {
+	ID          uint     `json:"id"`
+	X           float64  `json:"x"`
+	Y           float64  `json:"y"`
+	Orientation float64  `json:"orientation"`
+	EdgeID      uint     `json:"edgeId"`
+	Lane        uint     `json:"lane"` // Of the edge, 0 for its rightmost lane
+	State       string   `json:"state"`
+	Parked      bool     `json:"parked"`
+	Route       []uint   `json:"route"`  // IDs of the edges left on the route
+	Riders      []string `json:"riders"` // Riders with a stop left, next stop first
+}
+
+// IntersectionView - type, entries, movements and, for stop lights, light states of one intersection.
+type IntersectionView struct {
+	ID        uint              `json:"id"`
+	Type      string            `json:"type"`
+	Entries   []string          `json:"entries"`            // Directions with an entry into the intersection
+	Movements []MovementView    `json:"movements"`          // Ways through the intersection from each entry
+	Yielding  []string          `json:"yielding,omitempty"` // Directions of the entries giving way to the others
+	Lights    map[string]string `json:"lights,omitempty"`   // Light state by direction
+}
+
+// MovementView - one way through an intersection.
+type MovementView struct {
+	From    string `json:"from"` // Direction of the entry
+	Edge    uint   `json:"edge"`
+	Exit    uint   `json:"exit"` // Vertex leaving the intersection
+	Turn    string `json:"turn"`
+	Allowed bool   `json:"allowed"`
+}
+
+// RideView - progress of one ride, open requests included.
+type RideView struct {
+	Rider        string     `json:"rider"`
+	Status       string     `json:"status"`
+	CarID        *uint      `json:"carId,omitempty"`
+	From         string     `json:"from,omitempty"`
+	To           string     `json:"to,omitempty"`
+	AssignedAt   *time.Time `json:"assignedAt,omitempty"`
+	PickedUpAt   *time.Time `json:"pickedUpAt,omitempty"`
+	DroppedOffAt *time.Time `json:"droppedOffAt,omitempty"`
+}
+
+// MapView - vertices and edges of the road network.
+type MapView struct {
+	Vertices []VertexView `json:"vertices"`
+	Edges    []EdgeView   `json:"edges"`
+}
+
+// VertexView - one vertex of the road network.
+type VertexView struct {
+	ID uint    `json:"id"`
+	X  float64 `json:"x"`
+	Y  float64 `json:"y"`
+}
+
+// EdgeView - one directed edge of the road network.
+type EdgeView struct {
+	ID         uint    `json:"id"`
+	Start      uint    `json:"start"`
+	End        uint    `json:"end"`
+	Weight     float64 `json:"weight"`
+	Extends    bool    `json:"extends"` // Crosses an intersection
+	Wraps      bool    `json:"wraps"`   // Wraps around the edge of the map
+	Closed     bool    `json:"closed"`
+	Multiplier float64 `json:"multiplier"` // Of the travel time, 1 for normal traffic
+	TravelTime float64 `json:"travelTime"` // Seconds, smoothed from the cars that drove the edge
+}
+
+// RideRequestBody - body of a ride posted to the API.
+type RideRequestBody struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Amount     uint64 `json:"amount"`
+	PickUpTime int64  `json:"pickUpTime,omitempty"` // Unix seconds of a scheduled pick up, 0 to request now
+}
+
+var pathStateNames = map[PathState]string{
+	DrivingAtRandom: "DrivingAtRandom",
+	ToPickUp:        "ToPickUp",
+	ToDropOff:       "ToDropOff",
+	Stopped:         "Stopped",
+	Waiting:         "Waiting",
+}
+
+var rideStatusNames = map[RideEventType]string{
+	RideAssigned:   "Assigned",
+	RidePickedUp:   "PickedUp",
+	RideDroppedOff: "DroppedOff",
+}
+
+var intersectionTypeNames = map[IntersectionType]string{
+	NoIntersection: "None",
+	StopSign:       "StopSign",
+	StopLight:      "StopLight",
+	Roundabout:     "Roundabout",
+	Yield:          "Yield",
+	Autonomous:     "Autonomous",
+}
+
+var directionNames = [NumberOfDirections]string{"West", "South", "East", "North"}
+
+var lightStateNames = map[LightState]string{
+	Red:    "Red",
+	Orange: "Orange",
+	Green:  "Green",
+}
+
+// NewAPI - Constructor for a valid API object; demand and rides may be nil.
+func NewAPI(world *World, graph *Digraph, demand RideDemand, rides *RideTracker) *API {
+	a := new(API)
+	a.world = world
+	a.graph = graph
+	a.demand = demand
+	a.rides = rides
+	return a
+}
+
+// EnableRideRequests - Open rides posted to the API with requester.
+func (a *API) EnableRideRequests(requester RideRequester) {
+	a.requester = requester
+}
+
+// SetSessions - Only let riders signed in to sessions post rides, for themselves, and see their own rides, by
+//   their bearer token; admins also export analytics, change roads and see every rider.
+func (a *API) SetSessions(sessions *Sessions) {
+	a.sessions = sessions
+}
+
+// EnableAnalytics - Export rides and fleet utilization from analytics as CSV under /api/analytics/.
+func (a *API) EnableAnalytics(analytics *FleetAnalytics) {
+	a.analytics = analytics
+}
+
+// EnableScheduling - Hold rides posted to the API with a pick up time in scheduler.
+func (a *API) EnableScheduling(scheduler *RideScheduler) {
+	a.scheduler = scheduler
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+	switch {
+	case path == "cars":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, a.cars(r))
+		}
+	case strings.HasPrefix(path, "cars/"):
+		if allowMethods(w, r, http.MethodGet) {
+			a.serveCar(w, r, strings.TrimPrefix(path, "cars/"))
+		}
+	case path == "intersections":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, a.intersections())
+		}
+	case path == "rides":
+		if allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			if r.Method == http.MethodPost {
+				a.postRide(w, r)
+			} else {
+				a.serveRides(w, r)
+			}
+		}
+	case path == "analytics/rides.csv" || path == "analytics/fleet.csv":
+		if allowMethods(w, r, http.MethodGet) && a.authorize(w, r, "export analytics") {
+			a.serveAnalytics(w, path)
+		}
+	case strings.HasPrefix(path, "edges/"):
+		if allowMethods(w, r, http.MethodGet, http.MethodPut) {
+			a.serveEdge(w, r, strings.TrimPrefix(path, "edges/"))
+		}
+	case path == "map":
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, a.mapView())
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("no such resource"))
+	}
+}
+
+// cars - every car, listing only the riders r may see.
+func (a *API) cars(r *http.Request) []CarView {
+	rider, signedIn := a.viewer(r)
+	cars, _ := a.world.Snapshot()
+	views := make([]CarView, len(cars))
+	for idx, car := range cars {
+		views[idx] = carView(car, a.graph)
+		if !signedIn || rider != "" {
+			views[idx].Riders = visibleRiders(views[idx].Riders, rider)
+		}
+	}
+	return views
+}
+
+// visibleRiders - the entries of riders that are rider, none if rider is "".
+func visibleRiders(riders []string, rider string) []string {
+	visible := []string{}
+	for _, other := range riders {
+		if rider != "" && strings.EqualFold(other, rider) {
+			visible = append(visible, other)
+		}
+	}
+	return visible
+}
+
+func (a *API) serveCar(w http.ResponseWriter, r *http.Request, idString string) {
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("car ID is not a number"))
+		return
+	}
+	for _, car := range a.cars(r) {
+		if car.ID == uint(id) {
+			writeJSON(w, http.StatusOK, car)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, errors.New("no such car"))
+}
+
+func carView(car CarInfo, graph *Digraph) CarView {
+	pos := car.lanePos(graph)
+	view := CarView{ID: car.ID, X: pos.X, Y: pos.Y, Orientation: car.Dir, EdgeID: car.EdgeId, Lane: car.Lane,
+		State: pathStateNames[car.State], Parked: car.Parked, Route: car.Route, Riders: car.Riders}
+	if view.Route == nil {
+		view.Route = []uint{}
+	}
+	if view.Riders == nil {
+		view.Riders = []string{}
+	}
+	return view
+}
+
+func (a *API) intersections() []IntersectionView {
+	_, stopLights := a.world.Snapshot()
+	views := make([]IntersectionView, 0, len(a.graph.Intersections))
+	for _, intersection := range a.graph.Intersections {
+		view := IntersectionView{ID: intersection.id, Type: intersectionTypeNames[intersection.intersectionType], Entries: []string{},
+			Movements: []MovementView{}}
+		for direction, entry := range intersection.entries {
+			if entry.present {
+				view.Entries = append(view.Entries, directionNames[direction])
+			}
+			if entry.yields {
+				view.Yielding = append(view.Yielding, directionNames[direction])
+			}
+			for _, movement := range entry.movements {
+				view.Movements = append(view.Movements, MovementView{From: directionNames[direction], Edge: movement.Edge.ID,
+					Exit: movement.Exit.ID, Turn: movement.Turn.String(), Allowed: movement.Allowed})
+			}
+		}
+		for _, stopLight := range stopLights {
+			if intersection.intersectionType == StopLight && stopLight.ID == intersection.id {
+				view.Lights = make(map[string]string)
+				for direction, lightState := range stopLight.lightstates {
+					view.Lights[directionNames[direction]] = lightStateNames[lightState]
+				}
+			}
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// serveRides - Answer with every ride for an admin, or with the rides of the rider signed in.
+func (a *API) serveRides(w http.ResponseWriter, r *http.Request) {
+	rider, signedIn := a.viewer(r)
+	if !signedIn {
+		writeError(w, http.StatusUnauthorized, errors.New("sign in and pass the session token as a bearer token"))
+		return
+	}
+	views := a.rideViews()
+	if rider != "" {
+		own := []RideView{}
+		for _, view := range views {
+			if strings.EqualFold(view.Rider, rider) {
+				own = append(own, view)
+			}
+		}
+		views = own
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// rideViews - open ride requests followed by every ride a car has been assigned.
+func (a *API) rideViews() []RideView {
+	views := []RideView{}
+	if a.demand != nil {
+		for _, request := range a.demand.OpenRideRequests() {
+			views = append(views, RideView{Rider: request.Rider, Status: "Requested", From: request.From, To: request.To})
+		}
+	}
+	if a.rides != nil {
+		for _, record := range a.rides.Rides() {
+			view := RideView{Rider: record.Rider, Status: rideStatusNames[record.Status], CarID: new(uint),
+				From: formatCoords(record.PickUp)}
+			*view.CarID = record.CarID
+			view.AssignedAt = optionalTime(record.AssignedAt)
+			view.PickedUpAt = optionalTime(record.PickedUpAt)
+			view.DroppedOffAt = optionalTime(record.DroppedOffAt)
+			if record.Status == RideDroppedOff {
+				view.To = formatCoords(record.DropOff)
+			}
+			views = append(views, view)
+		}
+	}
+	return views
+}
+
+func (a *API) postRide(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.signedIn(w, r)
+	if !ok {
+		return
+	}
+	var body RideRequestBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := parseCoords(body.From); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, err := parseCoords(body.To); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.PickUpTime != 0 {
+		if a.scheduler == nil {
+			writeError(w, http.StatusNotImplemented, errors.New("scheduling is not enabled"))
+			return
+		}
+		err := a.scheduler.Schedule(ScheduledRide{Rider: session.Address, From: body.From, To: body.To,
+			Amount: body.Amount, PickUpTime: time.Unix(body.PickUpTime, 0)})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, RideView{Status: "Scheduled", From: body.From, To: body.To})
+		return
+	}
+	if a.requester == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("rides must be requested from the contract by the rider"))
+		return
+	}
+	rider := a.requester.RequestRide(session.Address, body.From, body.To, body.Amount)
+	writeJSON(w, http.StatusCreated, RideView{Rider: rider, Status: "Requested", From: body.From, To: body.To})
+}
+
+// viewer - the rider whose rides r may see, "" for every rider when sessions are disabled or r carries the
+//   bearer token of an admin session, and false without a valid session token.
+func (a *API) viewer(r *http.Request) (rider string, signedIn bool) {
+	if a.sessions == nil {
+		return "", true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	session, ok := a.sessions.Lookup(token)
+	if token == "" || !ok {
+		return "", false
+	}
+	if session.Role == AdminRole {
+		return "", true
+	}
+	return session.Address, true
+}
+
+// signedIn - the session whose bearer token the request carries, else answers it with an error asking to sign
+//   in. Without sessions every request is let through with an empty session.
+func (a *API) signedIn(w http.ResponseWriter, r *http.Request) (Session, bool) {
+	if a.sessions == nil {
+		return Session{}, true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	session, ok := a.sessions.Lookup(token)
+	if token == "" || !ok {
+		writeError(w, http.StatusUnauthorized, errors.New("sign in and pass the session token as a bearer token"))
+		return session, false
+	}
+	return session, true
+}
+
+// authorize - true if the request carries the bearer token of an admin session, else answers it with an error
+//   saying only admins may do action.
+func (a *API) authorize(w http.ResponseWriter, r *http.Request, action string) bool {
+	session, ok := a.signedIn(w, r)
+	if !ok {
+		return false
+	}
+	if a.sessions != nil && session.Role != AdminRole {
+		writeError(w, http.StatusForbidden, errors.New("only admins may "+action))
+		return false
+	}
+	return true
+}
+
+func (a *API) serveAnalytics(w http.ResponseWriter, path string) {
+	if a.analytics == nil {
+		writeError(w, http.StatusNotImplemented, errors.New("analytics are not enabled"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	if path == "analytics/rides.csv" {
+		a.analytics.WriteRidesCSV(w)
+	} else {
+		a.analytics.WriteFleetCSV(w)
+	}
+}
+
+// serveEdge - Answer with an edge and its road conditions, changing them first for a PUT by an admin.
+//   The body of a PUT is a RoadConditionRequest whose edge is ignored.
+func (a *API) serveEdge(w http.ResponseWriter, r *http.Request, idString string) {
+	id, err := strconv.ParseUint(idString, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("edge ID is not a number"))
+		return
+	}
+	edge, ok := a.graph.Edges[uint(id)]
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such edge"))
+		return
+	}
+	if r.Method == http.MethodPut {
+		if !a.authorize(w, r, "change road conditions") {
+			return
+		}
+		var body RoadConditionRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if _, err := a.graph.changeRoad(edge.ID, body.Closed, body.Multiplier); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, a.edgeView(edge))
+}
+
+func (a *API) edgeView(edge *Edge) EdgeView {
+	return EdgeView{ID: edge.ID, Start: edge.Start.ID, End: edge.End.ID, Weight: edge.Weight, Extends: edge.Extends,
+		Wraps: edge.Wraps, Closed: a.graph.IsClosed(edge.ID), Multiplier: a.graph.TravelTimeMultiplier(edge.ID),
+		TravelTime: a.world.TravelTimes().Estimate(edge.ID).Seconds()}
+}
+
+func (a *API) mapView() MapView {
+	view := MapView{Vertices: make([]VertexView, 0, len(a.graph.Vertices)), Edges: make([]EdgeView, 0, len(a.graph.Edges))}
+	for id := uint(0); len(view.Vertices) < len(a.graph.Vertices); id++ {
+		if vertex, ok := a.graph.Vertices[id]; ok {
+			view.Vertices = append(view.Vertices, VertexView{ID: vertex.ID, X: vertex.Pos.X, Y: vertex.Pos.Y})
+		}
+	}
+	for id := uint(0); len(view.Edges) < len(a.graph.Edges); id++ {
+		if edge, ok := a.graph.Edges[id]; ok {
+			view.Edges = append(view.Edges, a.edgeView(edge))
+		}
+	}
+	return view
+}
+
+// allowMethods - true if r uses one of methods, otherwise answer 405 Method Not Allowed.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func formatCoords(pos Coords) string {
+	return strconv.Itoa(int(pos.X)) + "," + strconv.Itoa(int(pos.Y))
+}
@@ -0,0 +1,242 @@
+package sim2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockRequester struct {
+	rider, from, to string
+}
+
+func (m *mockRequester) RequestRide(rider string, from string, to string, amount uint64) string {
+	m.rider, m.from, m.to = rider, from, to
+	if rider == "" {
+		return "0x1"
+	}
+	return rider
+}
+
+func TestAPI_ServeHTTP(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	world := NewWorld(25, graph)
+	world.trafficInfo.carStates = []CarInfo{{ID: 0, Pos: Coords{10, 20}, EdgeId: 3, State: ToPickUp, Route: []uint{4, 5}, Riders: []string{"0xa"}}}
+	world.updateSnapshot()
+	rides := NewRideTracker()
+	rides.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xa", CarID: 0, Time: time.Now()})
+	api := NewAPI(world, graph, nil, rides)
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/cars/0", nil))
+	var car CarView
+	if err := json.NewDecoder(recorder.Body).Decode(&car); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("Could not get car, status %d error %v \n", recorder.Code, err)
+	}
+	if car.State != "ToPickUp" || car.X != 10 || len(car.Route) != 2 || car.Riders[0] != "0xa" {
+		t.Errorf("Car view does not match the world snapshot, got %+v \n", car)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/cars/7", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Expected missing car to be not found, got %d \n", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/map", nil))
+	var mapView MapView
+	json.NewDecoder(recorder.Body).Decode(&mapView)
+	if len(mapView.Vertices) != len(graph.Vertices) || len(mapView.Edges) != len(graph.Edges) {
+		t.Errorf("Map view does not cover the graph \n")
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/intersections", nil))
+	var intersectionViews []IntersectionView
+	json.NewDecoder(recorder.Body).Decode(&intersectionViews)
+	if len(intersectionViews) != len(graph.Intersections) || len(intersectionViews[4].Movements) != 12 {
+		t.Errorf("Intersection views do not cover the movements, got %+v \n", intersectionViews)
+	} else if movement := intersectionViews[4].Movements[2]; movement.From != "West" || movement.Edge != 15 || movement.Turn != "Left" {
+		t.Errorf("Expected a left turn from the west over edge 15, got %+v \n", movement)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/rides", nil))
+	var rideViews []RideView
+	json.NewDecoder(recorder.Body).Decode(&rideViews)
+	if len(rideViews) != 1 || rideViews[0].Status != "Assigned" || *rideViews[0].CarID != 0 {
+		t.Errorf("Ride views do not match the tracked rides, got %+v \n", rideViews)
+	}
+}
+
+func TestAPI_PostRide(t *testing.T) {
+	api := NewAPI(NewWorld(25, NewDigraph()), NewDigraph(), nil, nil)
+	body := `{"from":"10,10","to":"20,20","amount":5}`
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/rides", strings.NewReader(body)))
+	if recorder.Code != http.StatusNotImplemented {
+		t.Errorf("Expected ride requests to be refused without a requester, got %d \n", recorder.Code)
+	}
+
+	requester := new(mockRequester)
+	api.EnableRideRequests(requester)
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/rides", strings.NewReader(body)))
+	if recorder.Code != http.StatusCreated || requester.from != "10,10" || requester.to != "20,20" {
+		t.Errorf("Ride was not requested, status %d \n", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/rides", strings.NewReader(`{"from":"x","to":"20,20"}`)))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid locations to be rejected, got %d \n", recorder.Code)
+	}
+
+	api.SetSessions(NewSessions(nil))
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/api/rides", strings.NewReader(body)))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected rides posted without a session token to be unauthorized, got %d \n", recorder.Code)
+	}
+	rider := api.sessions.Guest()
+	request := httptest.NewRequest(http.MethodPost, "/api/rides", strings.NewReader(body))
+	request.Header.Set("Authorization", "Bearer "+rider.Token)
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusCreated || requester.rider != rider.Address {
+		t.Errorf("Expected a ride posted by a rider to be requested for them, status %d rider %s \n", recorder.Code, requester.rider)
+	}
+
+	scheduler := NewRideScheduler(NewDigraph(), 25, SchedulerConfig{}, nil, nil)
+	api.EnableScheduling(scheduler)
+	scheduled := fmt.Sprintf(`{"from":"10,10","to":"20,20","pickUpTime":%d}`, time.Now().Add(time.Hour).Unix())
+	request = httptest.NewRequest(http.MethodPost, "/api/rides", strings.NewReader(scheduled))
+	request.Header.Set("Authorization", "Bearer "+rider.Token)
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusAccepted || len(scheduler.pending) != 1 || scheduler.pending[0].Rider != rider.Address {
+		t.Errorf("Expected a ride scheduled by a rider to be held for them, status %d \n", recorder.Code)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodDelete, "/api/cars", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected method not allowed, got %d \n", recorder.Code)
+	}
+}
+
+func TestAPI_Edges(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	api := NewAPI(NewWorld(25, graph), graph, nil, nil)
+
+	recorder := httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/api/edges/36", strings.NewReader(`{"closed":true,"multiplier":2}`)))
+	var edge EdgeView
+	if err := json.NewDecoder(recorder.Body).Decode(&edge); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("Could not change edge, status %d error %v \n", recorder.Code, err)
+	}
+	if !edge.Closed || edge.Multiplier != 2 || !graph.IsClosed(36) || graph.TravelTimeMultiplier(36) != 2 {
+		t.Errorf("Edge conditions not changed, got %+v \n", edge)
+	}
+
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, "/api/edges/36", strings.NewReader(`{"closed":false}`)))
+	json.NewDecoder(recorder.Body).Decode(&edge)
+	if edge.Closed || edge.Multiplier != 2 {
+		t.Errorf("Expected only the closure to change, got %+v \n", edge)
+	}
+
+	invalid := map[string]int{
+		"/api/edges/36 {\"multiplier\":0}": http.StatusBadRequest,
+		"/api/edges/x {}":                  http.StatusBadRequest,
+		"/api/edges/1000 {}":               http.StatusNotFound,
+	}
+	for request, status := range invalid {
+		parts := strings.SplitN(request, " ", 2)
+		recorder = httptest.NewRecorder()
+		api.ServeHTTP(recorder, httptest.NewRequest(http.MethodPut, parts[0], strings.NewReader(parts[1])))
+		if recorder.Code != status {
+			t.Errorf("Expected %s to answer %d, got %d \n", request, status, recorder.Code)
+		}
+	}
+
+	api.SetSessions(NewSessions(nil))
+	request := httptest.NewRequest(http.MethodPut, "/api/edges/36", strings.NewReader(`{"closed":true}`))
+	request.Header.Set("Authorization", "Bearer "+api.sessions.Guest().Token)
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden || graph.IsClosed(36) {
+		t.Errorf("Expected road changes by a rider to be forbidden, got %d \n", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	api.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/edges/36", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected anyone to get an edge, got %d \n", recorder.Code)
+	}
+}
+
+func TestAPI_RiderPrivacy(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	world := NewWorld(25, graph)
+	sessions := NewSessions([]string{"0x00000000000000000000000000000000000000ad"})
+	rider := sessions.Guest()
+	admin := sessions.open("0x00000000000000000000000000000000000000ad", false)
+	world.trafficInfo.carStates = []CarInfo{{ID: 0, EdgeId: 3, Riders: []string{rider.Address, "0xb"}}}
+	world.updateSnapshot()
+	rides := NewRideTracker()
+	rides.ObserveRide(RideEvent{Type: RideAssigned, Rider: rider.Address, Time: time.Now()})
+	rides.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xb", Time: time.Now()})
+	api := NewAPI(world, graph, nil, rides)
+	api.SetSessions(sessions)
+	api.EnableAnalytics(NewFleetAnalytics(rides))
+	get := func(path string, session *Session) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, path, nil)
+		if session != nil {
+			request.Header.Set("Authorization", "Bearer "+session.Token)
+		}
+		recorder := httptest.NewRecorder()
+		api.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if recorder := get("/api/rides", nil); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("Expected rides to need a session, got %d \n", recorder.Code)
+	}
+	var rideViews []RideView
+	json.NewDecoder(get("/api/rides", &rider).Body).Decode(&rideViews)
+	if len(rideViews) != 1 || rideViews[0].Rider != rider.Address {
+		t.Errorf("Expected a rider to see only their own ride, got %+v \n", rideViews)
+	}
+	json.NewDecoder(get("/api/rides", &admin).Body).Decode(&rideViews)
+	if len(rideViews) != 2 {
+		t.Errorf("Expected an admin to see every ride, got %+v \n", rideViews)
+	}
+
+	var cars []CarView
+	json.NewDecoder(get("/api/cars", nil).Body).Decode(&cars)
+	if len(cars) != 1 || len(cars[0].Riders) != 0 {
+		t.Errorf("Riders of a car shown without a session, got %+v \n", cars)
+	}
+	var car CarView
+	json.NewDecoder(get("/api/cars/0", &rider).Body).Decode(&car)
+	if len(car.Riders) != 1 || car.Riders[0] != rider.Address {
+		t.Errorf("Expected a rider to see only themselves in a car, got %+v \n", car.Riders)
+	}
+	json.NewDecoder(get("/api/cars/0", &admin).Body).Decode(&car)
+	if len(car.Riders) != 2 {
+		t.Errorf("Expected an admin to see every rider in a car, got %+v \n", car.Riders)
+	}
+
+	if recorder := get("/api/analytics/rides.csv", &rider); recorder.Code != http.StatusForbidden {
+		t.Errorf("Expected analytics to be for admins only, got %d \n", recorder.Code)
+	}
+	if recorder := get("/api/analytics/rides.csv", &admin); recorder.Code != http.StatusOK {
+		t.Errorf("Expected an admin to export analytics, got %d \n", recorder.Code)
+	}
+}
@@ -1,11 +1,9 @@
 package sim2
 
 import (
-  "log"
-  "fmt"
   "time"
 	"math"
-	"strconv"
+	"math/rand"
 )
 
 // car - Describes routine hooks and logic for Cars within a World simulation
@@ -13,6 +11,12 @@ import (
 // The distance the car should move every drive call
 const MovementPerFrame = 2
 const MinimumStopDistance = 75
+// Distance from a yielding car within which a car with priority leaves too small a gap to enter
+const YieldGapDistance = 100
+// How often a car giving way at a roundabout or yield intersection looks for a gap again
+const YieldRecheckInterval = time.Millisecond * 200
+// How often a parked car asks its rebalance policy whether to move
+const ParkedReplanInterval = time.Second * 10
 // Car - struct for all info needed to manage a Car within a World simulation.
 type Car struct {
   // TODO determine if Car needs any additional/public members
@@ -24,22 +28,44 @@ type Car struct {
   ethApi       BlockchainInterface
   requestState RequestState
 	webChan chan Message
+  pricing      *PricingService  // When set, rides paying less than their quote are refused
+  rebalance    RebalancePolicy  // Decides where to go without a ride
+  capacity     uint  // Riders served at once
+  maxDetour    float64  // Distance a new rider may add beyond their own trip while others ride
+  acceptedRide Rider  // Set with requestState Success, waiting to be scheduled
+  acceptResults chan *Rider  // Outcome of the accept attempt while Trying, nil if it failed
+  rideObservers []RideObserver
+  metrics      *Metrics  // Records intersection waits and ride acceptance, nil to record nothing
+  logger       *Logger
+  clock        Clock  // Times stops, waits and ride events
+  breakdowns   chan time.Duration  // Breakdowns to start on the next frame, by how long they last
+  placed       bool  // PlaceAt was called, otherwise the car takes a spot picked by id on its first frame
+  random       *rand.Rand  // Picks detours and, with the default rebalance policy, idle destinations
 }
 
 type Path struct {
-  pickUp             Location
-  dropOff            Location
+  stops              []Stop  // Scheduled pick ups and drop offs, next stop first
   pos                Coords
   orientation				 float64
   edge               Edge
   state              PathState
   nextState          PathState
   routeEdges         []Edge
-  riderAddress       string
+  destination        Location  // Where routeEdges lead
+  routedAt           uint64  // Version of the road conditions routeEdges were planned with
+  stranded           bool  // No open route leads to destination, routeEdges only take the car down an open road
+  reconsiderAt       time.Time  // When to look for a faster route next, routing by travel times
   justReachedEdgeEnd bool
   stopAlarm          <-chan time.Time
-  waitingFor         IntersectionContext
   trafficInfo       TrafficInfo
+  idleDestination    Location  // Where the rebalance policy sent the car while it has no ride
+  parking            bool  // The car stops at idleDestination instead of asking for a new one
+  parked             bool
+  replanAlarm        <-chan time.Time
+  reachedEdgeEndAt   time.Time  // When the car last reached the end of an edge, to time intersection waits
+  repairAlarm        <-chan time.Time  // Set while the car is broken down and cannot move
+  lane               uint  // Of the current edge, 0 for its rightmost lane
+  laneChangeAt       time.Time  // When the car may change lanes again
 }
 
 type Location struct {
@@ -64,14 +90,8 @@ const (
   Fail    RequestState = 3
 )
 
-type IntersectionContext struct {
-	stoppedCars      []CarInfo
-	movingCars       []CarInfo
-	noCarsMoveSince  time.Time
-}
-
-
-// NewCar - Construct a new valid Car object
+// NewCar - Construct a new valid Car object; unless placed with PlaceAt, it parks on a plain road of graph
+//   picked by id when its loop begins.
 func NewCar(id uint, graph *Digraph, ethApi BlockchainInterface, sync chan TrafficInfo, send *chan CarInfo, webChan chan Message) *Car {
   c := new(Car)
   c.id = id
@@ -80,49 +100,272 @@ func NewCar(id uint, graph *Digraph, ethApi BlockchainInterface, sync chan Traff
   c.sendChan = send
   c.ethApi = ethApi
   c.webChan = webChan
-  c.path.pos = c.graph.Vertices[id*3+1].Pos
-  c.path.edge = *c.graph.Vertices[id*3+1].AdjEdges[0]
-	c.path.orientation = Coords{0,0}.Angle(c.path.edge.unitVector())
-  //TODO deal with random edge equals current edge
-  c.path.routeEdges, _ = c.getShortestPathToEdge(c.graph.getRandomEdge())
+  c.capacity = 1
+  c.SetLogger(defaultLogger)
+  c.clock = systemClock
+  c.breakdowns = make(chan time.Duration, 1)
+  c.acceptResults = make(chan *Rider, 1)
+  c.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+  c.rebalance = &RandomCruise{graph: graph, rand: c.random}
 
   return c
 }
 
+// placeByID - Move the car to a spot of its own picked by id, however many cars the map has room for.
+func (c *Car) placeByID() {
+  if slots := placementSlots(c.graph, DefaultPlacementSpacing); len(slots) > 0 {
+    c.PlaceAt(slots[int(c.id) % len(slots)])
+  } else {
+    c.PlaceAt(Coords{})
+  }
+}
+
+// PlaceAt - Move the car to the point on a plain road closest to pos; call before CarLoop.
+func (c *Car) PlaceAt(pos Coords) {
+  location := closestParkingLocation(c.graph, pos)
+  c.path.pos = location.intersect
+  c.path.edge = location.edge
+  c.path.orientation = Coords{0,0}.Angle(c.path.edge.unitVector())
+  c.planIdleRoute()
+  c.placed = true
+}
+
+// SetClock - Time stops, waits and ride events by clock; call before CarLoop.
+func (c *Car) SetClock(clock Clock) {
+  c.clock = clock
+}
+
+// SetSeed - Seed the car's detours and, unless another rebalance policy is set, its idle destinations, so
+//   runs with the same seed drive the same way; call before CarLoop.
+func (c *Car) SetSeed(seed int64) {
+  c.random.Seed(seed)
+}
+
+// BreakDown - Stop the car where it is for duration, starting on its next frame.
+//   Returns false if the car already has a breakdown waiting to start.
+func (c *Car) BreakDown(duration time.Duration) bool {
+  select {
+  case c.breakdowns <- duration:
+    return true
+  default:
+    return false
+  }
+}
+
+// SetRebalancePolicy - Use policy to decide where to go while the car has no ride.
+func (c *Car) SetRebalancePolicy(policy RebalancePolicy) {
+  c.rebalance = policy
+  if c.placed && c.path.state == DrivingAtRandom {  // Otherwise placing the car plans its idle route
+    c.planIdleRoute()
+  }
+}
+
+// EnablePooling - Serve up to capacity riders at once, accepting a new rider only if they add at most
+//   maxDetour distance beyond their own trip to the scheduled stops.
+func (c *Car) EnablePooling(capacity uint, maxDetour float64) {
+  c.capacity = capacity
+  c.maxDetour = maxDetour
+}
+
+// SetLogger - Log to the car component of logger, tagging entries with the car's ID.
+func (c *Car) SetLogger(logger *Logger) {
+  c.logger = logger.Component("car").With(Fields{CarIDField:c.id})
+}
+
+// SetMetrics - Record intersection waits and ride acceptance in metrics.
+func (c *Car) SetMetrics(metrics *Metrics) {
+  c.metrics = metrics
+}
+
+// AddRideObserver - Report when this car is assigned, picks up or drops off a rider to observer.
+func (c *Car) AddRideObserver(observer RideObserver) {
+  c.rideObservers = append(c.rideObservers, observer)
+}
+
+// reportRide - Share event of this car, happening now, with the ride observers.
+func (c *Car) reportRide(event RideEvent) {
+  event.CarID = c.id
+  event.Time = c.clock.Now()
+  for _, observer := range c.rideObservers {
+    observer.ObserveRide(event)
+  }
+}
+
+// planIdleRoute - Ask the rebalance policy where to go next and route there.
+func (c *Car) planIdleRoute() {
+  destination, park := c.rebalance.IdleDestination(c.path.pos, c.path.edge)
+  c.path.idleDestination = destination
+  c.path.parking = park
+  c.path.parked = false
+  c.routeTo(destination)
+}
+
+// routeTo - Route to the edge of destination, unless it lies ahead on the current edge.
+//   Without an open route the car heads down an open road and tries again at the next vertex.
+func (c *Car) routeTo(destination Location) {
+  c.path.destination = destination
+  c.path.routedAt = c.graph.roadsVersion()
+  if destination.edge.ID == c.path.edge.ID && c.path.isAhead(destination.intersect) {
+    c.path.routeEdges = nil
+    c.path.stranded = false
+    return
+  }
+  edges, dist := c.getShortestPathToEdge(destination.edge)
+  if math.IsInf(dist, 1) {
+    c.detour()
+    return
+  }
+  if c.path.stranded {
+    c.logger.Info("Found a route again", Fields{EdgeIDField:destination.edge.ID})
+  }
+  c.path.routeEdges = edges
+  c.path.stranded = false
+}
+
+// detour - Take a random open road from the end of the current edge, as no open route leads to the destination.
+//   Roads leading back to where the car is are preferred, so it does not get stuck behind a closure. Caught
+//   where every way out is closed, the car leaves over a closed road rather than wait for it to open;
+//   only at the end of a road without any exit does it wait.
+func (c *Car) detour() {
+  if !c.path.stranded {
+    c.logger.Warn("No open route, detouring", Fields{EdgeIDField:c.path.destination.edge.ID})
+  }
+  c.path.stranded = true
+  c.path.routeEdges = nil
+  var open, circling, closed []Edge
+  var returning map[uint]bool
+  for _, edge := range c.path.edge.End.AdjEdges {
+    if !c.graph.canDrive(edge) {
+      if edge.movement == nil || edge.movement.Allowed {
+        closed = append(closed, *edge)  // Closed rather than a forbidden turn
+      }
+      continue
+    }
+    open = append(open, *edge)
+    if returning == nil {
+      returning = c.graph.connectedVertices(c.path.edge.End.ID, true)
+    }
+    if returning[edge.End.ID] {
+      circling = append(circling, *edge)
+    }
+  }
+  if len(circling) > 0 {
+    open = circling
+  }
+  if len(open) == 0 && len(closed) > 0 {
+    c.logger.Warn("Caught behind a closure, leaving over the closed road", Fields{EdgeIDField:c.path.edge.ID})
+    open = closed
+  }
+  if len(open) > 0 {
+    c.path.routeEdges = []Edge{open[c.random.Intn(len(open))]}
+  }
+}
+
+// reroute - Route again from the end of the current edge if the road conditions of the rest of the route
+//   changed since it was planned, or if no route led to the destination then. Routing by travel times,
+//   switch to a much faster route every so often.
+func (c *Car) reroute() {
+  if c.path.stranded || c.graph.changedSince(c.path.routedAt, c.path.routeEdges) {
+    c.logger.Debug("Rerouting", Fields{EdgeIDField:c.path.edge.ID})
+    c.routeTo(c.path.destination)
+  } else if c.graph.travelTimes != nil && len(c.path.routeEdges) > 0 && !c.clock.Now().Before(c.path.reconsiderAt) {
+    c.path.reconsiderAt = c.clock.Now().Add(RouteReconsiderInterval)
+    edges, dist := c.getShortestPathToEdge(c.path.destination.edge)
+    remaining, faster := c.graph.travelCost(c.path.routeEdges), c.graph.travelCost(edges)
+    if !math.IsInf(dist, 1) && faster < remaining * (1 - FasterRouteMargin) {
+      c.logger.Debug("Found a faster route", Fields{EdgeIDField:c.path.edge.ID, "remaining":remaining, "faster":faster})
+      c.path.routeEdges = edges
+    }
+  }
+}
+
+// currentLocation - where the car is now, as a location on the graph.
+func (c *Car) currentLocation() Location {
+  return Location{intersect:c.path.pos, edge:c.path.edge}
+}
+
+// getShortestPathToEdge - route from the end of the current edge onto edge, nil at infinite distance if there is none.
+//   There is none onto an edge the car may not drive, such as a closed road or a forbidden turn.
 func (c *Car) getShortestPathToEdge(edge Edge) (edges []Edge, dist float64) {
+	if !c.graph.canDrive(&edge) {
+		return nil, math.Inf(1)
+	}
 	edges, dist = c.graph.shortestPath(c.path.edge.End.ID, edge.Start.ID)
+	if math.IsInf(dist, 1) {
+		return nil, dist
+	}
 	edges = append(edges, edge)
-	fmt.Print("Car ", c.id," new path ")
-	for _ , edge := range edges {
-		fmt.Print(edge.End.ID," ")
+	if c.logger.Enabled(DebugLevel) {
+		vertices := make([]uint, len(edges))
+		for idx, edge := range edges {
+			vertices[idx] = edge.End.ID
+		}
+		c.logger.Debug("New path", Fields{EdgeIDField:edge.ID, "vertices":vertices})
 	}
-	fmt.Println()
 	return
 }
 
-// CarLoop - Begin the car simulation execution loop
+// EnforceFares - Refuse rides whose escrowed amount is below the fare quoted by pricing; nil accepts all rides.
+func (c *Car) EnforceFares(pricing *PricingService) {
+  c.pricing = pricing
+}
+
+// CarLoop - Begin the car simulation execution loop, returning once the world closes the sync channel
 func (c *Car) CarLoop() {
+  if !c.placed {
+    c.placeByID()
+  }
   for {
     //TODO pull out the current car's id in the next line
-    c.path.trafficInfo =  <-c.syncChan // Block waiting for next sync event
-    c.drive()
+    trafficInfo, ok := <-c.syncChan // Block waiting for next sync event
+    if !ok {
+      return  // The world stopped
+    }
+    c.path.trafficInfo = trafficInfo
+    if !c.brokenDown() {
+      c.drive()
+    }
     if !c.path.edge.Wraps {
 			desiredAngle := Coords{0, 0}.Angle(c.path.edge.unitVector())
 			c.path.orientation = determineOrientation(c.path.orientation, desiredAngle, 3)
 		}
-    info := CarInfo{ID:c.id, Pos:c.path.pos, Vel:Coords{0,0}, Dir:c.path.orientation, EdgeId:c.path.edge.ID }
+    info := CarInfo{ID:c.id, Pos:c.path.pos, Vel:Coords{0,0}, Dir:c.path.orientation, EdgeId:c.path.edge.ID,
+      State:c.path.state, NextState:c.path.nextState, Parked:c.path.parked, BrokenDown:c.path.repairAlarm != nil,
+      Lane:c.path.lane, Reservation:c.reservationRequest(), Route:c.path.routeIDs(), Riders:stopRiders(c.path.stops) }
     *c.sendChan <- info
   }
 }
 
+// brokenDown - Start a waiting breakdown, and true while the car is broken down.
+func (c *Car) brokenDown() bool {
+  select {
+  case duration := <-c.breakdowns:
+    c.logger.Warn("Broke down", Fields{EdgeIDField:c.path.edge.ID, "duration":duration})
+    c.path.repairAlarm = c.clock.After(duration)
+  default:
+  }
+  if c.path.repairAlarm == nil {
+    return false
+  }
+  select {
+  case <-c.path.repairAlarm:
+    c.logger.Info("Repaired", Fields{EdgeIDField:c.path.edge.ID})
+    c.path.repairAlarm = nil
+    return false
+  default:
+    return true
+  }
+}
+
 func (c *Car) drive () {
   switch c.path.state {
   case DrivingAtRandom:
     c.checkRequestState()
     c.driveToDestination()
-  case ToPickUp:
-    c.driveToDestination()
-  case ToDropOff:
+  case ToPickUp, ToDropOff:
+    if numRiders(c.path.stops) < c.capacity {
+      c.checkRequestState()
+    }
     c.driveToDestination()
   case Stopped:
     //select {
@@ -146,55 +389,128 @@ func (c *Car) driveToDestination() {
   } else {
     switch c.path.state {
     case DrivingAtRandom:
-      c.path.routeEdges, _ = c.getShortestPathToEdge(c.graph.getRandomEdge())
-      c.path.state = DrivingAtRandom
-    case ToPickUp:
-      if c.driveOnCurrentEdgeTowards(c.path.pickUp.intersect) {
-        fmt.Println("Car",c.id," Reached Pick Up, To Drop off")
-				c.webChan <- Message{
-					Type:"RideStatus",
-					Address:c.path.riderAddress,
-					State:"At Pick Up",
-					ID: strconv.Itoa(int(c.id)),
-				}
-        c.path.routeEdges, _ = c.getShortestPathToEdge(c.path.dropOff.edge)
-        c.path.state = Waiting
-        c.path.nextState = ToDropOff
-        c.path.stopAlarm = time.After(time.Second * 5)
+      if !c.path.parking {
+        c.planIdleRoute()
+      } else if c.path.parked {
+        select {
+        case <-c.path.replanAlarm:
+          c.planIdleRoute()
+        default:
+        }
+      } else if c.driveOnCurrentEdgeTowards(c.path.idleDestination.intersect) {
+        c.path.parked = true
+        c.path.replanAlarm = c.clock.After(ParkedReplanInterval)
       }
-    case ToDropOff:
-      if c.driveOnCurrentEdgeTowards(c.path.dropOff.intersect) {
-        fmt.Println("Car",c.id," Reached Drop off, back to Random")
-        c.webChan <- Message{
-					Type:"RideStatus",
-					Address:c.path.riderAddress,
-					State:"At Drop Off",
-					ID: strconv.Itoa(int(c.id)),
-				}
-        c.path.routeEdges, _ = c.getShortestPathToEdge(c.graph.getRandomEdge())
-        c.path.state = Waiting
-        c.path.nextState = DrivingAtRandom
-        c.path.stopAlarm = time.After(time.Second * 5)
+    case ToPickUp, ToDropOff:
+      if c.driveOnCurrentEdgeTowards(c.path.stops[0].location.intersect) {
+        if stop := c.path.stops[0]; stop.kind == PickUpStop && c.riderWalking(stop.rider) {
+          c.logger.Debug("Waiting for rider to walk to the pick up", Fields{RiderField:stop.rider, EdgeIDField:c.path.edge.ID})
+          c.path.nextState = c.path.state
+          c.path.state = Waiting
+          c.path.stopAlarm = c.clock.After(RiderWalkRecheckInterval)
+        } else {
+          c.arriveAtStop()
+        }
       }
     }
   }
 }
 
+// arriveAtStop - Serve the next scheduled stop, then wait there before heading to the stop after it.
+func (c *Car) arriveAtStop() {
+  stop := c.path.stops[0]
+  c.path.stops = c.path.stops[1:]
+  if stop.kind == PickUpStop {
+    c.logger.Info("Reached pick up", Fields{RiderField:stop.rider, EdgeIDField:c.path.edge.ID})
+    c.sendRideStatus(stop.rider, "At Pick Up")
+    c.reportRide(RideEvent{Type:RidePickedUp, Rider:stop.rider, Location:stop.location})
+  } else {
+    c.logger.Info("Reached drop off", Fields{RiderField:stop.rider, EdgeIDField:c.path.edge.ID})
+    c.sendRideStatus(stop.rider, "At Drop Off")
+    c.reportRide(RideEvent{Type:RideDroppedOff, Rider:stop.rider, Location:stop.location})
+  }
+  c.path.state = Waiting
+  c.path.nextState = c.stopState()
+  c.path.stopAlarm = c.clock.After(time.Second * 5)
+  if len(c.path.stops) > 0 {
+    c.routeTo(c.path.stops[0].location)
+  } else {
+    c.planIdleRoute()
+  }
+}
+
+// stopState - path state for heading to the next scheduled stop.
+func (c *Car) stopState() PathState {
+  if len(c.path.stops) == 0 {
+    return DrivingAtRandom
+  } else if c.path.stops[0].kind == PickUpStop {
+    return ToPickUp
+  }
+  return ToDropOff
+}
+
+// scheduleRider - Insert an accepted rider into the stops and reroute if the next stop changed.
+func (c *Car) scheduleRider(rider Rider) {
+  stops, _ := planInsertion(c.graph, c.currentLocation(), c.path.stops, rider)
+  if stops == nil {
+    c.logger.Warn("No route to serve rider, scheduling it last", Fields{RiderField:rider.address})
+    stops = append(c.path.stops, Stop{rider.address, PickUpStop, rider.pickUp}, Stop{rider.address, DropOffStop, rider.dropOff})
+  }
+  for _, stop := range c.path.stops {
+    if stop.kind == DropOffStop {
+      c.sendRideStatus(stop.rider, "Ride Shared")
+    }
+  }
+  c.sendRideStatus(rider.address, "To Pick Up")
+  c.reportRide(RideEvent{Type:RideAssigned, Rider:rider.address, Location:rider.pickUp, From:rider.from, Amount:rider.amount,
+    Distance:c.graph.routeDistance(rider.pickUp, rider.dropOff)})
+  if len(c.path.stops) == 0 || c.path.stops[0] != stops[0] {
+    c.routeTo(stops[0].location)
+  }
+  c.path.stops = stops
+  c.path.state = c.stopState()
+}
+
+func (c *Car) sendRideStatus(rider string, state string) {
+  carID := c.id
+  if !offer(c.webChan, RideStatusMessage{CarID:&carID, Address:rider, State:state}) {
+    c.logger.Warn("Dropped ride status, web output is not keeping up", Fields{RiderField:rider, "state":state})
+  }
+}
+
 func (p *Path) destinationEdgeReached() (bool) {
-  return len(p.routeEdges) == 0
+  return len(p.routeEdges) == 0 && !p.stranded
+}
+
+// isAhead - true if pos on the current edge has not been passed yet.
+func (p *Path) isAhead(pos Coords) (bool) {
+  return p.pos.Distance(p.edge.End.Pos) >= pos.Distance(p.edge.End.Pos)
+}
+
+// routeIDs - IDs of the edges left on the route.
+func (p *Path) routeIDs() (ids []uint) {
+  for _, edge := range p.routeEdges {
+    ids = append(ids, edge.ID)
+  }
+  return
 }
 
 func (p *Path) loadNextEdge() () {
   p.edge = p.routeEdges[0]
   p.routeEdges = p.routeEdges[1:]
   p.justReachedEdgeEnd = false;
+  p.lane = p.edge.clampLane(p.lane)
 }
 
 func (c *Car) collisionInNextEdge() bool {
 	carInfos := removeCar(c.path.trafficInfo.carStates, c.id)
+	lane := c.path.routeEdges[0].clampLane(c.path.lane)
 	//fmt.Printf("car %d info address %p \n", c.id, &carInfos)
 	for _, otherCarInfo := range carInfos {
-		if otherCarInfo.EdgeId == c.path.routeEdges[0].ID {
+		if otherCarInfo.Parked {
+			continue  // Pulled over, out of the way
+		}
+		if otherCarInfo.EdgeId == c.path.routeEdges[0].ID && otherCarInfo.Lane == lane {
 			if c.path.routeEdges[0].Wraps {
 				return true
 			}
@@ -217,7 +533,8 @@ func (c *Car) driveOnCurrentEdgeTowards(endPos Coords) (bool) {
     c.path.pos = endPos
     return true
   } else {
-    if !c.collisionAhead() {
+    c.changeLane()
+    if _, blocked := c.carInLane(c.path.lane); !blocked {
       c.path.pos = c.path.pos.ProjectInDirection(MovementPerFrame, c.path.edge.End.Pos)
     }
     return false
@@ -226,37 +543,56 @@ func (c *Car) driveOnCurrentEdgeTowards(endPos Coords) (bool) {
 
 func (c *Car) keepDrivingOnRoute() () {
   if c.path.pos == c.path.edge.End.Pos {
-    if c.path.edge.End.intersection != nil {
+    if len(c.path.routeEdges) == 0 {
+      // Stranded at a dead end, until a road opens
+      if c.graph.roadsVersion() != c.path.routedAt {
+        c.routeTo(c.path.destination)
+      }
+    } else if c.path.edge.End.intersection != nil {
       switch c.path.edge.End.intersection.intersectionType {
       case StopSign:
         if c.path.justReachedEdgeEnd { // Just reached waitingFor
           //fmt.Println("Car ", c.id," Reached Stop Sign")
-          c.saveStopSignInfo()
           c.path.nextState = c.path.state
           c.path.state = Waiting
-          c.path.stopAlarm = time.After(time.Second * 2)
+          c.path.stopAlarm = c.clock.After(time.Second * 2)
           c.path.justReachedEdgeEnd = false
         } else if c.clearToPassStopSign() {
           //fmt.Println("Car ", c.id," clear to cross intersection")
-          if !c.collisionInNextEdge() {
-						c.path.loadNextEdge()
-					}
+          c.crossIntersection(StopSign)
         } else {
           c.path.nextState = c.path.state
           c.path.state = Waiting
-          c.path.stopAlarm = time.After(time.Millisecond * 500)
+          c.path.stopAlarm = c.clock.After(time.Millisecond * 500)
         }
 
       case StopLight:
         if c.clearToPassStopLight() {
-					if !c.collisionInNextEdge() {
-						c.path.loadNextEdge()
-					}
+					c.crossIntersection(StopLight)
         } else {
 					c.path.nextState = c.path.state
 					c.path.state = Waiting
-					c.path.stopAlarm = time.After(time.Millisecond * 500)
+					c.path.stopAlarm = c.clock.After(time.Millisecond * 500)
 				}
+
+      case Roundabout, Yield:
+        if c.gapToEnter() {
+          c.crossIntersection(c.path.edge.End.intersection.intersectionType)
+        } else {
+          c.path.nextState = c.path.state
+          c.path.state = Waiting
+          c.path.stopAlarm = c.clock.After(YieldRecheckInterval)
+        }
+
+      case Autonomous:
+        if c.path.trafficInfo.reservationGrants[c.id] {
+          c.crossIntersection(Autonomous)
+        } else {
+          c.logger.Debug("Waiting for reservation", Fields{EdgeIDField:c.path.edge.ID})
+          c.path.nextState = c.path.state
+          c.path.state = Waiting
+          c.path.stopAlarm = c.clock.After(ReservationRecheckInterval)
+        }
       }
     } else {
 			if !c.collisionInNextEdge() {
@@ -265,87 +601,168 @@ func (c *Car) keepDrivingOnRoute() () {
       if c.path.edge.Wraps {
       	c.path.pos = c.path.edge.End.Pos
       	c.path.justReachedEdgeEnd = true
+      	c.reroute()
 			}
     }
   } else if c.path.pos.Distance(c.path.edge.End.Pos) > MovementPerFrame {
-    if !c.collisionAhead() {
+    c.changeLane()
+    if _, blocked := c.carInLane(c.path.lane); !blocked {
       c.path.pos = c.path.pos.ProjectInDirection(MovementPerFrame, c.path.edge.End.Pos)
     }
   } else {
     c.path.pos = c.path.edge.End.Pos
     c.path.justReachedEdgeEnd = true
+    c.path.reachedEdgeEndAt = c.clock.Now()
+    c.reroute()
   }
 }
 
-func (c *Car) saveStopSignInfo() {
-	otherCars := removeCar(c.path.trafficInfo.carStates, c.id)
-	c.path.waitingFor.movingCars = c.getCarsMovingInIntersection(otherCars)
-	c.path.waitingFor.stoppedCars = c.getCarsStoppedAtIntersection(otherCars)
-	if len(c.path.waitingFor.movingCars) == 0 {
-		c.path.waitingFor.noCarsMoveSince = time.Now()
-	}
+// clearToPassStopSign - true if the world gave the car right of way at the stop sign it waits at.
+func (c *Car) clearToPassStopSign() bool {
+  if !c.path.trafficInfo.stopSignGrants[c.id] {
+    c.logger.Debug("Waiting for right of way", Fields{EdgeIDField:c.path.edge.ID})
+    return false
+  }
+  return true
 }
 
-func (c *Car) clearToPassStopSign() (clear bool) {
-  clear = true
-  otherCars := removeCar(c.path.trafficInfo.carStates, c.id)
 
-	currentlyMovingCars := c.getCarsMovingInIntersection(otherCars)
-	for _, alreadyMovingCar := range c.path.waitingFor.movingCars {
-		if carIsPresent(currentlyMovingCars, alreadyMovingCar.ID) {
-			fmt.Println("Car ", c.id," waiting on car ", alreadyMovingCar.ID," to finish crossing")
-			clear = false
-		} else {
-			c.path.waitingFor.movingCars = removeCar(c.path.waitingFor.movingCars, alreadyMovingCar.ID)
-			if len(c.path.waitingFor.movingCars) == 0 {
-				c.path.waitingFor.noCarsMoveSince = time.Now()
-			}
-		}
-	}
-
-  currentlyStoppedCars := c.getCarsStoppedAtIntersection(otherCars)
-  for _, alreadyStoppedCar := range c.path.waitingFor.stoppedCars {
-    if carIsPresent(currentlyStoppedCars, alreadyStoppedCar.ID) {
-      fmt.Println("Car ", c.id," waiting on car ", alreadyStoppedCar.ID," to start crossing ")
-      clear = false
-    } else {
-      c.path.waitingFor.stoppedCars = removeCar(c.path.waitingFor.stoppedCars, alreadyStoppedCar.ID)
-      if carIsPresent(currentlyMovingCars, alreadyStoppedCar.ID) {
-        fmt.Println("Car ", c.id," waiting on car ", alreadyStoppedCar.ID," to finish crossing")
-        c.path.waitingFor.movingCars = append(c.path.waitingFor.movingCars, alreadyStoppedCar)
-        clear = false
-      } else {
-        // Good to go
-      }
-    }
+// crossIntersection - Enter the next edge unless a car blocks it or a pedestrian crosses in front, recording
+//   the wait at the intersection.
+func (c *Car) crossIntersection(intersectionType IntersectionType) {
+  if !c.collisionInNextEdge() && !c.pedestrianCrossing() {
+    c.metrics.ObserveIntersectionWait(intersectionType, c.clock.Now().Sub(c.path.reachedEdgeEndAt))
+    c.path.loadNextEdge()
   }
-
-	// break deadlocks if cars arrive at the same time
-	if len(c.path.waitingFor.movingCars) == 0 && len(c.path.waitingFor.stoppedCars) > 0 {
-		if time.Now().Sub(c.path.waitingFor.noCarsMoveSince) > time.Second * 5 {
-			clear = true
-			for _, stoppedCar := range c.path.waitingFor.stoppedCars {
-				if stoppedCar.ID > c.id {
-					clear = false
-					fmt.Println("Broke Dead Lock")
-				}
-			}
-		}
-	}
-	return
 }
 
-
-func (c *Car) collisionAhead() bool {
+// carInLane - the car closer than MinimumStopDistance ahead in lane of the current edge, parked cars aside,
+//   and true if there is one.
+func (c *Car) carInLane(lane uint) (blocker CarInfo, blocked bool) {
   carInfos := removeCar(c.path.trafficInfo.carStates, c.id)
-  //fmt.Printf("car %d info address %p \n", c.id, &carInfos)
   for _, otherCarInfo := range carInfos {
-    if otherCarInfo.EdgeId == c.path.edge.ID {
+    if otherCarInfo.EdgeId == c.path.edge.ID && otherCarInfo.Lane == lane && !otherCarInfo.Parked {
       edgeEndPos := c.path.edge.End.Pos
       otherCarDistanceToEdge := otherCarInfo.Pos.Distance(edgeEndPos)
       thisCarDistanceToEdge := c.path.pos.Distance(edgeEndPos)
       distanceBetweenCars := thisCarDistanceToEdge - otherCarDistanceToEdge
       if distanceBetweenCars > 0 && distanceBetweenCars < MinimumStopDistance {
+        return otherCarInfo, true
+      }
+    }
+  }
+  return
+}
+
+// laneClear - true if no car drives in lane of the current edge within MinimumStopDistance of the car and
+//   no stopped car waits ahead in it, parked cars aside.
+func (c *Car) laneClear(lane uint) bool {
+  carInfos := removeCar(c.path.trafficInfo.carStates, c.id)
+  for _, otherCarInfo := range carInfos {
+    if otherCarInfo.EdgeId == c.path.edge.ID && otherCarInfo.Lane == lane && !otherCarInfo.Parked {
+      edgeEndPos := c.path.edge.End.Pos
+      distanceBetweenCars := c.path.pos.Distance(edgeEndPos) - otherCarInfo.Pos.Distance(edgeEndPos)
+      if math.Abs(distanceBetweenCars) < MinimumStopDistance ||
+        (distanceBetweenCars > 0 && otherCarInfo.isStoppedInLane(&c.path.edge)) {
+        return false
+      }
+    }
+  }
+  return true
+}
+
+// changeLane - Move over a lane towards the lane for the next turn, towards the rightmost lane before
+//   stopping on the current edge, or past a stopped car blocking the lane, if the lane beside is clear.
+func (c *Car) changeLane() {
+  lanes := c.path.edge.laneCount()
+  if lanes < 2 || c.clock.Now().Before(c.path.laneChangeAt) {
+    return
+  }
+  target, ok := c.desiredLane(lanes)
+  if blocker, blocked := c.carInLane(c.path.lane); blocked && blocker.isStoppedInLane(&c.path.edge) &&
+    (!ok || target == c.path.lane) {
+    // Overtake on the left where there is a lane, else on the right
+    target, ok = c.path.lane + 1, true
+    if target == lanes {
+      target = c.path.lane - 1
+    }
+  }
+  if !ok || target == c.path.lane {
+    return
+  }
+  next := c.path.lane + 1
+  if target < c.path.lane {
+    next = c.path.lane - 1
+  }
+  if !c.laneClear(next) {
+    return
+  }
+  c.logger.Debug("Changed lane", Fields{EdgeIDField:c.path.edge.ID, "lane":next})
+  c.path.lane = next
+  c.path.laneChangeAt = c.clock.Now().Add(LaneChangeInterval)
+}
+
+// desiredLane - lane the car should drive in on the current edge, which has lanes lanes: the rightmost lane
+//   before stopping on it, or near its end the lane for the turn to the next edge; false when any will do.
+func (c *Car) desiredLane(lanes uint) (lane uint, ok bool) {
+  if c.path.destinationEdgeReached() {
+    return 0, c.path.state == ToPickUp || c.path.state == ToDropOff || c.path.parking
+  }
+  if len(c.path.routeEdges) == 0 || c.path.pos.Distance(c.path.edge.End.Pos) > TurnLaneDistance {
+    return 0, false
+  }
+  return turnLane(&c.path.routeEdges[0], lanes)
+}
+
+// gapToEnter - true if the car may enter the roundabout or yield intersection at the end of its edge without
+//   stopping: always from an entry with priority, else once no car with priority is within YieldGapDistance
+//   of the entry and heading for it, from the positions of the other cars.
+func (c *Car) gapToEnter() bool {
+  entryVertex := c.path.edge.End
+  intersection := entryVertex.intersection
+  if !intersection.entries[entryVertex.directionFromIntersection].yields {
+    return true
+  }
+  for _, otherCarInfo := range removeCar(c.path.trafficInfo.carStates, c.id) {
+    edge, ok := c.graph.Edges[otherCarInfo.EdgeId]
+    if !ok || otherCarInfo.Parked {
+      continue
+    }
+    inIntersection := edge.crosses == intersection && otherCarInfo.Pos != edge.End.Pos
+    onPriorityEntry := edge.End.intersection == intersection && edge.crosses == nil &&
+      !intersection.entries[edge.End.directionFromIntersection].yields
+    if !inIntersection && !onPriorityEntry {
+      continue
+    }
+    gap := otherCarInfo.Pos.Distance(edge.End.Pos)  // Priority traffic on its way into the intersection
+    if inIntersection {
+      toEntry := Coords{entryVertex.Pos.X - otherCarInfo.Pos.X, entryVertex.Pos.Y - otherCarInfo.Pos.Y}
+      direction := heading(edge)
+      if toEntry.X * direction.X + toEntry.Y * direction.Y <= 0 {
+        continue  // Past the entry already
+      }
+      gap = otherCarInfo.Pos.Distance(entryVertex.Pos)
+    }
+    if gap < YieldGapDistance {
+      c.logger.Debug("Giving way", Fields{"other_car_id":otherCarInfo.ID, EdgeIDField:c.path.edge.ID})
+      return false
+    }
+  }
+  return true
+}
+
+// pedestrianCrossing - true if a pedestrian is on a crosswalk the car would drive over crossing the
+//   intersection at the end of its edge.
+func (c *Car) pedestrianCrossing() bool {
+  if len(c.path.routeEdges) == 0 || c.path.routeEdges[0].movement == nil {
+    return false
+  }
+  path := c.path.routeEdges[0].movement.path()
+  for _, pedestrian := range c.path.trafficInfo.pedestrians {
+    if pedestrian.Crossing && pedestrian.Crosswalk < uint(len(c.graph.Crosswalks)) {
+      crosswalk := c.graph.Crosswalks[pedestrian.Crosswalk]
+      if crosswalk.intersection == c.path.edge.End.intersection && crosswalk.crosses(path) {
+        c.logger.Debug("Giving way to pedestrian", Fields{"pedestrian_id":pedestrian.ID, EdgeIDField:c.path.edge.ID})
         return true
       }
     }
@@ -353,6 +770,31 @@ func (c *Car) collisionAhead() bool {
   return false
 }
 
+// riderWalking - true if rider is still walking to the pick up.
+func (c *Car) riderWalking(rider string) bool {
+  for _, pedestrian := range c.path.trafficInfo.pedestrians {
+    if pedestrian.Rider == rider {
+      return true
+    }
+  }
+  return false
+}
+
+// reservationRequest - request to cross the autonomous intersection at the end of the edge on the route,
+//   once within ReservationDistance of it; nil elsewhere.
+func (c *Car) reservationRequest() *ReservationRequest {
+  entry := c.path.edge.End
+  if entry.intersection == nil || entry.intersection.intersectionType != Autonomous || len(c.path.routeEdges) == 0 ||
+    c.path.repairAlarm != nil || (c.path.state == Waiting && c.path.pos != entry.Pos) {
+    return nil  // Not on its way into the intersection
+  }
+  distance := c.path.pos.Distance(entry.Pos)
+  if distance > ReservationDistance {
+    return nil
+  }
+  return &ReservationRequest{Edge:c.path.routeEdges[0].ID, Distance:distance}
+}
+
 func (c *Car) clearToPassStopLight() (clear bool) {
 	for _, stopLight := range c.path.trafficInfo.stopLights {
 		if stopLight.ID == c.path.edge.End.intersection.id {
@@ -373,100 +815,118 @@ func (c *Car) clearToPassStopLight() (clear bool) {
 
 func (c *Car) checkRequestState() {
   if c.requestState == Trying {
+    select {
+    case rider := <-c.acceptResults:
+      if rider == nil {
+        c.requestState = Fail
+      } else {
+        c.acceptedRide = *rider
+        c.requestState = Success
+      }
+    default:
+    }
     return
   } else {
     if c.requestState == Fail || c.requestState == None {
       if available, address := c.ethApi.GetRideAddressIfAvailable(); available == true {
-        fmt.Println("Car",c.id," Found a Ride")
-        go c.tryToAcceptRequest(address)
+        c.logger.Info("Found a ride", Fields{RiderField:address})
+        stops := make([]Stop, len(c.path.stops))
+        copy(stops, c.path.stops)
+        go c.tryToAcceptRequest(address, c.currentLocation(), stops)
         c.requestState = Trying;
       }
     }else if c.requestState == Success {
-      fmt.Println("Car",c.id," Got the Ride, To Pick Up")
-			c.webChan <- Message{
-				Type:"RideStatus",
-				Address:c.path.riderAddress,
-				State:"To Pick Up",
-				ID: strconv.Itoa(int(c.id)),
-			}
-      c.path.pickUp, c.path.dropOff = c.getLocations()
-      c.path.routeEdges, _ = c.getShortestPathToEdge(c.path.pickUp.edge)
-      c.path.state = ToPickUp
+      c.logger.Info("Got the ride, to pick up", Fields{RiderField:c.acceptedRide.address})
+      c.path.parking = false
+      c.path.parked = false
+      c.scheduleRider(c.acceptedRide)
       c.requestState = None
     }
   }
 }
 
-func (c *Car) tryToAcceptRequest(address string) {
-  if c.ethApi.AcceptRequest(address) {
-    log.Println("Car ",c.id," Accept Request success")
-    c.path.riderAddress = address
-    c.requestState = Success
-  } else {
-    log.Println("Car ",c.id," Accept Request failed")
-    c.requestState = Fail
+// tryToAcceptRequest - Accept the ride from address if it pays its fare and fits into the snapshot of
+//   the car's stops; runs outside the car loop since blockchain calls are slow, and hands the rider
+//   accepted, or nil, back to the car loop over acceptResults.
+func (c *Car) tryToAcceptRequest(address string, start Location, stops []Stop) {
+  from, to := c.ethApi.GetLocations(address)
+  var amount uint64
+  if c.pricing != nil {
+    amount = c.ethApi.GetAmount(address)
+    if !c.fareIsCovered(address, from, to, amount) {
+      c.acceptResults <- nil
+      return
+    }
   }
-}
-
-func (c *Car) getLocations() (pickup Location, dropOff Location) {
-  //TODO: recover from improperly formatted locations
-  from, to := c.ethApi.GetLocations(c.path.riderAddress)
-  fmt.Println("Car",c.id," locations ",from," ", to)
-  numbers := splitLine(from, ",", 2)
-  pickup = c.graph.closestEdgeAndCoord(Coords{numbers[0],numbers[1]})
-  fmt.Println("Pick Up", pickup.edge.Start.ID, " ", pickup.edge.End.ID)
-  numbers = splitLine(to, ",", 2)
-  dropOff = c.graph.closestEdgeAndCoord(Coords{numbers[0],numbers[1]})
-  fmt.Println("Drop Off", dropOff.edge.Start.ID, " ", dropOff.edge.End.ID)
-  return
-}
-
-func removeCar(cars []CarInfo, blackSheep uint) ([]CarInfo) {
-  for i, car := range cars {
-    if car.ID == blackSheep {
-      return append(cars[:i], cars[i+1:]...)
+  rider, err := c.getRider(address, from, to)
+  if err != nil {
+    c.logger.Warn("Refused ride", Fields{RiderField:address, "error":err})
+    c.acceptResults <- nil
+    return
+  }
+  if len(stops) > 0 {
+    if _, detour := planInsertion(c.graph, start, stops, rider); detour > c.maxDetour {
+      c.logger.Info("Refused ride adding too long a detour", Fields{RiderField:address, "detour":detour})
+      c.acceptResults <- nil
+      return
     }
   }
-  return cars
+  acceptStart := time.Now()
+  accepted := c.ethApi.AcceptRequest(address)
+  c.metrics.ObserveAcceptRequest(accepted, time.Since(acceptStart))
+  if accepted {
+    c.logger.Info("Accept request success", Fields{RiderField:address})
+    if c.pricing == nil {
+      amount = c.ethApi.GetAmount(address)  // Only for the record of the ride
+    }
+    rider.amount = amount
+    c.acceptResults <- &rider
+  } else {
+    c.logger.Warn("Accept request failed", Fields{RiderField:address})
+    c.acceptResults <- nil
+  }
 }
 
-func carIsPresent(cars []CarInfo, blackSheep uint) (bool) {
-  for _, car := range cars {
-    if car.ID == blackSheep {
-      return true
-    }
+func (c *Car) fareIsCovered(address string, from string, to string, amount uint64) bool {
+  quote, err := c.pricing.Quote(from, to)
+  if err != nil {
+    c.logger.Warn("Could not quote ride", Fields{RiderField:address, "error":err})
+    return false
   }
-  return false
+  if amount < quote.Fare {
+    c.logger.Info("Refused ride paying less than its fare", Fields{RiderField:address, "amount":amount, "fare":quote.Fare})
+    return false
+  }
+  return true
 }
 
-func (c *Car) getCarsStoppedAtIntersection(otherCars []CarInfo) (stoppedCars []CarInfo) {
-  for _, otherCarInfo := range otherCars {
-    entries := c.path.edge.End.intersection.entries
-    for _, intersectionEntry := range entries {
-      if intersectionEntry.present && intersectionEntry.vertex.Pos == otherCarInfo.Pos {
-        stoppedCars = append(stoppedCars, otherCarInfo)
-      }
-    }
+// getRider - Snap the rider's from and to locations to the graph.
+func (c *Car) getRider(address string, from string, to string) (rider Rider, err error) {
+  c.logger.Debug("Ride locations", Fields{RiderField:address, "from":from, "to":to})
+  rider.address = address
+  fromCoords, err := parseCoords(from)
+  if err != nil {
+    return
   }
+  toCoords, err := parseCoords(to)
+  if err != nil {
+    return
+  }
+  rider.from = fromCoords
+  rider.pickUp = c.graph.closestEdgeAndCoord(fromCoords)
+  c.logger.Debug("Pick up", Fields{RiderField:address, EdgeIDField:rider.pickUp.edge.ID})
+  rider.dropOff = c.graph.closestEdgeAndCoord(toCoords)
+  c.logger.Debug("Drop off", Fields{RiderField:address, EdgeIDField:rider.dropOff.edge.ID})
   return
 }
 
-func (c *Car) getCarsMovingInIntersection(otherCars []CarInfo) (movingCars []CarInfo) {
-  for _, otherCarInfo := range otherCars {
-    entries := c.path.edge.End.intersection.entries
-    for _, intersectionEntry := range entries {
-      if intersectionEntry.present {
-        for _, edge := range intersectionEntry.vertex.AdjEdges {
-          if edge.ID == otherCarInfo.EdgeId {
-            movingCars = append(movingCars, otherCarInfo)
-          }else if edge.Extends && edge.End.AdjEdges[0].ID == otherCarInfo.EdgeId {
-            movingCars = append(movingCars, otherCarInfo)
-          }
-        }
-      }
+func removeCar(cars []CarInfo, blackSheep uint) ([]CarInfo) {
+  for i, car := range cars {
+    if car.ID == blackSheep {
+      return append(cars[:i], cars[i+1:]...)
     }
   }
-  return
+  return cars
 }
 
 func determineOrientation (currentAngle float64, desiredAngle float64, steps float64) float64 {
@@ -1,45 +1,39 @@
 package sim2
 
 import (
+	"math"
 	"testing"
 	"time"
-	"math"
 )
+
 var mockEth MockEthAPI
-var mockWorld MockWorld
-var syncChan chan bool
-var recvChan *chan CarInfo
 var car *Car
 
 func reset() {
 	mockEth = *new(MockEthAPI)
-	mockWorld = *new(MockWorld)
-	car = new(Car)
-	car.ethApi = &mockEth
-	car.world = &mockWorld
-	car.path.edge = Edge{ID:0,
-		Start:&Vertex{Pos:Coords{0,0}},
-		End:&Vertex{Pos:Coords{1,1}}}
-	car.path.pos = Coords{0,0}
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	car = NewCar(0, graph, &mockEth, nil, nil, make(chan Message, 10))
+	car.PlaceAt(Coords{300, 386})
+	mockEth.getAddressStruct.returnAddress = "0xa"
+	mockEth.getLocationStruct.returnFrom = "300,386"
+	mockEth.getLocationStruct.returnTo = "700,337"
+}
+
+// awaitRequestState - Check the request state until the accept attempt in flight ends.
+func awaitRequestState() {
+	for i := 0; i < 1000 && car.requestState == Trying; i++ {
+		time.Sleep(time.Millisecond)
+		car.checkRequestState()
+	}
 }
 
 func TestNewCar(t *testing.T) {
-	edge := Edge{ID:0,
-		Start:&Vertex{Pos:Coords{0,0}},
-		End:&Vertex{Pos:Coords{1,1}}}
-	mockWorld.getVertexStruct.returnVertex = *edge.Start
-	mockWorld.getVertexStruct.returnVertex.AdjEdges = append(mockWorld.getVertexStruct.returnVertex.AdjEdges, edge)
-	mockWorld.getRandomEdgeStruct.returnEdge = edge
-	var carID uint = 0
-	car = NewCar(carID, &mockWorld, &mockEth, syncChan, recvChan)
-	if car.id != carID {
-		t.Errorf("Car ID does not equal %d \n", carID)
-	}
-	if mockWorld.getVertexStruct.paramId != carID {
-		t.Errorf("Edge ID does not equal %d \n", carID)
-	}
-	if mockWorld.shortestpathStruct.calls != 1 {
-		t.Errorf("Did not query the world to find shortest location between current location and pick up location \n")
+	reset()
+	if car.id != 0 {
+		t.Errorf("Car ID does not equal 0 \n")
+	}
+	if car.path.pos.Distance(Coords{300, 386}) > 10 || car.path.edge.Start.Pos.Distance(car.path.pos) > car.path.edge.Weight {
+		t.Errorf("Car not placed on the road closest to where it was put, at %v \n", car.path.pos)
 	}
 	if car.path.state != DrivingAtRandom {
 		t.Errorf("Car path state not intialized to random \n")
@@ -59,12 +53,12 @@ func testRequestState(t *testing.T) {
 	// Test for accept request success
 	reset()
 	mockEth.getAddressStruct.returnAvailable = true
-	acceptRequestWaitChannel :=  make(chan bool, 1)
-	mockEth.acceptRequestStruct.function = func (string) bool {
+	acceptRequestWaitChannel := make(chan bool, 1)
+	mockEth.acceptRequestStruct.function = func(string) bool {
 		return <-acceptRequestWaitChannel
 	}
 	car.requestState = None
-	car.driveOnCurrentEdgeTowards()
+	car.checkRequestState()
 	if car.requestState != Trying {
 		t.Errorf("Car request state did not switch to trying \n")
 	}
@@ -72,27 +66,39 @@ func testRequestState(t *testing.T) {
 		t.Errorf("Did not try to get address in None state \n")
 	}
 	acceptRequestWaitChannel <- true
-	time.Sleep(time.Millisecond)
+	awaitRequestState()
 	if car.requestState != Success {
 		t.Errorf("Car request state did not switch to success \n")
 	}
+	if mockEth.getLocationStruct.calls != 1 || mockEth.acceptRequestStruct.paramAddress != "0xa" {
+		t.Errorf("Did not query eth api for the locations of the ride it accepted \n")
+	}
+
+	// Test for procedures after successful accept
+	car.checkRequestState()
+	if car.requestState != None {
+		t.Errorf("Car request state did not switch to none \n")
+	}
+	if car.path.state != ToPickUp {
+		t.Errorf("Car path not changed to pick up \n")
+	}
+	if len(car.path.stops) != 2 || car.path.stops[0].rider != "0xa" || car.path.stops[0].kind != PickUpStop {
+		t.Errorf("Pick up and drop off of the rider not scheduled, got %v \n", car.path.stops)
+	}
 
 	// Test for accept request failure
 	reset()
 	mockEth.getAddressStruct.returnAvailable = true
-	mockEth.acceptRequestStruct.function = func (string) bool {
+	mockEth.acceptRequestStruct.function = func(string) bool {
 		return <-acceptRequestWaitChannel
 	}
 	car.requestState = None
-	car.driveOnCurrentEdgeTowards()
+	car.checkRequestState()
 	if car.requestState != Trying {
 		t.Errorf("Car request state did not switch to trying \n")
 	}
-	if mockEth.getAddressStruct.calls != 1 {
-		t.Errorf("Did not try to get address in None state \n")
-	}
 	acceptRequestWaitChannel <- false
-	time.Sleep(time.Millisecond)
+	awaitRequestState()
 	if car.requestState != Fail {
 		t.Errorf("Car request state did not switch to fail \n")
 	}
@@ -100,111 +106,130 @@ func testRequestState(t *testing.T) {
 	// Test for retry after failure
 	reset()
 	mockEth.getAddressStruct.returnAvailable = true
-	mockEth.acceptRequestStruct.function = func (string) bool {
-		time.Sleep(time.Millisecond * 1)
-		return true
-	}
+	mockEth.acceptRequestStruct.returnStatus = true
 	car.requestState = Fail
-	car.driveOnCurrentEdgeTowards()
+	car.checkRequestState()
 	if car.requestState != Trying {
 		t.Errorf("Car request state did not switch to trying \n")
 	}
 	if mockEth.getAddressStruct.calls != 1 {
-		t.Errorf("Did not try to get address in None state \n")
+		t.Errorf("Did not try to get address in Fail state \n")
 	}
-	time.Sleep(time.Millisecond * 2)
+	awaitRequestState()
 	if car.requestState != Success {
 		t.Errorf("Car request state did not switch to success \n")
 	}
 
-	// Test for procedures after successful accept
+	// Test for refusing a ride off the map
 	reset()
-	car.requestState = Success
-	mockEth.getLocationStruct.returnFrom = "0,0"
-	mockEth.getLocationStruct.returnTo = "1,1"
-	mockWorld.closestEdgeAndCoordStruct.returnLocation = Location{edge:Edge{Start:&Vertex{ID:1}}}
-	car.driveOnCurrentEdgeTowards()
-	if mockEth.getLocationStruct.calls != 1 {
-		t.Errorf("Did not query eth api to get locations \n")
-	}
-	if mockWorld.closestEdgeAndCoordStruct.calls != 2 {
-		t.Errorf("Did not query the world twice to find closest location to pick up and drop off points \n")
-	}
-	if mockWorld.shortestpathStruct.calls != 1 {
-		t.Errorf("Did not query the world to find shortest location between current location and pick up location \n")
-	}
-	if car.path.state != ToPickUp {
-		t.Errorf("Car path not changed to pick up \n")
-	}
-	if car.requestState != None {
-		t.Errorf("Car request state did not switch to none \n")
+	mockEth.getAddressStruct.returnAvailable = true
+	mockEth.getLocationStruct.returnFrom = "north"
+	car.checkRequestState()
+	awaitRequestState()
+	if car.requestState != Fail || mockEth.acceptRequestStruct.calls != 0 {
+		t.Errorf("Accepted a ride with an invalid pick up \n")
 	}
 }
 
 func testPathState(t *testing.T) {
 
-	//// Test destination reached after driving at random
+	// Test destination reached after driving to pick up
 	reset()
-	mockWorld.getRandomEdgeStruct.returnEdge = car.path.edge
-	car.path.state = DrivingAtRandom
-	car.path.pos = car.path.edge.End.Pos
-	car.path.routeEdges = []Edge{{ID:1, Start:&Vertex{Pos:Coords{1,1}}, End:&Vertex{Pos:Coords{2,2}}}}
-	car.driveOnCurrentEdgeTowards()
-	if car.path.edge.ID != 1 {
-		t.Errorf("Car did not switch edges upon reaching \n")
-	}
-	if len(car.path.routeEdges) != 0 {
-		t.Errorf("Last edge was not popped after reaching destination \n")
+	clock := NewSimClock(time.Now())
+	car.SetClock(clock)
+	rider, err := car.getRider("0xa", "300,386", "700,337")
+	if err != nil {
+		t.Fatalf("Could not snap rider to the map: %v \n", err)
 	}
-	if mockWorld.shortestpathStruct.calls != 1 {
-		t.Errorf("Did not query the world to find shortest location between current location and random location \n")
-	}
-	if car.path.state != DrivingAtRandom {
-		t.Errorf("Car path state not remained in random \n")
-	}
-
-	// Test destination reached after driving to pickup
-	reset()
-	car.path.dropOff.edge =
-		Edge{ID:0,
-			Start:&Vertex{Pos:Coords{0,0}},
-			End:&Vertex{Pos:Coords{1,1}}}
+	car.path.stops = []Stop{{"0xa", PickUpStop, rider.pickUp}, {"0xa", DropOffStop, rider.dropOff}}
 	car.path.state = ToPickUp
-	car.path.pos = car.path.edge.End.Pos
-	car.path.routeEdges = []Edge{{ID:1, Start:&Vertex{Pos:Coords{1,1}}, End:&Vertex{Pos:Coords{2,2}}}}
-
-	car.driveOnCurrentEdgeTowards()
+	car.path.edge = rider.pickUp.edge
+	car.path.pos = rider.pickUp.intersect
+	car.path.routeEdges = nil
+	car.drive()
+	if car.path.state != Waiting || car.path.nextState != ToDropOff {
+		t.Errorf("Car path state not switched to drop off after waiting \n")
+	}
+	if len(car.path.stops) != 1 || len(car.path.routeEdges) == 0 {
+		t.Errorf("Car not routed to the drop off \n")
+	}
+	clock.Advance(5*time.Second + time.Millisecond)
+	car.drive()
 	if car.path.state != ToDropOff {
-		t.Errorf("Car path state not switched to drop off \n")
+		t.Errorf("Car did not leave the pick up after waiting \n")
 	}
 
-	// Test destination reached after driving to pickup
-	reset()
-	mockWorld.getRandomEdgeStruct.returnEdge = car.path.edge
-	car.path.state = ToDropOff
-	car.path.pos = car.path.edge.End.Pos
-	car.path.routeEdges = []Edge{{ID:1, Start:&Vertex{Pos:Coords{1,1}}, End:&Vertex{Pos:Coords{2,2}}}}
-	car.driveOnCurrentEdgeTowards()
-	if car.path.state != DrivingAtRandom {
-		t.Errorf("Car path state not switched to driving at random \n")
+	// Test destination reached after driving to drop off
+	car.path.edge = rider.dropOff.edge
+	car.path.pos = rider.dropOff.intersect
+	car.path.routeEdges = nil
+	car.drive()
+	if car.path.state != Waiting || car.path.nextState != DrivingAtRandom || len(car.path.stops) != 0 {
+		t.Errorf("Car path state not switched to driving at random after waiting \n")
 	}
 
 	// Test if current position is projected to end position by Movement per drive when distance is greater than movement per drive
 	reset()
-	originalCarPostion := car.path.pos
-	car.driveOnCurrentEdgeTowards()
-	distanceMoved := originalCarPostion.Distance(car.path.pos)
-	if math.Abs(distanceMoved -MovementPerFrame) > 0.1 {
+	var plain *Edge
+	for _, edge := range car.graph.Edges {
+		if edge.End.intersection == nil && !edge.Wraps && edge.Weight > 10 && len(edge.End.AdjEdges) > 0 {
+			plain = edge
+			break
+		}
+	}
+	car.path.edge = *plain
+	car.path.pos = plain.Start.Pos
+	car.path.routeEdges = []Edge{*plain.End.AdjEdges[0]}
+	car.drive()
+	distanceMoved := plain.Start.Pos.Distance(car.path.pos)
+	if math.Abs(distanceMoved-MovementPerFrame) > 0.1 {
 		t.Errorf("Current position was not projected by movement per drive \n")
 	}
 
 	// Test if current position is set to end position when distance is less than Movement per drive
-	reset()
-	car.path.edge.End.Pos = Coords{X:0.1, Y:0.1}
-	car.driveOnCurrentEdgeTowards()
-	if car.path.pos != car.path.edge.End.Pos {
+	car.path.pos = plain.End.Pos.ProjectInDirection(MovementPerFrame/2, plain.Start.Pos)
+	car.drive()
+	if car.path.pos != plain.End.Pos {
 		t.Errorf("Current position not set to end position upon getting close enough \n")
 	}
 
+	// Test switching edges upon reaching the end of the current one
+	car.drive()
+	if car.path.edge.ID != plain.End.AdjEdges[0].ID || len(car.path.routeEdges) != 0 {
+		t.Errorf("Car did not switch edges upon reaching \n")
+	}
+}
+
+func TestCar_TryToAcceptRequest(t *testing.T) {
+	reset()
+	mockEth.acceptRequestStruct.returnStatus = true
+	mockEth.getAmountStruct.returnAmount = 30
+	car.tryToAcceptRequest("0xa", car.currentLocation(), nil)
+	if rider := <-car.acceptResults; rider == nil || rider.amount != 30 || mockEth.getAmountStruct.calls != 1 {
+		t.Errorf("Expected the amount of the accepted ride to be recorded \n")
+	}
+
+	reset()
+	mockEth.acceptRequestStruct.returnStatus = false
+	car.tryToAcceptRequest("0xa", car.currentLocation(), nil)
+	if rider := <-car.acceptResults; rider != nil || mockEth.getAmountStruct.calls != 0 {
+		t.Errorf("Asked the chain for the amount of a ride not accepted, with fares not enforced \n")
+	}
 }
 
+func TestCar_SendRideStatus(t *testing.T) {
+	reset()
+	for i := 0; i < cap(car.webChan); i++ {
+		car.webChan <- CarMessage{}
+	}
+	sent := make(chan struct{})
+	go func() {
+		car.sendRideStatus("0xa", "At Pick Up")
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatalf("Ride status blocked the car while web output was full \n")
+	}
+}
@@ -0,0 +1,78 @@
+package sim2
+
+import (
+	"sync"
+	"time"
+)
+
+// clock - Describes the time cars and stop lights go by, the wall clock or a simulated one
+
+// Clock - tells the time and sends alarms.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// wallClock - Clock of the running process.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                         { return time.Now() }
+func (wallClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// systemClock - clock of cars and worlds that were not given one.
+var systemClock Clock = wallClock{}
+
+// SimClock - Clock that only moves when advanced, so a simulation can run faster than real time.
+type SimClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	alarms []simAlarm
+}
+
+type simAlarm struct {
+	at   time.Time
+	send chan time.Time
+}
+
+// NewSimClock - Constructor for a valid SimClock object reading start.
+func NewSimClock(start time.Time) *SimClock {
+	c := new(SimClock)
+	c.now = start
+	return c
+}
+
+// Now - the simulated time.
+func (c *SimClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// After - Channel receiving the simulated time once the clock has advanced by d.
+func (c *SimClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	send := make(chan time.Time, 1)
+	if d <= 0 {
+		send <- c.now
+		return send
+	}
+	c.alarms = append(c.alarms, simAlarm{c.now.Add(d), send})
+	return send
+}
+
+// Advance - Move the clock forward by d, sending the alarms that come due.
+func (c *SimClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.alarms[:0]
+	for _, alarm := range c.alarms {
+		if alarm.at.After(c.now) {
+			pending = append(pending, alarm)
+		} else {
+			alarm.send <- c.now
+		}
+	}
+	c.alarms = pending
+}
@@ -0,0 +1,30 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimClock_After(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewSimClock(start)
+	alarm := clock.After(time.Second)
+	clock.Advance(time.Millisecond * 600)
+	select {
+	case <-alarm:
+		t.Errorf("Alarm went off before it was due \n")
+	default:
+	}
+	clock.Advance(time.Millisecond * 600)
+	select {
+	case at := <-alarm:
+		if !at.Equal(start.Add(time.Millisecond * 1200)) {
+			t.Errorf("Alarm sent %v, expected the time it went off \n", at)
+		}
+	default:
+		t.Errorf("Alarm did not go off once due \n")
+	}
+	if now := clock.Now(); !now.Equal(start.Add(time.Millisecond * 1200)) {
+		t.Errorf("Clock reads %v after advancing 1.2s from %v \n", now, start)
+	}
+}
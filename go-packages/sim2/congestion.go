@@ -0,0 +1,149 @@
+package sim2
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// congestion - Describes travel times of edges smoothed from the times cars took to drive them, waits at
+//   the stop line included, for routing around queues
+
+// DefaultTravelTimeSmoothing - weight of the latest observed traversal in an edge's smoothed travel time
+const DefaultTravelTimeSmoothing = 0.3
+
+// RouteReconsiderInterval - how often a car routing by travel times looks for a faster route
+const RouteReconsiderInterval = time.Second * 10
+
+// FasterRouteMargin - share of the remaining travel time a new route must save for a car to switch to it
+const FasterRouteMargin = 0.25
+
+// TravelTimes - exponentially smoothed travel time of every edge, starting from the time it takes to
+//   drive the edge without stopping. Safe to read while the world updates it.
+type TravelTimes struct {
+	mutex     sync.RWMutex
+	graph     *Digraph
+	speed     float64 // Map units driven per second
+	smoothing float64
+	seconds   map[uint]float64 // Of the edges observed so far
+	observed  map[uint]uint    // Traversals observed per edge
+}
+
+// NewTravelTimes - Constructor for a valid TravelTimes object for the edges of graph driven at speed map
+//   units per second, weighting each new traversal by smoothing.
+func NewTravelTimes(graph *Digraph, speed float64, smoothing float64) *TravelTimes {
+	t := new(TravelTimes)
+	t.graph = graph
+	t.speed = speed
+	t.smoothing = smoothing
+	t.seconds = make(map[uint]float64)
+	t.observed = make(map[uint]uint)
+	return t
+}
+
+// SetSmoothing - Weight each new traversal by smoothing, between 0 and 1.
+func (t *TravelTimes) SetSmoothing(smoothing float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.smoothing = smoothing
+}
+
+// Estimate - smoothed travel time of the edge with ID id, the time to drive it without stopping until a
+//   car has been seen driving it.
+func (t *TravelTimes) Estimate(id uint) time.Duration {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return time.Duration(t.estimate(id) * float64(time.Second))
+}
+
+// Observations - number of traversals of the edge with ID id observed so far.
+func (t *TravelTimes) Observations(id uint) uint {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.observed[id]
+}
+
+// Observe - Fold the time a car took to drive the edge with ID id into its smoothed travel time.
+func (t *TravelTimes) Observe(id uint, took time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.graph.Edges[id]; !ok || took < 0 {
+		return
+	}
+	t.seconds[id] = t.smoothing*took.Seconds() + (1-t.smoothing)*t.estimate(id)
+	t.observed[id]++
+}
+
+// weight - smoothed travel time of edge in map units driven in that time, its length until observed.
+func (t *TravelTimes) weight(edge *Edge) float64 {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if seconds, ok := t.seconds[edge.ID]; ok {
+		return seconds * t.speed
+	}
+	return edge.Weight
+}
+
+// estimate - smoothed travel time of the edge with ID id in seconds; caller must hold the mutex.
+func (t *TravelTimes) estimate(id uint) float64 {
+	if seconds, ok := t.seconds[id]; ok {
+		return seconds
+	}
+	if edge, ok := t.graph.Edges[id]; ok && t.speed > 0 {
+		return edge.Weight / t.speed
+	}
+	return math.Inf(1)
+}
+
+// SetRouting - Route on g by mode: "distance" for the length of the edges, or "congestion" for their
+//   travel times smoothed in times.
+func (g *Digraph) SetRouting(mode string, times *TravelTimes) error {
+	switch mode {
+	case "distance":
+		g.RouteByTravelTimes(nil)
+	case "congestion":
+		g.RouteByTravelTimes(times)
+	default:
+		return errors.New("unknown routing " + mode)
+	}
+	return nil
+}
+
+// edgeTraversal - the edge a car is driving and since when.
+type edgeTraversal struct {
+	edge      uint
+	enteredAt time.Time
+	clean     bool // Driven from its start without parking, breaking down or stopping for a rider
+}
+
+// trafficObserver - times the cars of a world from one edge to the next, feeding TravelTimes.
+type trafficObserver struct {
+	times      *TravelTimes
+	traversals map[uint]edgeTraversal // By car ID
+}
+
+func newTrafficObserver(times *TravelTimes) *trafficObserver {
+	return &trafficObserver{times: times, traversals: make(map[uint]edgeTraversal)}
+}
+
+// observe - Note the edges cars are on now, observing the travel time of every edge a car just left after
+//   driving it from its start. Edges wrapping around the map take no time and are left out.
+func (o *trafficObserver) observe(cars []CarInfo, now time.Time) {
+	for _, car := range cars {
+		traversal, ok := o.traversals[car.ID]
+		if !ok || car.EdgeId != traversal.edge {
+			if ok && traversal.clean {
+				o.times.Observe(traversal.edge, now.Sub(traversal.enteredAt))
+			}
+			edge, onMap := o.times.graph.Edges[car.EdgeId]
+			traversal = edgeTraversal{edge: car.EdgeId, enteredAt: now, clean: ok && onMap && !edge.Wraps}
+		}
+		if car.Parked || car.BrokenDown {
+			traversal.clean = false
+		} else if edge, onMap := o.times.graph.Edges[car.EdgeId]; car.State == Waiting && onMap && car.Pos != edge.End.Pos {
+			traversal.clean = false // Stopped for a rider, not at the stop line
+		}
+		o.traversals[car.ID] = traversal
+	}
+}
@@ -0,0 +1,109 @@
+package sim2
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTravelTimes_Observe(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	times := NewTravelTimes(graph, 50, 0.5)
+	freeFlow := graph.Edges[36].Weight / 50
+	if estimate := times.Estimate(36).Seconds(); math.Abs(estimate-freeFlow) > 1e-6 {
+		t.Errorf("Unobserved edge estimated at %vs, expected its free flow time %vs \n", estimate, freeFlow)
+	}
+	times.Observe(36, time.Duration(freeFlow*3*float64(time.Second)))
+	if estimate := times.Estimate(36).Seconds(); math.Abs(estimate-freeFlow*2) > 1e-6 {
+		t.Errorf("Edge estimated at %vs after one slow traversal, expected %vs \n", estimate, freeFlow*2)
+	}
+	if weight := times.weight(graph.Edges[36]); math.Abs(weight-graph.Edges[36].Weight*2) > 1e-6 {
+		t.Errorf("Edge weighs %v, expected twice its length \n", weight)
+	}
+	times.Observe(1000, time.Second)
+	if times.Observations(36) != 1 || times.Observations(1000) != 0 {
+		t.Errorf("Observations miscounted \n")
+	}
+}
+
+func TestTrafficObserver_Observe(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	times := NewTravelTimes(graph, 50, 1)
+	observer := newTrafficObserver(times)
+	start := time.Now()
+	drive := func(car uint, edge uint, at time.Duration) {
+		observer.observe([]CarInfo{{ID: car, EdgeId: edge, Pos: graph.Edges[edge].Start.Pos}}, start.Add(at))
+	}
+
+	drive(0, 8, 0) // Placed mid-edge
+	drive(0, 13, 4*time.Second)
+	drive(0, 16, 10*time.Second)
+	if times.Observations(8) != 0 || times.Observations(13) != 1 || times.Estimate(13) != 6*time.Second {
+		t.Errorf("Expected only edge 13 observed at 6s, got %v \n", times.Estimate(13))
+	}
+
+	observer.observe([]CarInfo{{ID: 0, EdgeId: 16, Parked: true}}, start.Add(11*time.Second))
+	drive(0, 24, 30*time.Second)
+	observer.observe([]CarInfo{{ID: 0, EdgeId: 24, State: Waiting, Pos: graph.Edges[24].End.Pos}}, start.Add(40*time.Second))
+	drive(0, 20, 50*time.Second)
+	if times.Observations(16) != 0 || times.Estimate(24) != 20*time.Second {
+		t.Errorf("Expected the parked traversal left out and the stop line wait counted \n")
+	}
+	observer.observe([]CarInfo{{ID: 0, EdgeId: 20, State: Waiting, Pos: graph.Edges[20].Start.Pos}}, start.Add(55*time.Second))
+	drive(0, 21, 60*time.Second)
+	if times.Observations(20) != 0 {
+		t.Errorf("Traversal with a stop for a rider was observed \n")
+	}
+}
+
+func TestDigraph_SetRouting(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	times := NewTravelTimes(graph, 50, 1)
+	if err := graph.SetRouting("congestion", times); err != nil {
+		t.Fatal(err)
+	}
+	times.Observe(36, time.Minute)
+	edges, _ := graph.shortestPath(22, 26)
+	for _, edge := range edges {
+		if edge.ID == 36 {
+			t.Errorf("Route uses congested edge 36 \n")
+		}
+	}
+	graph.SetRouting("distance", times)
+	if edges, _ := graph.shortestPath(22, 26); len(edges) == 0 || edges[0].ID != 36 {
+		t.Errorf("Routing by distance does not use edge 36 again \n")
+	}
+	if err := graph.SetRouting("fastest", times); err == nil {
+		t.Errorf("Set unknown routing \n")
+	}
+}
+
+func TestCar_FasterRoute(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	times := NewTravelTimes(graph, 50, 1)
+	graph.SetRouting("congestion", times)
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.PlaceAt(Coords{131, 350})
+	car.routeTo(closestParkingLocation(graph, Coords{880, 520}))
+	if route := car.path.routeIDs(); len(route) < 3 || route[2] != 16 {
+		t.Fatalf("Expected a route over edge 16, got %v \n", route)
+	}
+
+	times.Observe(16, time.Second*6) // Barely slower
+	car.reroute()
+	if route := car.path.routeIDs(); route[2] != 16 {
+		t.Errorf("Switched route for a small saving, got %v \n", route)
+	}
+	times.Observe(16, time.Minute*5)
+	car.reroute()
+	if route := car.path.routeIDs(); route[2] != 16 {
+		t.Errorf("Reconsidered the route before the interval passed, got %v \n", route)
+	}
+	car.path.reconsiderAt = time.Time{}
+	car.reroute()
+	for _, id := range car.path.routeIDs() {
+		if id == 16 {
+			t.Errorf("Kept the route over congested edge 16 \n")
+		}
+	}
+}
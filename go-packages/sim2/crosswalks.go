@@ -0,0 +1,70 @@
+package sim2
+
+import (
+	"errors"
+	"strconv"
+)
+
+// crosswalks - Describes where pedestrians cross the roads into and out of intersections
+
+// Crosswalk - crossing of the road at one side of an intersection, between the vertices at its ends.
+type Crosswalk struct {
+	ID           uint
+	Ends         [2]Coords
+	intersection *Intersection
+}
+
+// addCrosswalk - Add a crosswalk between the vertices with IDs start and end, one of them entering the
+//   intersection the crosswalk belongs to.
+func (g *Digraph) addCrosswalk(start uint, end uint) error {
+	startVertex, startOK := g.Vertices[start]
+	endVertex, endOK := g.Vertices[end]
+	if !startOK || !endOK {
+		return errors.New("no vertex " + strconv.Itoa(int(start)) + " or " + strconv.Itoa(int(end)))
+	}
+	intersection := startVertex.intersection
+	if intersection == nil {
+		intersection = endVertex.intersection
+	}
+	if intersection == nil {
+		return errors.New("neither vertex enters an intersection")
+	}
+	crosswalk := &Crosswalk{ID: uint(len(g.Crosswalks)), Ends: [2]Coords{startVertex.Pos, endVertex.Pos}, intersection: intersection}
+	g.Crosswalks = append(g.Crosswalks, crosswalk)
+	intersection.crosswalks = append(intersection.crosswalks, crosswalk)
+	return nil
+}
+
+// crosses - true if the path through the points of path runs over the crosswalk.
+func (cw *Crosswalk) crosses(path []Coords) bool {
+	for i := 1; i < len(path); i++ {
+		if segmentsTouch(path[i-1], path[i], cw.Ends[0], cw.Ends[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// crosswalkOnWay - the crosswalk of g closest to from that the straight walk from from to to runs over,
+//   leaving out used; nil if there is none.
+func (g *Digraph) crosswalkOnWay(from Coords, to Coords, used map[*Crosswalk]bool) (closest *Crosswalk) {
+	distance := 0.0
+	for _, crosswalk := range g.Crosswalks {
+		if used[crosswalk] || !crosswalk.crosses([]Coords{from, to}) {
+			continue
+		}
+		near, _ := crosswalk.orderedEnds(from)
+		if closest == nil || from.Distance(near) < distance {
+			closest, distance = crosswalk, from.Distance(near)
+		}
+	}
+	return
+}
+
+// orderedEnds - the end of the crosswalk closest to pos and the other end.
+func (cw *Crosswalk) orderedEnds(pos Coords) (near Coords, far Coords) {
+	if pos.Distance(cw.Ends[0]) <= pos.Distance(cw.Ends[1]) {
+		return cw.Ends[0], cw.Ends[1]
+	}
+	return cw.Ends[1], cw.Ends[0]
+}
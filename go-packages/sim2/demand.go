@@ -0,0 +1,124 @@
+package sim2
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// demand - Describes the open ride requests and a decaying history of where rides were requested
+
+// RideRequest - a ride request that no car has accepted yet.
+type RideRequest struct {
+	Rider string // Rider address
+	From  string // Pick up location as "x,y"
+	To    string // Drop off location as "x,y"
+}
+
+// RideDemand - source of ride requests that no car has accepted yet.
+type RideDemand interface {
+	OpenRideRequests() (rides []RideRequest)
+}
+
+// demandEvent - a ride request first seen at a pick up position.
+type demandEvent struct {
+	rider string
+	pos   Coords
+	seen  time.Time
+}
+
+// DemandHistory - polls a RideDemand and remembers where rides were recently requested.
+//   DemandHistory is itself a RideDemand serving the latest poll without blocking.
+type DemandHistory struct {
+	source   RideDemand
+	grid     zoneGrid
+	halfLife time.Duration // Age at which a request counts half as much as a new one
+	mutex    sync.Mutex
+	open     []RideRequest
+	events   []demandEvent
+}
+
+// NewDemandHistory - Constructor for a valid DemandHistory object zoning graph into zoneSize squares.
+func NewDemandHistory(graph *Digraph, source RideDemand, zoneSize float64, halfLife time.Duration) *DemandHistory {
+	h := new(DemandHistory)
+	h.source = source
+	h.grid = newZoneGrid(graph, zoneSize)
+	h.halfLife = halfLife
+	return h
+}
+
+// LoopDemand - Begin polling the ride demand source every interval.
+func (h *DemandHistory) LoopDemand(interval time.Duration) {
+	for {
+		h.observe(h.source.OpenRideRequests(), time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// OpenRideRequests - ride requests open as of the latest poll.
+func (h *DemandHistory) OpenRideRequests() (rides []RideRequest) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append(rides, h.open...)
+}
+
+// Hotspot - center of the zone with the most recent demand, false if there is no recent demand.
+func (h *DemandHistory) Hotspot() (Coords, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	weights := make([]float64, h.grid.numZones())
+	now := time.Now()
+	for _, event := range h.events {
+		if zone, ok := h.grid.zone(event.pos); ok {
+			weights[zone] += h.weight(now.Sub(event.seen))
+		}
+	}
+	hottest, hottestWeight := 0, 0.0
+	for zone, weight := range weights {
+		if weight > hottestWeight {
+			hottest, hottestWeight = zone, weight
+		}
+	}
+	return h.grid.center(hottest), hottestWeight > 0
+}
+
+// RequestedAt - when the latest ride request of rider was first seen, false if it was not seen recently.
+func (h *DemandHistory) RequestedAt(rider string) (time.Time, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for idx := len(h.events) - 1; idx >= 0; idx-- {
+		if strings.EqualFold(h.events[idx].rider, rider) {
+			return h.events[idx].seen, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// observe - record requests not open in the previous poll and forget events too old to matter.
+func (h *DemandHistory) observe(open []RideRequest, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	previouslyOpen := make(map[string]bool)
+	for _, ride := range h.open {
+		previouslyOpen[ride.Rider+ride.From] = true
+	}
+	for _, ride := range open {
+		if previouslyOpen[ride.Rider+ride.From] {
+			continue
+		}
+		if pos, err := parseCoords(ride.From); err == nil {
+			h.events = append(h.events, demandEvent{ride.Rider, pos, now})
+		}
+	}
+	h.open = open
+
+	// Drop events weighing less than a hundredth of a new request
+	for len(h.events) > 0 && h.weight(now.Sub(h.events[0].seen)) < 0.01 {
+		h.events = h.events[1:]
+	}
+}
+
+func (h *DemandHistory) weight(age time.Duration) float64 {
+	return math.Pow(0.5, age.Seconds()/h.halfLife.Seconds())
+}
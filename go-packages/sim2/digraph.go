@@ -1,14 +1,15 @@
 package sim2
 
 import (
+  "errors"
   "os"
-  "log"
   "bufio"
   "strings"
   "strconv"
   "math"
   "math/rand"
-  "time"
+  "sort"
+  "sync"
 
 )
 
@@ -31,6 +32,9 @@ type Edge struct {
   Weight float64
   Extends bool
   Wraps bool
+  Lanes uint  // Side by side in the direction of the edge
+  movement *Movement  // Through the intersection the edge starts at, nil for edges between intersections
+  crosses *Intersection  // Set for movements and the edges they extend into
 }
 
 // The number of directions at an waitingFor
@@ -40,12 +44,15 @@ type Intersection struct {
   id uint
   entries [NumberOfDirections]EntryInfo
   intersectionType IntersectionType
+  crosswalks []*Crosswalk  // Across the roads at its sides
 }
 
 // Entry Info - information about the entry to the waitingFor
 type EntryInfo struct {
   present bool    // if there is an entry from the corresponding direction
   vertex *Vertex  // the vertex corresponding to the entry
+  movements []*Movement  // the ways through the intersection from the entry
+  yields bool  // cars from the entry give way to cars with priority, at roundabouts and yield intersections
 }
 
 type Direction int
@@ -61,13 +68,44 @@ const (
   NoIntersection  IntersectionType = 0
   StopSign        IntersectionType = 1
   StopLight       IntersectionType = 2
+  Roundabout      IntersectionType = 3
+  Yield           IntersectionType = 4
+  Autonomous      IntersectionType = 5  // Cars cross on reservations from the world instead of stopping
 )
 
+// Depot - named place on the map where cars start and park.
+type Depot struct {
+  Name string
+  Pos Coords
+}
+
 // Digraph - struct for Digraph object.
 type Digraph struct {
   Vertices map[uint]*Vertex  // map vertex ID to vertex reference
   Edges map[uint]*Edge  // map edge ID to edge reference
   Intersections []*Intersection
+  Depots []Depot  // In map file order
+  Crosswalks []*Crosswalk  // Indexed by ID
+  conditions *roadConditions  // Edges closed to traffic or slowed down
+  travelTimes *TravelTimes  // Weigh edges by their observed travel times, nil to weigh them by length
+  turnCosts [NumberOfTurns]float64  // Added to the weight of movements through intersections by their turn
+}
+
+// roadConditions - edges closed to traffic and travel time multipliers; shared by copies of the Digraph
+//   and safe to change while cars route.
+type roadConditions struct {
+  mutex sync.RWMutex
+  closed map[uint]bool
+  multipliers map[uint]float64  // Of edges slowed down or sped up, 1 for other edges
+  version uint64  // Counts the changes so far
+  changedAt map[uint]uint64  // Version of the last change to each edge that has changed
+}
+
+// RoadCondition - closure and travel time multiplier of one edge.
+type RoadCondition struct {
+  EdgeID uint
+  Closed bool
+  Multiplier float64
 }
 
 // NewDigraph - Constructor for valid Digraph object.
@@ -75,16 +113,177 @@ func NewDigraph() *Digraph {
   d := new(Digraph)
   d.Vertices = make(map[uint]*Vertex)
   d.Edges = make(map[uint]*Edge)
+  d.conditions = &roadConditions{closed:make(map[uint]bool), multipliers:make(map[uint]float64), changedAt:make(map[uint]uint64)}
+  d.turnCosts = DefaultTurnCosts
   return d
 }
 
+// ShareRoadConditions - Route by the road conditions of other from now on, so closing an edge of either
+//   graph closes it in both. The graphs must be read from the same map.
+func (g *Digraph) ShareRoadConditions(other *Digraph) {
+  g.conditions = other.conditions
+}
+
+// CloseEdge - Route around the edge with ID id from now on and true OK, false if there is no such edge.
+func (g *Digraph) CloseEdge(id uint) bool {
+  return g.changeEdge(id, func(c *roadConditions) { c.closed[id] = true })
+}
+
+// OpenEdge - Route over the edge with ID id again and true OK, false if there is no such edge.
+func (g *Digraph) OpenEdge(id uint) bool {
+  return g.changeEdge(id, func(c *roadConditions) { delete(c.closed, id) })
+}
+
+// SetTravelTimeMultiplier - Route as if the edge with ID id took multiplier times as long to drive, 1 to
+//   restore it, and true OK. False if there is no such edge or multiplier is not positive.
+func (g *Digraph) SetTravelTimeMultiplier(id uint, multiplier float64) bool {
+  if !(multiplier > 0) || math.IsInf(multiplier, 1) {
+    return false
+  }
+  return g.changeEdge(id, func(c *roadConditions) {
+    if multiplier == 1 {
+      delete(c.multipliers, id)
+    } else {
+      c.multipliers[id] = multiplier
+    }
+  })
+}
+
+// changeRoad - Close or open the edge with ID id and set its travel time multiplier, leaving either unchanged
+//   if nil, and answer with its conditions. Nothing changes if either is invalid.
+func (g *Digraph) changeRoad(id uint, closed *bool, multiplier *float64) (condition RoadCondition, err error) {
+  if _, ok := g.Edges[id]; !ok {
+    return condition, errors.New("no such edge")
+  }
+  if multiplier != nil && (!(*multiplier > 0) || math.IsInf(*multiplier, 1)) {
+    return condition, errors.New("travel time multiplier must be a positive number")
+  }
+  if closed != nil && *closed {
+    g.CloseEdge(id)
+  } else if closed != nil {
+    g.OpenEdge(id)
+  }
+  if multiplier != nil {
+    g.SetTravelTimeMultiplier(id, *multiplier)
+  }
+  return RoadCondition{EdgeID:id, Closed:g.IsClosed(id), Multiplier:g.TravelTimeMultiplier(id)}, nil
+}
+
+// changeEdge - Apply change to the road conditions of the edge with ID id and true OK, false if there is no such edge.
+func (g *Digraph) changeEdge(id uint, change func(c *roadConditions)) bool {
+  if _, ok := g.Edges[id]; !ok {
+    return false
+  }
+  g.conditions.mutex.Lock()
+  defer g.conditions.mutex.Unlock()
+  change(g.conditions)
+  g.conditions.version++
+  g.conditions.changedAt[id] = g.conditions.version
+  return true
+}
+
+// IsClosed - true if the edge with ID id is closed to traffic.
+func (g *Digraph) IsClosed(id uint) bool {
+  if g.conditions == nil {
+    return false
+  }
+  g.conditions.mutex.RLock()
+  defer g.conditions.mutex.RUnlock()
+  return g.conditions.closed[id]
+}
+
+// TravelTimeMultiplier - how many times as long as usual the edge with ID id takes to drive.
+func (g *Digraph) TravelTimeMultiplier(id uint) float64 {
+  if g.conditions == nil {
+    return 1
+  }
+  g.conditions.mutex.RLock()
+  defer g.conditions.mutex.RUnlock()
+  if multiplier, ok := g.conditions.multipliers[id]; ok {
+    return multiplier
+  }
+  return 1
+}
+
+// RoadConditions - version of the road conditions and the conditions of the edges changed after version
+//   since, in edge ID order; 0 lists every edge ever changed.
+func (g *Digraph) RoadConditions(since uint64) (version uint64, changed []RoadCondition) {
+  if g.conditions == nil {
+    return
+  }
+  g.conditions.mutex.RLock()
+  defer g.conditions.mutex.RUnlock()
+  for id := uint(0); id < uint(len(g.Edges)); id++ {
+    if g.conditions.changedAt[id] > since {
+      multiplier, ok := g.conditions.multipliers[id]
+      if !ok {
+        multiplier = 1
+      }
+      changed = append(changed, RoadCondition{EdgeID:id, Closed:g.conditions.closed[id], Multiplier:multiplier})
+    }
+  }
+  return g.conditions.version, changed
+}
+
+// roadsVersion - version of the road conditions, counting the changes so far.
+func (g *Digraph) roadsVersion() uint64 {
+  if g.conditions == nil {
+    return 0
+  }
+  g.conditions.mutex.RLock()
+  defer g.conditions.mutex.RUnlock()
+  return g.conditions.version
+}
+
+// changedSince - true if the road conditions of any of edges changed after version.
+func (g *Digraph) changedSince(version uint64, edges []Edge) bool {
+  if g.conditions == nil {
+    return false
+  }
+  g.conditions.mutex.RLock()
+  defer g.conditions.mutex.RUnlock()
+  if g.conditions.version == version {
+    return false
+  }
+  for _, edge := range edges {
+    if g.conditions.changedAt[edge.ID] > version {
+      return true
+    }
+  }
+  return false
+}
+
+// RouteByTravelTimes - Weigh edges by their smoothed travel times in times when routing, nil to weigh them
+//   by length again.
+func (g *Digraph) RouteByTravelTimes(times *TravelTimes) {
+  g.travelTimes = times
+}
+
+// travelWeight - weight of edge, or its smoothed travel time when routing by travel times, scaled by
+//   its travel time multiplier, plus the cost of its turn through an intersection.
+func (g *Digraph) travelWeight(edge *Edge) float64 {
+  weight := edge.Weight
+  if g.travelTimes != nil {
+    weight = g.travelTimes.weight(edge)
+  }
+  return weight * g.TravelTimeMultiplier(edge.ID) + g.turnCost(edge)
+}
+
+// travelCost - total travel weight of edges.
+func (g *Digraph) travelCost(edges []Edge) (cost float64) {
+  for idx := range edges {
+    cost += g.travelWeight(&edges[idx])
+  }
+  return
+}
+
 // GetDigraphFromFile - Populate Digraph object from fomratted 'map' file.
 func GetDigraphFromFile(fname string) (d *Digraph) {
   d = NewDigraph()
 
   file, err := os.Open(fname)
   if err != nil {
-    log.Fatal(err)
+    defaultLogger.Component("digraph").Fatal("Could not open map", Fields{"file":fname, "error":err})
   }
   defer file.Close()
 
@@ -128,7 +327,7 @@ func GetDigraphFromFile(fname string) (d *Digraph) {
 			}
       idReadNext, err := strconv.Atoi(point)
 			if err != nil {
-				log.Fatalf("%s is not a number", point)
+				defaultLogger.Component("digraph").Fatal("Vertex ID is not a number", Fields{"file":fname, "point":point})
 			}
       idNext := uint(idReadNext)
       if _, ok := d.Vertices[idNext]; !ok {
@@ -143,6 +342,7 @@ func GetDigraphFromFile(fname string) (d *Digraph) {
       edge.End = vertNext
       edge.Extends = edgeExtends
       edge.Wraps = edgeWraps
+      edge.Lanes = 1
       d.Edges[edge.ID] = edge
       vert.AdjEdges = append(vert.AdjEdges, edge)
     }
@@ -156,66 +356,184 @@ func GetDigraphFromFile(fname string) (d *Digraph) {
     }
   }
 
-  intersectionCount := 0
   for scanner.Scan() {
     text := scanner.Text()
     if text == "STOPLIGHTS" {
       break
     }
-    numbers := splitLine(text," ", 4)
-    var stopSign Intersection
-    stopSign.id = uint(intersectionCount)
-    stopSign.intersectionType = StopSign
-    for direction, number := range numbers {
-      if number >= 0 {
-        stopSign.entries[direction].present = true
-        stopSign.entries[direction].vertex = d.Vertices[uint(number)]
-        d.Vertices[uint(number)].intersection = &stopSign
-        d.Vertices[uint(number)].directionFromIntersection = Direction(direction)
-      }
+    d.addIntersection(StopSign, splitLine(text," ", 4))
+  }
+
+  // Stop lights end at the first of the optional sections
+  section := ""
+  for scanner.Scan() {
+    text := scanner.Text()
+    if optionalMapSections[text] {
+      section = text
+      break
     }
-    d.Intersections = append(d.Intersections, &stopSign)
-    intersectionCount++
+    d.addIntersection(StopLight, splitLine(text," ", 4))
   }
 
   for scanner.Scan() {
     text := scanner.Text()
-    numbers := splitLine(text," ", 4)
-    var stopLight Intersection
-    stopLight.id = uint(intersectionCount)
-    stopLight.intersectionType = StopLight
-    for direction, number := range numbers {
-      if number >= 0 {
-        stopLight.entries[direction].present = true
-        stopLight.entries[direction].vertex = d.Vertices[uint(number)]
-        d.Vertices[uint(number)].intersection = &stopLight
-        d.Vertices[uint(number)].directionFromIntersection = Direction(direction)
+    if optionalMapSections[text] {
+      section = text
+      continue
+    }
+    line := strings.Fields(text)
+    if len(line) == 0 {
+      continue
+    }
+    switch section {
+    case "ROUNDABOUTS":
+      // Cars from every entry give way to the cars already in the roundabout
+      numbers, _ := splitEntries(text)
+      roundabout := d.addIntersection(Roundabout, numbers)
+      for direction := range roundabout.entries {
+        roundabout.entries[direction].yields = roundabout.entries[direction].present
+      }
+    case "YIELDS":
+      // Entries marked with a trailing y give way to the others, every entry if none is marked
+      numbers, yields := splitEntries(text)
+      yield := d.addIntersection(Yield, numbers)
+      marked := yields != [NumberOfDirections]bool{}
+      for direction := range yield.entries {
+        yield.entries[direction].yields = yield.entries[direction].present && (yields[direction] || !marked)
+      }
+    case "AUTONOMOUS":
+      // Cars reserve their path through these intersections and cross without stopping
+      d.addIntersection(Autonomous, splitLine(text," ", 4))
+    case "CROSSWALKS":
+      // Each line holds the vertices at either end of a crosswalk, one of them an intersection entry
+      numbers := splitLine(text, " ", 2)
+      if err := d.addCrosswalk(uint(numbers[0]), uint(numbers[1])); err != nil {
+        defaultLogger.Component("digraph").Fatal("Invalid crosswalk", Fields{"file":fname, "line":text, "error":err})
+      }
+    case "DEPOTS":
+      // Each depot line holds a name and its x,y position
+      if len(line) != 2 {
+        defaultLogger.Component("digraph").Fatal("Depot line is not a name and a position", Fields{"file":fname, "line":text})
+      }
+      numbers := splitLine(line[1], ",", 2)
+      d.Depots = append(d.Depots, Depot{Name:line[0], Pos:Coords{numbers[0], numbers[1]}})
+    case "NOTURNS":
+      // Each line holds an intersection entry vertex listed before and the turns forbidden from it
+      id, err := strconv.Atoi(line[0])
+      if err != nil || len(line) < 2 {
+        defaultLogger.Component("digraph").Fatal("Forbidden turn line is not a vertex and its turns", Fields{"file":fname, "line":text})
+      }
+      for _, name := range line[1:] {
+        turn, err := ParseTurn(name)
+        if err == nil {
+          err = d.ForbidTurn(uint(id), turn)
+        }
+        if err != nil {
+          defaultLogger.Component("digraph").Fatal("Could not forbid turn", Fields{"file":fname, "line":text, "error":err})
+        }
+      }
+    case "LANES":
+      // Each line holds the start and end vertex of an edge and its number of lanes
+      numbers := splitLine(text, " ", 3)
+      if !d.setLanes(uint(numbers[0]), uint(numbers[1]), uint(numbers[2])) {
+        defaultLogger.Component("digraph").Fatal("Invalid lanes", Fields{"file":fname, "line":text})
+      }
+    case "TURNCOSTS":
+      // Each line holds a turn and its cost in map units
+      if len(line) != 2 {
+        defaultLogger.Component("digraph").Fatal("Turn cost line is not a turn and a cost", Fields{"file":fname, "line":text})
+      }
+      turn, err := ParseTurn(line[0])
+      cost, costErr := strconv.ParseFloat(line[1], 64)
+      if err != nil || costErr != nil || !d.SetTurnCost(turn, cost) {
+        defaultLogger.Component("digraph").Fatal("Invalid turn cost", Fields{"file":fname, "line":text})
       }
     }
-    d.Intersections = append(d.Intersections, &stopLight)
-    intersectionCount++
   }
   return d
 }
 
+// optionalMapSections - headers of the sections that may follow the stop lights of a map file, in any order
+var optionalMapSections = map[string]bool{"ROUNDABOUTS":true, "YIELDS":true, "AUTONOMOUS":true, "DEPOTS":true, "NOTURNS":true,
+  "TURNCOSTS":true, "LANES":true, "CROSSWALKS":true}
+
+// addIntersection - Add an intersection of intersectionType entered at the vertices with IDs numbers, listed
+//   west, south, east and north with -1 for no entry, and find the movements through it.
+func (g *Digraph) addIntersection(intersectionType IntersectionType, numbers []float64) *Intersection {
+  intersection := new(Intersection)
+  intersection.id = uint(len(g.Intersections))
+  intersection.intersectionType = intersectionType
+  for direction, number := range numbers {
+    if number >= 0 {
+      intersection.entries[direction].present = true
+      intersection.entries[direction].vertex = g.Vertices[uint(number)]
+      g.Vertices[uint(number)].intersection = intersection
+      g.Vertices[uint(number)].directionFromIntersection = Direction(direction)
+    }
+  }
+  g.Intersections = append(g.Intersections, intersection)
+  g.findMovements(intersection)
+  return intersection
+}
+
+// setLanes - Give the edges from the vertex with ID start to the vertex with ID end lanes lanes, and true OK.
+//   False if there is no such edge or lanes is 0.
+func (g *Digraph) setLanes(start uint, end uint, lanes uint) bool {
+  vertex, ok := g.Vertices[start]
+  if !ok || lanes == 0 {
+    return false
+  }
+  found := false
+  for _, edge := range vertex.AdjEdges {
+    if edge.End.ID == end {
+      edge.Lanes = lanes
+      found = true
+    }
+  }
+  return found
+}
+
+// DepotPositions - positions of the depots of the map.
+func (g *Digraph) DepotPositions() (positions []Coords) {
+  for _, depot := range g.Depots {
+    positions = append(positions, depot.Pos)
+  }
+  return
+}
+
+// splitEntries - Split a line of intersection entries into their vertex IDs and whether each is marked
+//   with a trailing y.
+func splitEntries(line string) (numbers []float64, marked [NumberOfDirections]bool) {
+  fields := strings.Split(line, " ")
+  for direction := range fields {
+    if direction < NumberOfDirections && strings.HasSuffix(fields[direction], "y") {
+      marked[direction] = true
+      fields[direction] = strings.TrimSuffix(fields[direction], "y")
+    }
+  }
+  return splitLine(strings.Join(fields, " "), " ", NumberOfDirections), marked
+}
+
 // splitCSV - Split a CSV pair into constituent values.
 func splitLine(line string, separator string, length int) (numbers []float64) {
   numbersInString := strings.Split(line, separator)
   if len(numbersInString) != length {
-    log.Fatalf("Line does not have %d numbers, it has %d numbers", length, len(numbers))
+    defaultLogger.Component("digraph").Fatal("Line does not have the expected count of numbers", Fields{"line":line, "expected":length, "numbers":len(numbersInString)})
   }
 
   for _, numberInString := range numbersInString {
     number, err := strconv.Atoi(numberInString)
     if err != nil {
-      log.Fatalf("%s in %s is not a number", numberInString, numbersInString)
+      defaultLogger.Component("digraph").Fatal("Coordinate is not a number", Fields{"line":line, "number":numberInString})
     }
     numbers = append(numbers, float64(number))
   }
   return
 }
 
-// ShortestPath - solve for the shortest deighted directional path from start to end vertex.
+// ShortestPath - solve for the shortest deighted directional path from start to end vertex, avoiding
+//   closed edges and forbidden turns and weighting edges by their travel time multipliers and turn costs;
+//   dist is the distance driven on it.
 //   If not path can be found, return an empty slice and infinite distance.
 //   Negative edge weights are not permitted.
 func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist float64) {
@@ -226,7 +544,7 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
 
   // Receiver validity check
   if g.Vertices == nil || g.Edges == nil {
-    log.Println("err: ShortestPath - digraph not initialized")
+    defaultLogger.Component("digraph").Error("ShortestPath - digraph not initialized")
     return
   }
 
@@ -234,7 +552,7 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
   _, ok0 := g.Vertices[startVertID]
   _, ok1 := g.Vertices[endVertID]
   if !ok0 || !ok1 {
-    log.Println("err: ShortestPath - invalid start or end vertex")
+    defaultLogger.Component("digraph").Error("ShortestPath - invalid start or end vertex", Fields{"start":startVertID, "end":endVertID})
     return
   }
 
@@ -261,18 +579,20 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
   // Iterate over all vertices, starting at the query vertex, until end vertex is found
   currID := startVertID
   for ; len(unvisited) != 0 ; {
-    // Create a local record of the shortest distance in this iteration (optimization)
-    shortest := minDist{math.Inf(1), 0}
+    // The end vertex is visited at its shortest distance
+    if currID == endVertID {
+      break
+    }
 
     // Consider all unvisited neighbors of the current vertex
     for _, adjEdge := range g.Vertices[currID].AdjEdges {
       neighborID := adjEdge.End.ID  // Identify neighbor vertex
 
-      // Only consider if unvisited
-      if _, ok := unvisited[neighborID]; ok {
+      // Only consider if unvisited, open to traffic and not a forbidden turn
+      if _, ok := unvisited[neighborID]; ok && g.canDrive(adjEdge) {
 
         // Determine distance to start vertex
-        localdist := distances[currID].dist + adjEdge.Weight
+        localdist := distances[currID].dist + g.travelWeight(adjEdge)
         //fmt.Println("currID", currID, "neighborID", neighborID, "adjEdge", adjEdge)
         //fmt.Println("localdist", localdist, "currdist", distances[currID].dist, "weight", adjEdge.Weight)
 
@@ -280,31 +600,24 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
         if localdist < distances[neighborID].dist {
           distances[neighborID] = minDist{localdist, currID}
         }
-
-        // If this is the shortest distance for the current vertex, note so
-        if localdist < shortest.dist {
-          shortest = minDist{localdist, neighborID}
-        }
       }
     }
 
-    // If identified shortest is valid, use it as next vertex to visit
-    var nextID uint
-    if !math.IsInf(shortest.dist, 1) {
-      nextID = uint(shortest.prev)
-    } else {  // Otherwise, search graph for next closest vertex
-      nextClosest := minDist{math.Inf(1), 0}  // Identify next closest vertex
-
-      // Walk the unvisited vertices to find the next closest vertex
-      for idx := range unvisited {
-        if distances[idx].dist < nextClosest.dist {
-          nextClosest = minDist{distances[idx].dist, idx}
-        }
+    // Visit the closest unvisited vertex next, so every vertex is visited at its shortest distance
+    // even where edge weights differ from their lengths; ties go to the lowest ID for repeatable routes
+    nextClosest := minDist{math.Inf(1), 0}
+    for idx := range unvisited {
+      if idx != currID && (distances[idx].dist < nextClosest.dist ||
+        (distances[idx].dist == nextClosest.dist && idx < nextClosest.prev)) {
+        nextClosest = minDist{distances[idx].dist, idx}
       }
+    }
 
-      // Assign next vertex as the closest unvisited vertex
-      nextID = uint(nextClosest.prev)
+    // The vertices left cannot be reached, as when closed edges cut them off
+    if math.IsInf(nextClosest.dist, 1) {
+      break
     }
+    nextID := nextClosest.prev
 
     // Identify current vertex as 'visited' and move to next vertex
     delete(unvisited, currID)
@@ -316,14 +629,12 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
   // Determine if a valid path was found
   if !math.IsInf(distances[endVertID].dist, 1) {
     inverse := make([]uint, 0)
-    dist = float64(0)
+    dist = 0
 
     // Build the path backwards from the destination vertex
     inverse = append(inverse, endVertID)
     for curr := endVertID; curr != startVertID; curr = distances[curr].prev {
       inverse = append(inverse, distances[curr].prev)
-      dist += distances[curr].dist
-      //fmt.Println("cd", distances[curr].dist)
     }
 
     // Invert the path back for the path from start
@@ -337,8 +648,9 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
   for i :=0 ; i < len(edgeIDs)-1; i++ {
     vertex := g.Vertices[edgeIDs[i]]
     for _, adjEdge := range vertex.AdjEdges {
-      if edgeIDs[i+1] == adjEdge.End.ID {
+      if edgeIDs[i+1] == adjEdge.End.ID && g.canDrive(adjEdge) {
         edges = append(edges, *adjEdge)
+        dist += adjEdge.Weight
         break
       }
     }
@@ -347,8 +659,23 @@ func (g *Digraph) shortestPath(startVertID, endVertID uint) (edges []Edge, dist
   return
 }
 
+// routeDistance - distance driven from one location on the graph to another.
+//   If no route can be found, return infinite distance.
+func (g *Digraph) routeDistance(from Location, to Location) (float64) {
+  // Both locations on the same edge with the destination ahead; no routing needed
+  if from.edge.ID == to.edge.ID &&
+    from.intersect.Distance(from.edge.End.Pos) >= to.intersect.Distance(to.edge.End.Pos) {
+    return from.intersect.Distance(to.intersect)
+  }
+  _, dist := g.shortestPath(from.edge.End.ID, to.edge.Start.ID)
+  dist += from.intersect.Distance(from.edge.End.Pos)
+  dist += to.edge.Start.Pos.Distance(to.intersect)
+  return dist
+}
+
 // closestEdgeAndCoord For coords within world space, find  closest coords on an edge on world graph
 // Return coordinates of closest point on world graph, and corresponding edge ID in world struct
+// Only roads cars may be sent to are considered, see isDestination
 func (g Digraph) closestEdgeAndCoord(queryPoint Coords) (location Location) {
   // TODO: input sanitation/validation; error handling?
   // TODO: proper helper function breakdown of closestEdgeAndCoord
@@ -361,7 +688,7 @@ func (g Digraph) closestEdgeAndCoord(queryPoint Coords) (location Location) {
 
   // TODO: remove randomness caused by traversing equivalent closest edges with 'range' on map here
   for _, edge := range g.Edges {
-  	if !edge.Wraps {
+  	if !edge.Wraps && g.isDestination(edge) {
 			coord, dist := edge.checkIntersect(queryPoint)
 			//fmt.Print("[", edge.Start.ID, ", ", edge.End.ID, "]: ")
 			//fmt.Print("shortest: ", location.intersect, "@", shortestDistance, ", new: ", coord, "@", dist)
@@ -463,9 +790,61 @@ func (e *Edge) unitVector() (c Coords){
   return
 }
 
-func (g Digraph) getRandomEdge() (edge Edge) {
-  s1 := rand.NewSource(time.Now().UnixNano())
-  r1 := rand.New(s1)
-  edge = *g.Edges[uint(r1.Int() % len(g.Edges))]
+// getRandomEdge - a random edge cars may be sent to, drawn by random. Roads a car at vertex from can reach and
+//   drive on from back to it are preferred over ones cut off by closures; if every road is closed, any edge.
+func (g *Digraph) getRandomEdge(from uint, random *rand.Rand) (edge Edge) {
+  var candidates, reachable []*Edge
+  reaching := g.connectedVertices(from, false)
+  returning := g.connectedVertices(from, true)
+  for _, edge := range g.Edges {
+    if g.isDestination(edge) {
+      candidates = append(candidates, edge)
+      if reaching[edge.Start.ID] && returning[edge.End.ID] {
+        reachable = append(reachable, edge)
+      }
+    }
+  }
+  if len(reachable) > 0 {
+    candidates = reachable
+  }
+  if len(candidates) == 0 {
+    return *g.Edges[uint(random.Intn(len(g.Edges)))]  // Routing to it strands the car until a road opens
+  }
+  sort.Slice(candidates, func(i, j int) bool { return candidates[i].ID < candidates[j].ID })  // Map order is random
+  edge = *candidates[random.Intn(len(candidates))]
   return
 }
+
+// isDestination - true if cars may be sent to edge: an open road between intersections rather than a
+//   movement through one, which may be a forbidden turn.
+func (g *Digraph) isDestination(edge *Edge) bool {
+  return edge.movement == nil && g.canDrive(edge)
+}
+
+// connectedVertices - IDs of the vertices reachable from vertex over roads cars may drive, or with reverse,
+//   of the vertices vertex is reachable from.
+func (g *Digraph) connectedVertices(vertex uint, reverse bool) map[uint]bool {
+  entering := make(map[uint][]*Edge)
+  if reverse {
+    for _, edge := range g.Edges {
+      entering[edge.End.ID] = append(entering[edge.End.ID], edge)
+    }
+  }
+  connected := map[uint]bool{vertex: true}
+  queue := []uint{vertex}
+  for len(queue) > 0 {
+    id := queue[0]
+    queue = queue[1:]
+    edges, next := g.Vertices[id].AdjEdges, func(edge *Edge) uint { return edge.End.ID }
+    if reverse {
+      edges, next = entering[id], func(edge *Edge) uint { return edge.Start.ID }
+    }
+    for _, edge := range edges {
+      if other := next(edge); !connected[other] && g.canDrive(edge) {
+        connected[other] = true
+        queue = append(queue, other)
+      }
+    }
+  }
+  return connected
+}
@@ -0,0 +1,273 @@
+package sim2
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestDigraph_CloseEdge(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	open, openDist := graph.shortestPath(22, 26)
+	if len(open) == 0 || open[0].ID != 36 {
+		t.Fatalf("Expected the shortest path from 22 to 26 to start on edge 36, got %v \n", open)
+	}
+	if !graph.CloseEdge(36) {
+		t.Fatalf("Could not close edge 36 \n")
+	}
+	closed, closedDist := graph.shortestPath(22, 26)
+	for _, edge := range closed {
+		if edge.ID == 36 {
+			t.Errorf("Route uses closed edge 36 \n")
+		}
+	}
+	if len(closed) == 0 || closedDist <= openDist {
+		t.Errorf("Expected a longer detour around edge 36, got %v at %v \n", closed, closedDist)
+	}
+	graph.OpenEdge(36)
+	if _, dist := graph.shortestPath(22, 26); dist != openDist {
+		t.Errorf("Reopened edge was not used again \n")
+	}
+	if graph.CloseEdge(1000) {
+		t.Errorf("Closed an edge that is not on the map \n")
+	}
+}
+
+func TestDigraph_ShortestPathUnreachable(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	graph.CloseEdge(16) // The only edge leaving vertex 9
+	edges, dist := graph.shortestPath(9, 14)
+	if len(edges) != 0 || !math.IsInf(dist, 1) {
+		t.Errorf("Expected no path out of a dead end, got %v at %v \n", edges, dist)
+	}
+}
+
+func TestDigraph_TravelTimeMultiplier(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	_, openDist := graph.shortestPath(22, 26)
+	if !graph.SetTravelTimeMultiplier(36, 100) {
+		t.Fatalf("Could not slow down edge 36 \n")
+	}
+	slow, slowDist := graph.shortestPath(22, 26)
+	for _, edge := range slow {
+		if edge.ID == 36 {
+			t.Errorf("Route uses edge 36 slowed down a hundred times \n")
+		}
+	}
+	if slowDist <= openDist || slowDist > 100*openDist {
+		t.Errorf("Expected the driven distance of the detour, got %v against %v \n", slowDist, openDist)
+	}
+	graph.SetTravelTimeMultiplier(36, 1)
+	if _, dist := graph.shortestPath(22, 26); dist != openDist {
+		t.Errorf("Restored edge was not used again \n")
+	}
+	for _, invalid := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if graph.SetTravelTimeMultiplier(36, invalid) {
+			t.Errorf("Set travel time multiplier %v \n", invalid)
+		}
+	}
+}
+
+func TestDigraph_RoadConditions(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	car := GetDigraphFromFile("../../maps/4by4.map")
+	car.ShareRoadConditions(graph)
+	graph.CloseEdge(36)
+	version, _ := graph.RoadConditions(0)
+	graph.SetTravelTimeMultiplier(16, 3)
+	if !car.IsClosed(36) || car.TravelTimeMultiplier(16) != 3 {
+		t.Errorf("Road conditions are not shared \n")
+	}
+	latest, changed := car.RoadConditions(version)
+	if latest != version+1 || len(changed) != 1 || changed[0] != (RoadCondition{EdgeID: 16, Multiplier: 3}) {
+		t.Errorf("Expected edge 16 changed after version %d, got %v at version %d \n", version, changed, latest)
+	}
+	if _, all := car.RoadConditions(0); len(all) != 2 {
+		t.Errorf("Expected both changed edges, got %v \n", all)
+	}
+	if !graph.changedSince(version, []Edge{*graph.Edges[16]}) || graph.changedSince(version, []Edge{*graph.Edges[36]}) {
+		t.Errorf("Edges changed since version %d misidentified \n", version)
+	}
+
+	closed, slow := false, 0.5
+	if condition, err := graph.changeRoad(36, &closed, &slow); err != nil || condition.Closed || condition.Multiplier != 0.5 {
+		t.Errorf("Road change not applied, got %v, %v \n", condition, err)
+	}
+	slow = -2
+	if _, err := graph.changeRoad(36, nil, &slow); err == nil || graph.TravelTimeMultiplier(36) != 0.5 {
+		t.Errorf("Invalid multiplier applied \n")
+	}
+	if _, err := graph.changeRoad(1000, &closed, nil); err == nil {
+		t.Errorf("Changed an edge that is not on the map \n")
+	}
+}
+
+func TestCar_RerouteOnRoadChange(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.PlaceAt(Coords{131, 350})
+	destination := closestParkingLocation(graph, Coords{880, 520})
+	car.routeTo(destination)
+	route := car.path.routeIDs()
+	if len(route) < 3 || route[2] != 16 {
+		t.Fatalf("Expected a route over edge 16, got %v \n", route)
+	}
+
+	graph.SetTravelTimeMultiplier(77, 5) // Not on the route
+	car.reroute()
+	if rerouted := car.path.routeIDs(); len(rerouted) != len(route) || rerouted[2] != 16 {
+		t.Errorf("Rerouted after a change off the route, got %v \n", rerouted)
+	}
+	graph.CloseEdge(16)
+	car.reroute()
+	rerouted := car.path.routeIDs()
+	for _, id := range rerouted {
+		if id == 16 {
+			t.Errorf("Route still uses closed edge 16: %v \n", rerouted)
+		}
+	}
+	if len(rerouted) == 0 || rerouted[len(rerouted)-1] != destination.edge.ID {
+		t.Errorf("Route no longer leads to the destination: %v \n", rerouted)
+	}
+}
+
+func TestCar_NoRoute(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.path.edge = *graph.Edges[52] // Ends at vertex 5, whose only exit is edge 8
+	car.path.pos = car.path.edge.End.Pos
+	for _, id := range []uint{13, 40, 77} { // Every edge into vertex 9
+		graph.CloseEdge(id)
+	}
+	car.routeTo(Location{graph.Edges[16].Start.Pos, *graph.Edges[16]})
+	if !car.path.stranded || len(car.path.routeEdges) != 1 || car.path.routeEdges[0].ID != 8 {
+		t.Errorf("Expected a detour down edge 8, got %v \n", car.path.routeIDs())
+	}
+	if car.path.destinationEdgeReached() {
+		t.Errorf("Detouring car considers itself at its destination \n")
+	}
+
+	car.path.edge = *graph.Edges[13] // Ends at vertex 9, whose only exit is edge 16
+	car.path.pos = car.path.edge.End.Pos
+	graph.CloseEdge(16)
+	car.routeTo(closestParkingLocation(graph, Coords{880, 520}))
+	if route := car.path.routeIDs(); !car.path.stranded || len(route) != 1 || route[0] != 16 {
+		t.Fatalf("Expected the car caught behind the closure to leave over closed edge 16, got %v \n", route)
+	}
+	graph.OpenEdge(16)
+	car.routeTo(car.path.destination)
+	if route := car.path.routeIDs(); car.path.stranded || len(route) == 0 || route[0] != 16 {
+		t.Errorf("Expected a route out over reopened edge 16, got %v \n", route)
+	}
+}
+
+func TestCar_DetourAwayFromDeadEnd(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	random := rand.New(rand.NewSource(1))
+	graph.CloseEdge(16) // Vertex 9 becomes a dead end
+	for i := 0; i < 200; i++ {
+		if edge := graph.getRandomEdge(8, random); edge.ID == 77 || edge.ID == 13 {
+			t.Fatalf("Sent a car down edge %d into the dead end \n", edge.ID)
+		}
+	}
+	graph.OpenEdge(16)
+	for _, id := range []uint{13, 40, 77} { // Every edge into vertex 9
+		graph.CloseEdge(id)
+	}
+	for i := 0; i < 200; i++ {
+		if edge := graph.getRandomEdge(8, random); edge.ID == 16 {
+			t.Fatalf("Sent a car to edge 16, which it cannot reach \n")
+		}
+	}
+	for _, id := range []uint{13, 40, 77} {
+		graph.OpenEdge(id)
+	}
+
+	graph.CloseEdge(16)
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.SetSeed(1)
+	car.path.edge = *graph.Edges[8] // Ends at vertex 8, whose exits include edge 13 into vertex 9
+	car.path.pos = car.path.edge.End.Pos
+	for i := 0; i < 20; i++ {
+		car.path.stranded = false
+		car.detour()
+		if len(car.path.routeEdges) != 1 || car.path.routeEdges[0].ID == 13 {
+			t.Fatalf("Expected a detour away from the dead end, got %v \n", car.path.routeIDs())
+		}
+	}
+}
+
+func TestDigraph_RandomEdgeSeeded(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	first, second := rand.New(rand.NewSource(7)), rand.New(rand.NewSource(7))
+	for i := 0; i < 20; i++ {
+		if a, b := graph.getRandomEdge(8, first), graph.getRandomEdge(8, second); a.ID != b.ID {
+			t.Fatalf("Same seed picked edges %d and %d \n", a.ID, b.ID)
+		}
+	}
+}
+
+func TestDigraph_RoundaboutsAndYields(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	roundabout := graph.Vertices[12].intersection
+	yield := graph.Vertices[30].intersection
+	if roundabout.intersectionType != Roundabout || yield.intersectionType != Yield {
+		t.Fatalf("Expected a roundabout at vertex 12 and a yield intersection at vertex 30 \n")
+	}
+	for _, entry := range roundabout.entries {
+		if !entry.yields {
+			t.Errorf("Roundabout entry %d does not give way \n", entry.vertex.ID)
+		}
+	}
+	if !yield.entries[West].yields || yield.entries[South].yields || yield.entries[North].yields {
+		t.Errorf("Expected only vertex 30 to give way at the yield intersection \n")
+	}
+	if graph.Edges[19].crosses != roundabout || graph.Edges[34].crosses != roundabout || graph.Edges[59].crosses != nil {
+		t.Errorf("Edges through the roundabout not marked \n")
+	}
+	if len(graph.Intersections) != 8 || graph.Intersections[roundabout.id] != roundabout {
+		t.Errorf("Intersections not numbered in map order \n")
+	}
+}
+
+func TestCar_GapToEnter(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	enter := func(edge uint, others ...CarInfo) bool {
+		car.path.edge = *graph.Edges[edge]
+		car.path.pos = graph.Edges[edge].End.Pos
+		car.path.trafficInfo.carStates = others
+		return car.gapToEnter()
+	}
+
+	// Yield intersection: vertex 30 gives way to the road through vertices 33 and 35
+	if !enter(70) {
+		t.Errorf("Gave way with no other car around \n")
+	}
+	if enter(70, CarInfo{ID: 1, EdgeId: 53, Pos: Coords{800, 124}}) {
+		t.Errorf("Entered in front of a car approaching on the priority road \n")
+	}
+	if !enter(70, CarInfo{ID: 1, EdgeId: 53, Pos: Coords{1000, 124}}) {
+		t.Errorf("Gave way to a car far along the priority road \n")
+	}
+	if enter(70, CarInfo{ID: 1, EdgeId: 45, Pos: Coords{730, 124}}) {
+		t.Errorf("Entered in front of a car crossing the intersection \n")
+	}
+	if !enter(70, CarInfo{ID: 1, EdgeId: 45, Pos: Coords{700, 124}}) {
+		t.Errorf("Gave way to a car past the entry \n")
+	}
+	if !enter(53, CarInfo{ID: 1, EdgeId: 18, Pos: Coords{620, 150}}) {
+		t.Errorf("Car on the priority road gave way \n")
+	}
+
+	// Roundabout: every entry gives way to the cars circulating
+	if enter(59, CarInfo{ID: 1, EdgeId: 19, Pos: Coords{420, 126}}) {
+		t.Errorf("Entered the roundabout in front of a circulating car \n")
+	}
+	if !enter(59, CarInfo{ID: 1, EdgeId: 17, Pos: Coords{420, 152}}) {
+		t.Errorf("Gave way to a circulating car past the entry \n")
+	}
+	if !enter(59, CarInfo{ID: 1, EdgeId: 46, Pos: Coords{500, 124}}) {
+		t.Errorf("Gave way to a car approaching another entry \n")
+	}
+}
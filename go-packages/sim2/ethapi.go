@@ -1,15 +1,17 @@
 package sim2
 
 import (
-	"log"
-	"fmt"
 	"context"
+	"errors"
 	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"math/big"
 	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,42 +22,56 @@ type EthAPI struct {
 	newRideEvent chan *MoovRideManagerNewRideRequest
 	lastNewRequestIndex uint
 	lastCheck time.Time
+	metrics *Metrics
+	logger *Logger
 }
 
 type BlockchainInterface interface {
 	GetRideAddressIfAvailable() (available bool, address string)
 	AcceptRequest(address string) (status bool)
 	GetLocations(address string) (from string, to string)
+	GetAmount(address string) (amount uint64)
 }
 
 
 func NewEthApi(mrmAddress string, privateKeyString string) (*EthAPI)  {
 	var err error
 	var ethApi EthAPI
+	ethApi.SetLogger(defaultLogger)
 	//c.ethApi.conn, err = ethclient.Dial("http://127.0.0.1:7545")
 	ethApi.conn, err = ethclient.Dial("ws://127.0.0.1:8546")
 	if err != nil {
-		log.Fatalf("could not create ipc client: %v", err)
+		ethApi.logger.Fatal("could not create ipc client", Fields{"error":err})
 	}
 	ethApi.mrm, err = NewMoovRideManager(common.HexToAddress(mrmAddress), ethApi.conn)
 	if err != nil {
-		log.Fatalf("could not connect to mrm: %v", err)
+		ethApi.logger.Fatal("could not connect to mrm", Fields{"error":err, "mrm":mrmAddress})
 	}
 
 	privateKey, err := crypto.HexToECDSA(privateKeyString)
 	if err != nil {
-		log.Fatalf("could not convert private key to hex: %v", err)
+		ethApi.logger.Fatal("could not convert private key to hex", Fields{"error":err})
 	}
 	ethApi.auth = bind.NewKeyedTransactor(privateKey)
 	ethApi.newRideEvent = make(chan *MoovRideManagerNewRideRequest)
 	_, err = ethApi.mrm.WatchNewRideRequest(nil, ethApi.newRideEvent);
 	if err != nil {
-		log.Fatalf("could not watch for New Ride event: %v", err)
+		ethApi.logger.Fatal("could not watch for New Ride event", Fields{"error":err})
 	}
 	ethApi.lastCheck = time.Now()
 	return &ethApi
 }
 
+// SetLogger - Log to the ethapi component of logger.
+func (ethApi *EthAPI) SetLogger(logger *Logger) {
+	ethApi.logger = logger.Component("ethapi")
+}
+
+// SetMetrics - Count failed geth calls in metrics.
+func (ethApi *EthAPI) SetMetrics(metrics *Metrics) {
+	ethApi.metrics = metrics
+}
+
 func (ethApi *EthAPI) GetRideAddressIfAvailable() (available bool, address string) {
 	ethApi.checkConnection()
 	select {
@@ -64,7 +80,8 @@ func (ethApi *EthAPI) GetRideAddressIfAvailable() (available bool, address strin
 			msg.Raw.Index = ethApi.lastNewRequestIndex
 			addresses, err := ethApi.mrm.GetAvailableRides(nil)
 			if err != nil {
-				log.Println("could not get addresses from car: ", err)
+				ethApi.logger.Error("could not get addresses from car", Fields{"error":err})
+				ethApi.metrics.GethError("GetAvailableRides")
 			}
 			if len(addresses) > 0 {
 				//ethApi.lastNewRequestIndex = msg.Raw.Index
@@ -82,7 +99,8 @@ func (ethApi *EthAPI) GetRideAddressIfAvailable() (available bool, address strin
 		if time.Now().Sub(ethApi.lastCheck) > time.Second * 3 {
 			addresses, err := ethApi.mrm.GetAvailableRides(nil)
 			if err != nil {
-				log.Println("could not get addresses from car: ", err)
+				ethApi.logger.Error("could not get addresses from car", Fields{"error":err})
+				ethApi.metrics.GethError("GetAvailableRides")
 			}
 			if len(addresses) > 0 {
 				//ethApi.lastNewRequestIndex = msg.Raw.Index
@@ -108,14 +126,17 @@ func (ethApi *EthAPI) AcceptRequest(address string) (status bool) {
 		GasLimit: 2381623,
 	}, common.HexToAddress(address))
 	if err != nil {
-		log.Println("Could not accept ride request from car: ", err)
+		ethApi.logger.Error("Could not accept ride request from car", Fields{RiderField:address, "error":err})
+		ethApi.metrics.GethError("AcceptRideRequest")
 		status = false
 	} else {
-		fmt.Println("Transaction initiated")
+		txLogger := ethApi.logger.With(Fields{RiderField:address, TxHashField:transaction.Hash().Hex()})
+		txLogger.Info("Transaction initiated")
 		receipt, err := bind.WaitMined(context.Background(), ethApi.conn, transaction)
 		if err != nil {
-			log.Fatalf("Wait for mining error: %v \n", err)
+			txLogger.Fatal("Wait for mining error", Fields{"error":err})
 		} else if receipt.Status == types.ReceiptStatusFailed {
+			txLogger.Warn("Transaction failed")
 			status = false
 		} else {
 			status = true
@@ -128,17 +149,241 @@ func (ethApi *EthAPI) GetLocations(address string) (from string, to string) {
 	ethApi.checkConnection()
 	ride, err := ethApi.mrm.Rides(nil, common.HexToAddress(address))
 	if err != nil {
-		log.Println("get locations error: ", err)
+		ethApi.logger.Error("get locations error", Fields{RiderField:address, "error":err})
+		ethApi.metrics.GethError("Rides")
 	} else {
 		from = ride.From
 		to = ride.To
 	}
 	return
 }
+
+func (ethApi *EthAPI) GetAmount(address string) (amount uint64) {
+	ethApi.checkConnection()
+	ride, err := ethApi.mrm.Rides(nil, common.HexToAddress(address))
+	if err != nil {
+		ethApi.logger.Error("get amount error", Fields{RiderField:address, "error":err})
+		ethApi.metrics.GethError("Rides")
+	} else if ride.Amount != nil {
+		amount = ride.Amount.Uint64()
+	}
+	return
+}
+
+// OpenRideRequests - rides no car has accepted yet.
+func (ethApi *EthAPI) OpenRideRequests() (rides []RideRequest) {
+	ethApi.checkConnection()
+	addresses, err := ethApi.mrm.GetAvailableRides(nil)
+	if err != nil {
+		ethApi.logger.Error("could not get available rides", Fields{"error":err})
+		ethApi.metrics.GethError("GetAvailableRides")
+		return
+	}
+	for _, address := range addresses {
+		ride, err := ethApi.mrm.Rides(nil, address)
+		if err != nil {
+			ethApi.logger.Error("get locations error", Fields{RiderField:address.Hex(), "error":err})
+			ethApi.metrics.GethError("Rides")
+			continue
+		}
+		rides = append(rides, RideRequest{Rider:address.String(), From:ride.From, To:ride.To})
+	}
+	return
+}
+
 func (ethApi *EthAPI) checkConnection() {
 	_, err := ethApi.conn.NetworkID(context.TODO())
 	if err!= nil {
-		log.Fatalln("Geth Connection Problem")
+		ethApi.logger.Fatal("Geth Connection Problem", Fields{"error":err})
 	}
 }
 
+
+// rideAvailable - status in the ride manager contract of a rider without an open ride.
+const rideAvailable uint8 = 0
+
+// MiningTimeout - how long ContractRiders waits for a transaction to be mined before giving up on the ride.
+const MiningTimeout = time.Minute * 2
+
+// ContractRiders - requests rides from the ride manager contract, taking turns among rider accounts without an
+//   open ride. MoovCoins are approved for the ride manager to escrow when an account's allowance falls short.
+type ContractRiders struct {
+	conn *ethclient.Client
+	mrmAddress common.Address
+	mrm *MoovRideManager
+	coin *MoovCoin
+	riders []*bind.TransactOpts
+	mutex sync.Mutex
+	next int  // Index of the rider requesting the next ride
+	pending map[common.Address]bool  // Riders whose ride request is not mined yet
+	metrics *Metrics
+	logger *Logger
+}
+
+// NewContractRiders - Constructor for a valid ContractRiders object requesting rides with the hex private keys.
+func NewContractRiders(mrmAddress string, privateKeys []string) (*ContractRiders, error) {
+	if len(privateKeys) == 0 {
+		return nil, errors.New("contract riders need at least one private key")
+	}
+	conn, err := ethclient.Dial("ws://127.0.0.1:8546")
+	if err != nil {
+		return nil, err
+	}
+	r := new(ContractRiders)
+	r.conn = conn
+	r.pending = make(map[common.Address]bool)
+	r.logger = defaultLogger.Component("ethapi")
+	r.mrmAddress = common.HexToAddress(mrmAddress)
+	r.mrm, err = NewMoovRideManager(r.mrmAddress, conn)
+	if err != nil {
+		return nil, err
+	}
+	coinAddress, err := r.mrm.MoovCoin(nil)
+	if err != nil {
+		return nil, err
+	}
+	r.coin, err = NewMoovCoin(coinAddress, conn)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range privateKeys {
+		privateKey, err := crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(key), "0x"))
+		if err != nil {
+			return nil, err
+		}
+		r.riders = append(r.riders, bind.NewKeyedTransactor(privateKey))
+	}
+	return r, nil
+}
+
+// SetMetrics - Count failed ride requests in metrics.
+func (r *ContractRiders) SetMetrics(metrics *Metrics) {
+	r.metrics = metrics
+}
+
+// RequestRide - Request a ride from the account of rider, or from the next rider account without an open ride
+//   if rider is "", and wait for it to be mined. Returns "" when no such account is free or the request failed;
+//   safe to call concurrently, with one request in flight per account.
+func (r *ContractRiders) RequestRide(rider string, from string, to string, amount uint64) string {
+	auth := r.reserve(rider)
+	if auth == nil {
+		r.logger.Warn("No rider account without an open ride", Fields{RiderField:rider, "from":from, "to":to})
+		return ""
+	}
+	defer r.release(auth)
+
+	riderLogger := r.logger.With(Fields{RiderField:auth.From.Hex()})
+	value := new(big.Int).SetUint64(amount)
+	if !r.approve(auth, value, riderLogger) {
+		return ""
+	}
+	transaction, err := r.mrm.NewRideRequest(r.transactOpts(auth), from, to, value)
+	if err != nil {
+		riderLogger.Error("Could not request ride", Fields{"error":err})
+		r.metrics.GethError("NewRideRequest")
+		return ""
+	}
+	if !r.waitMined(transaction, riderLogger) {
+		return ""
+	}
+	riderLogger.Debug("Ride request mined", Fields{TxHashField:transaction.Hash().Hex()})
+	return auth.From.Hex()
+}
+
+// reserve - the next rider account without an open ride, only the account of rider unless it is "", held until
+//   release, or nil if there is none. Accounts are held while the contract is asked about their rides, so the
+//   lock is not kept over the calls.
+func (r *ContractRiders) reserve(rider string) *bind.TransactOpts {
+	for i := 0; i < len(r.riders); i++ {
+		auth := r.hold(rider)
+		if auth == nil {
+			return nil
+		}
+		ride, err := r.mrm.Rides(nil, auth.From)
+		if err != nil {
+			r.logger.Error("get ride status error", Fields{RiderField:auth.From.Hex(), "error":err})
+			r.metrics.GethError("Rides")
+		} else if ride.RideStatus == rideAvailable {
+			return auth
+		}
+		r.release(auth)  // The contract allows one open ride per rider
+		if rider != "" {
+			break  // No other account may request the ride
+		}
+	}
+	return nil
+}
+
+// hold - the next rider account without a request in flight, only the account of rider unless it is "", held
+//   until release, or nil if there is none.
+func (r *ContractRiders) hold(rider string) *bind.TransactOpts {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := 0; i < len(r.riders); i++ {
+		index := (r.next + i) % len(r.riders)
+		auth := r.riders[index]
+		if rider != "" && !strings.EqualFold(auth.From.Hex(), rider) {
+			continue
+		}
+		if !r.pending[auth.From] {
+			r.pending[auth.From] = true
+			r.next = (index + 1) % len(r.riders)
+			return auth
+		}
+	}
+	return nil
+}
+
+// release - Let the rider account request again once its ride is no longer open.
+func (r *ContractRiders) release(auth *bind.TransactOpts) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.pending, auth.From)
+}
+
+// approve - Make sure the ride manager may escrow value from the rider account, returning false if it may not.
+func (r *ContractRiders) approve(auth *bind.TransactOpts, value *big.Int, riderLogger *Logger) bool {
+	allowance, err := r.coin.Allowance(nil, auth.From, r.mrmAddress)
+	if err != nil {
+		riderLogger.Error("get allowance error", Fields{"error":err})
+		r.metrics.GethError("Allowance")
+		return false
+	}
+	if allowance.Cmp(value) >= 0 {
+		return true
+	}
+	transaction, err := r.coin.Approve(r.transactOpts(auth), r.mrmAddress, value)
+	if err != nil {
+		riderLogger.Error("Could not approve MoovCoins for the ride", Fields{"error":err})
+		r.metrics.GethError("Approve")
+		return false
+	}
+	return r.waitMined(transaction, riderLogger)
+}
+
+// waitMined - Wait up to MiningTimeout for the transaction to be mined, returning false if it failed or was
+//   not mined in time.
+func (r *ContractRiders) waitMined(transaction *types.Transaction, riderLogger *Logger) bool {
+	txLogger := riderLogger.With(Fields{TxHashField:transaction.Hash().Hex()})
+	ctx, cancel := context.WithTimeout(context.Background(), MiningTimeout)
+	defer cancel()
+	receipt, err := bind.WaitMined(ctx, r.conn, transaction)
+	if err != nil {
+		txLogger.Error("Wait for mining error", Fields{"error":err})
+		return false
+	}
+	if receipt.Status == types.ReceiptStatusFailed {
+		txLogger.Warn("Transaction failed")
+		return false
+	}
+	return true
+}
+
+// transactOpts - options for a transaction sent from the rider account.
+func (r *ContractRiders) transactOpts(auth *bind.TransactOpts) *bind.TransactOpts {
+	return &bind.TransactOpts{
+		From:     auth.From,
+		Signer:   auth.Signer,
+		GasLimit: 2381623,
+	}
+}
@@ -6,6 +6,7 @@ type MockEthAPI struct {
 	getAddressStruct GetAddressStruct
 	acceptRequestStruct AcceptRequestStruct
 	getLocationStruct GetLocationStruct
+	getAmountStruct GetAmountStruct
 }
 
 type GetAddressStruct struct{
@@ -59,4 +60,21 @@ func (mockEthApi *MockEthAPI) GetLocations(address string) (from string, to stri
 	from = mockEthApi.getLocationStruct.returnFrom
 	to = mockEthApi.getLocationStruct.returnTo
 	return
+}
+
+type GetAmountStruct struct {
+	paramAddress string
+	returnAmount uint64
+	function func(string) (uint64)
+	calls uint
+}
+
+func (mockEthApi *MockEthAPI) GetAmount(address string) (amount uint64) {
+	mockEthApi.getAmountStruct.calls++
+	mockEthApi.getAmountStruct.paramAddress = address
+	if mockEthApi.getAmountStruct.function != nil {
+		return mockEthApi.getAmountStruct.function(address)
+	}
+	amount = mockEthApi.getAmountStruct.returnAmount
+	return
 }
\ No newline at end of file
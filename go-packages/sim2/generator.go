@@ -0,0 +1,263 @@
+package sim2
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generator - Describes synthetic ride demand: where rides start and end, and how often they are requested
+
+// HotspotTries - road points drawn for a hotspot location before settling on the hotspot itself
+const HotspotTries = 100
+
+// LocationDistribution - draws ride origins or destinations on the map.
+type LocationDistribution interface {
+	Sample(r *rand.Rand) Coords
+}
+
+// UniformLocations - points spread evenly along the roads of the map.
+type UniformLocations struct {
+	edges      []*Edge
+	cumulative []float64 // Total length of the edges up to and including each edge
+}
+
+// NewUniformLocations - Constructor for a valid UniformLocations object over the roads of graph,
+//   leaving out edges through intersections and around the edge of the map.
+func NewUniformLocations(graph *Digraph) *UniformLocations {
+	u := new(UniformLocations)
+	ids := make([]int, 0, len(graph.Edges))
+	for id, edge := range graph.Edges {
+		if !edge.Extends && !edge.Wraps {
+			ids = append(ids, int(id))
+		}
+	}
+	sort.Ints(ids) // Same draws for the same seed
+	total := 0.0
+	for _, id := range ids {
+		edge := graph.Edges[uint(id)]
+		total += edge.Start.Pos.Distance(edge.End.Pos)
+		u.edges = append(u.edges, edge)
+		u.cumulative = append(u.cumulative, total)
+	}
+	return u
+}
+
+// Sample - a point on a road, every unit of road length equally likely.
+func (u *UniformLocations) Sample(r *rand.Rand) Coords {
+	if len(u.edges) == 0 {
+		return Coords{}
+	}
+	length := r.Float64() * u.cumulative[len(u.cumulative)-1]
+	idx := sort.SearchFloat64s(u.cumulative, length)
+	if idx == len(u.edges) {
+		idx--
+	}
+	edge := u.edges[idx]
+	along := r.Float64()
+	return Coords{edge.Start.Pos.X + along*(edge.End.Pos.X-edge.Start.Pos.X),
+		edge.Start.Pos.Y + along*(edge.End.Pos.Y-edge.Start.Pos.Y)}
+}
+
+// HotspotLocations - points on roads near hotspots, with a share of the points anywhere on the map.
+type HotspotLocations struct {
+	uniform    *UniformLocations
+	hotspots   []Coords
+	radius     float64 // Distance from a hotspot of the points drawn near it
+	background float64 // Share of points drawn anywhere on the map
+}
+
+// NewHotspotLocations - Constructor for a valid HotspotLocations object.
+func NewHotspotLocations(graph *Digraph, hotspots []Coords, radius float64, background float64) *HotspotLocations {
+	h := new(HotspotLocations)
+	h.uniform = NewUniformLocations(graph)
+	h.hotspots = hotspots
+	h.radius = radius
+	h.background = background
+	return h
+}
+
+// Sample - a point on a road within radius of a random hotspot, or anywhere for the background share.
+func (h *HotspotLocations) Sample(r *rand.Rand) Coords {
+	if len(h.hotspots) == 0 || r.Float64() < h.background {
+		return h.uniform.Sample(r)
+	}
+	hotspot := h.hotspots[r.Intn(len(h.hotspots))]
+	for try := 0; try < HotspotTries; try++ {
+		if pos := h.uniform.Sample(r); pos.Distance(hotspot) <= h.radius {
+			return pos
+		}
+	}
+	return hotspot
+}
+
+// NewLocationDistribution - the distribution named name, uniform or hotspot; hotspot needs hotspots.
+func NewLocationDistribution(name string, graph *Digraph, hotspots []Coords, radius float64) (LocationDistribution, error) {
+	switch name {
+	case "uniform":
+		return NewUniformLocations(graph), nil
+	case "hotspot":
+		if len(hotspots) == 0 {
+			return nil, errors.New("hotspot demand needs at least one hotspot")
+		}
+		return NewHotspotLocations(graph, hotspots, radius, 0.2), nil
+	}
+	return nil, errors.New("unknown demand distribution " + name)
+}
+
+// RatePeriod - ride requests per minute for a period of time.
+type RatePeriod struct {
+	PerMinute float64
+	Duration  time.Duration // 0 lasts forever
+}
+
+// ParseRates - parse comma separated rates of requests per minute, each lasting for a duration
+//   after ":", as in "10:5m,60:2m". A rate without a duration lasts forever.
+func ParseRates(list string) (rates []RatePeriod, err error) {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var period RatePeriod
+		parts := strings.SplitN(entry, ":", 2)
+		if period.PerMinute, err = strconv.ParseFloat(parts[0], 64); err != nil || period.PerMinute < 0 {
+			return nil, errors.New("rate " + parts[0] + " is not a number of requests per minute")
+		}
+		if len(parts) == 2 {
+			if period.Duration, err = time.ParseDuration(parts[1]); err != nil {
+				return nil, err
+			}
+		}
+		rates = append(rates, period)
+	}
+	return
+}
+
+// DemandConfig - where generated rides start and end and how often they are requested.
+type DemandConfig struct {
+	Origins      LocationDistribution
+	Destinations LocationDistribution
+	Rates        []RatePeriod // Repeated once the last period ends
+	Amount       uint64       // MoovCoins offered for each ride, unless the fare is quoted
+	MinDistance  float64      // Straight line distance from origin to destination a ride covers at least
+	Seed         int64
+}
+
+// DemandGenerator - requests rides at Poisson distributed times from a RideRequester.
+type DemandGenerator struct {
+	config    DemandConfig
+	requester RideRequester
+	pricing   *PricingService // Quotes the amount offered, nil to offer config.Amount
+	mutex     sync.Mutex      // Guards rand
+	rand      *rand.Rand
+	logger    *Logger
+}
+
+// NewDemandGenerator - Constructor for a valid DemandGenerator object requesting rides from requester.
+func NewDemandGenerator(config DemandConfig, requester RideRequester) *DemandGenerator {
+	g := new(DemandGenerator)
+	g.config = config
+	g.requester = requester
+	g.rand = rand.New(rand.NewSource(config.Seed))
+	g.logger = defaultLogger.Component("generator")
+	return g
+}
+
+// QuoteFares - Offer the quoted fare of each ride instead of a fixed amount.
+func (g *DemandGenerator) QuoteFares(pricing *PricingService) {
+	g.pricing = pricing
+}
+
+// LoopGenerator - Begin requesting rides, drawing the requests for each interval as it passes. Requests are
+//   issued concurrently, so a slow requester does not hold up the next interval; ContractRiders turns away
+//   requests while every rider account has one in flight.
+func (g *DemandGenerator) LoopGenerator(interval time.Duration) {
+	start := time.Now()
+	for {
+		time.Sleep(interval)
+		for _, ride := range g.generate(time.Since(start), interval) {
+			go g.request(ride)
+		}
+	}
+}
+
+// request - Request ride from the requester.
+func (g *DemandGenerator) request(ride RideRequest) {
+	amount := g.amount(ride)
+	rider := g.requester.RequestRide("", ride.From, ride.To, amount)
+	g.logger.Debug("Requested ride", Fields{RiderField: rider, "from": ride.From, "to": ride.To, "amount": amount})
+}
+
+// generate - ride requests for the interval ending elapsed after the generator started.
+func (g *DemandGenerator) generate(elapsed time.Duration, interval time.Duration) (rides []RideRequest) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	count := poisson(g.rand, g.rateAt(elapsed)*interval.Minutes())
+	for i := 0; i < count; i++ {
+		from := g.config.Origins.Sample(g.rand)
+		to := g.config.Destinations.Sample(g.rand)
+		for try := 0; try < HotspotTries && from.Distance(to) < g.config.MinDistance; try++ {
+			to = g.config.Destinations.Sample(g.rand)
+		}
+		rides = append(rides, RideRequest{From: formatCoords(from), To: formatCoords(to)})
+	}
+	return
+}
+
+// rateAt - requests per minute elapsed after the generator started.
+func (g *DemandGenerator) rateAt(elapsed time.Duration) float64 {
+	var cycle time.Duration
+	for _, period := range g.config.Rates {
+		if period.Duration == 0 {
+			cycle = 0 // The rates end in a period lasting forever, so they are not repeated
+			break
+		}
+		cycle += period.Duration
+	}
+	if cycle > 0 {
+		elapsed %= cycle
+	}
+	for _, period := range g.config.Rates {
+		if period.Duration == 0 || elapsed < period.Duration {
+			return period.PerMinute
+		}
+		elapsed -= period.Duration
+	}
+	return 0
+}
+
+// amount - MoovCoins offered for ride.
+func (g *DemandGenerator) amount(ride RideRequest) uint64 {
+	if g.pricing == nil {
+		return g.config.Amount
+	}
+	quote, err := g.pricing.Quote(ride.From, ride.To)
+	if err != nil {
+		return g.config.Amount
+	}
+	return quote.Fare
+}
+
+// poisson - number of events in an interval expecting mean events, drawn from r.
+func poisson(r *rand.Rand, mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+	if mean > 30 {
+		// Normal approximation, the product below underflows for large means
+		return int(math.Max(0, math.Round(mean+math.Sqrt(mean)*r.NormFloat64())))
+	}
+	limit := math.Exp(-mean)
+	count, product := 0, r.Float64()
+	for product > limit {
+		count++
+		product *= r.Float64()
+	}
+	return count
+}
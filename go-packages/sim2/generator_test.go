@@ -0,0 +1,124 @@
+package sim2
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestParseRates(t *testing.T) {
+	rates, err := ParseRates("10:5m, 60:2m,3")
+	if err != nil {
+		t.Fatalf("Valid rates did not parse: %v \n", err)
+	}
+	expected := []RatePeriod{{10, 5 * time.Minute}, {60, 2 * time.Minute}, {3, 0}}
+	if len(rates) != len(expected) {
+		t.Fatalf("Parsed %d rates, expected %d \n", len(rates), len(expected))
+	}
+	for idx := range expected {
+		if rates[idx] != expected[idx] {
+			t.Errorf("Rate %d parsed as %v, expected %v \n", idx, rates[idx], expected[idx])
+		}
+	}
+	for _, invalid := range []string{"fast", "-1:5m", "10:soon"} {
+		if _, err := ParseRates(invalid); err == nil {
+			t.Errorf("Invalid rates %q parsed \n", invalid)
+		}
+	}
+}
+
+func TestDemandGenerator_RateAt(t *testing.T) {
+	rates, _ := ParseRates("10:5m,60:2m")
+	g := NewDemandGenerator(DemandConfig{Rates: rates}, nil)
+	cases := map[time.Duration]float64{
+		0:                10,
+		4 * time.Minute:  10,
+		6 * time.Minute:  60,
+		8 * time.Minute:  10, // Second cycle
+		13 * time.Minute: 60,
+	}
+	for elapsed, expected := range cases {
+		if rate := g.rateAt(elapsed); rate != expected {
+			t.Errorf("Rate after %v is %v, expected %v \n", elapsed, rate, expected)
+		}
+	}
+
+	rates, _ = ParseRates("10:5m,60")
+	g = NewDemandGenerator(DemandConfig{Rates: rates}, nil)
+	if rate := g.rateAt(time.Hour); rate != 60 {
+		t.Errorf("Rate lasting forever was not kept, got %v \n", rate)
+	}
+}
+
+func TestPoisson_Mean(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, mean := range []float64{0.5, 4, 50} {
+		total := 0
+		for i := 0; i < 10000; i++ {
+			total += poisson(r, mean)
+		}
+		if average := float64(total) / 10000; math.Abs(average-mean) > mean*0.05 {
+			t.Errorf("Poisson draws average %v, expected about %v \n", average, mean)
+		}
+	}
+}
+
+func TestUniformLocations_OnRoads(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	uniform := NewUniformLocations(graph)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		pos := uniform.Sample(r)
+		onRoad := false
+		for _, edge := range uniform.edges {
+			along := edge.Start.Pos.Distance(pos) + pos.Distance(edge.End.Pos)
+			if math.Abs(along-edge.Start.Pos.Distance(edge.End.Pos)) < 1e-6 {
+				onRoad = true
+				break
+			}
+		}
+		if !onRoad {
+			t.Fatalf("Uniform location %v is not on a road \n", pos)
+		}
+	}
+}
+
+func TestHotspotLocations_NearHotspot(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	hotspot := Coords{300, 300}
+	locations := NewHotspotLocations(graph, []Coords{hotspot}, 150, 0)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if pos := locations.Sample(r); pos.Distance(hotspot) > 150 {
+			t.Fatalf("Hotspot location %v is farther than the radius from %v \n", pos, hotspot)
+		}
+	}
+	if _, err := NewLocationDistribution("hotspot", graph, nil, 150); err == nil {
+		t.Errorf("Hotspot distribution without hotspots was created \n")
+	}
+}
+
+func TestDemandGenerator_Generate(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	uniform := NewUniformLocations(graph)
+	g := NewDemandGenerator(DemandConfig{Origins: uniform, Destinations: uniform,
+		Rates: []RatePeriod{{60, 0}}, Amount: 7, MinDistance: 100, Seed: 1}, &mockRequester{})
+	rides := 0
+	for i := 0; i < 60; i++ {
+		for _, ride := range g.generate(time.Duration(i)*time.Second, time.Second) {
+			from, _ := parseCoords(ride.From)
+			to, _ := parseCoords(ride.To)
+			if from.Distance(to) < 100-math.Sqrt2 { // Coordinates are truncated to whole units
+				t.Errorf("Generated ride from %v to %v is shorter than the minimum \n", from, to)
+			}
+			if amount := g.amount(ride); amount != 7 {
+				t.Errorf("Generated ride offers %d, expected the fixed amount \n", amount)
+			}
+			rides++
+		}
+	}
+	if rides < 40 || rides > 80 {
+		t.Errorf("Generated %d rides in a minute at 60 a minute \n", rides)
+	}
+}
@@ -0,0 +1,75 @@
+package sim2
+
+import (
+	"time"
+)
+
+// lanes - Describes roads with several lanes in one direction: where each lane lies beside the edge and
+//   which lane suits a car's next move
+
+// LaneWidth - lateral distance between neighbouring lanes in map units
+const LaneWidth = 8
+
+// LaneChangeInterval - shortest time between two lane changes of one car
+const LaneChangeInterval = time.Second * 2
+
+// TurnLaneDistance - distance before the end of an edge from which cars get into the lane for their turn
+const TurnLaneDistance = 150
+
+// laneCount - the number of lanes of e, at least one.
+func (e *Edge) laneCount() uint {
+	if e.Lanes == 0 {
+		return 1
+	}
+	return e.Lanes
+}
+
+// LaneOffset - lateral offset of lane from the edge, which runs along its rightmost lane 0; further lanes lie
+//   to the left of the direction of travel.
+func (e *Edge) LaneOffset(lane uint) Coords {
+	if lane == 0 || e.Wraps || e.Start.Pos == e.End.Pos {
+		return Coords{0, 0}
+	}
+	heading := e.Start.Pos.UnitVector(e.End.Pos)
+	shift := float64(lane) * LaneWidth
+	return Coords{heading.Y * shift, -heading.X * shift} // Left of heading, as y grows southwards
+}
+
+// clampLane - lane on e closest to lane.
+func (e *Edge) clampLane(lane uint) uint {
+	if lane >= e.laneCount() {
+		return e.laneCount() - 1
+	}
+	return lane
+}
+
+// lanePos - position of the car drawn in its lane.
+func (info CarInfo) lanePos(graph *Digraph) Coords {
+	edge, ok := graph.Edges[info.EdgeId]
+	if !ok {
+		return info.Pos
+	}
+	offset := edge.LaneOffset(info.Lane)
+	return Coords{info.Pos.X + offset.X, info.Pos.Y + offset.Y}
+}
+
+// turnLane - lane of an edge with lanes lanes to turn through an intersection over next from: the leftmost
+//   lane to turn left or make a U-turn, the rightmost to turn right; false when any lane will do.
+func turnLane(next *Edge, lanes uint) (lane uint, ok bool) {
+	if next.movement == nil {
+		return 0, false
+	}
+	switch next.movement.Turn {
+	case Left, UTurn:
+		return lanes - 1, true
+	case Right:
+		return 0, true
+	}
+	return 0, false
+}
+
+// isStoppedInLane - true if the car will not move on soon: broken down or stopped for a rider, not waiting
+//   at a stop line.
+func (info CarInfo) isStoppedInLane(edge *Edge) bool {
+	return info.BrokenDown || (info.State == Waiting && info.Pos != edge.End.Pos)
+}
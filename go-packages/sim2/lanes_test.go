@@ -0,0 +1,90 @@
+package sim2
+
+import (
+	"testing"
+)
+
+func TestDigraph_Lanes(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	arterial := graph.Edges[176] // East along the south of the map
+	if arterial.Lanes != 2 || graph.Edges[0].Lanes != 1 {
+		t.Fatalf("Expected 2 lanes on edge 176 and 1 on edge 0, got %d and %d \n", arterial.Lanes, graph.Edges[0].Lanes)
+	}
+	if offset := arterial.LaneOffset(1); offset != (Coords{0, -LaneWidth}) {
+		t.Errorf("Second eastbound lane offset by %v, expected north of the edge \n", offset)
+	}
+	if offset := arterial.LaneOffset(0); offset != (Coords{0, 0}) {
+		t.Errorf("Rightmost lane offset by %v, expected on the edge \n", offset)
+	}
+	if lane := graph.Edges[0].clampLane(1); lane != 0 {
+		t.Errorf("Lane 1 clamped to %d on a single lane edge \n", lane)
+	}
+	car := CarInfo{Pos: Coords{600, 969}, EdgeId: 176, Lane: 1}
+	if pos := car.lanePos(graph); pos != (Coords{600, 969 - LaneWidth}) {
+		t.Errorf("Car drawn at %v \n", pos)
+	}
+}
+
+func TestCar_Overtake(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.path.edge = *graph.Edges[176]
+	car.path.pos = Coords{600, 969}
+	car.path.routeEdges = []Edge{*graph.Edges[177]}
+
+	ahead := CarInfo{ID: 1, Pos: Coords{650, 969}, EdgeId: 176, State: ToPickUp}
+	car.path.trafficInfo.carStates = []CarInfo{ahead}
+	car.changeLane()
+	if car.path.lane != 0 {
+		t.Errorf("Changed lane behind a moving car \n")
+	}
+
+	ahead.BrokenDown = true
+	beside := CarInfo{ID: 2, Pos: Coords{560, 969}, EdgeId: 176, Lane: 1, State: ToPickUp}
+	car.path.trafficInfo.carStates = []CarInfo{ahead, beside}
+	car.changeLane()
+	if car.path.lane != 0 {
+		t.Errorf("Changed into a lane with a car alongside \n")
+	}
+
+	car.path.trafficInfo.carStates = []CarInfo{ahead}
+	car.changeLane()
+	if car.path.lane != 1 {
+		t.Fatalf("Did not overtake the broken down car \n")
+	}
+	if _, blocked := car.carInLane(car.path.lane); blocked {
+		t.Errorf("Still blocked after changing lane \n")
+	}
+	car.path.lane = 0
+	car.changeLane()
+	if car.path.lane != 0 {
+		t.Errorf("Changed lane again before LaneChangeInterval passed \n")
+	}
+}
+
+func TestCar_TurnLane(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.path.edge = *graph.Edges[146] // North to the stop sign at vertex 96
+	car.path.routeEdges = []Edge{*graph.Edges[120]}
+	car.path.trafficInfo.carStates = nil
+
+	car.path.pos = Coords{82, 800}
+	car.changeLane()
+	if car.path.lane != 0 {
+		t.Errorf("Changed lane for a turn far from the intersection \n")
+	}
+	car.path.pos = Coords{82, 500}
+	car.changeLane()
+	if car.path.lane != 1 {
+		t.Errorf("Did not get into the left lane to turn left \n")
+	}
+
+	car.path.routeEdges = nil
+	car.path.state = ToDropOff
+	car.path.laneChangeAt = car.clock.Now()
+	car.changeLane()
+	if car.path.lane != 0 {
+		t.Errorf("Did not get into the rightmost lane to stop \n")
+	}
+}
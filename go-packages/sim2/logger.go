@@ -0,0 +1,214 @@
+package sim2
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logger - Describes a structured, leveled logger with a level per component and text or JSON output
+
+type LogLevel int
+const (
+	DebugLevel LogLevel = 0
+	InfoLevel  LogLevel = 1
+	WarnLevel  LogLevel = 2
+	ErrorLevel LogLevel = 3
+)
+
+var logLevelNames = map[LogLevel]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+type LogFormat int
+const (
+	TextFormat LogFormat = 0
+	JSONFormat LogFormat = 1
+)
+
+// Field names shared by every component, so entries about one car, edge, rider or transaction can be found together.
+const (
+	CarIDField  = "car_id"
+	EdgeIDField = "edge_id"
+	RiderField  = "rider"
+	TxHashField = "tx_hash"
+)
+
+// Fields - values attached to a log entry by name.
+type Fields map[string]interface{}
+
+// logSink - output and levels shared by a logger and every logger derived from it.
+type logSink struct {
+	mutex        sync.Mutex
+	out          io.Writer
+	format       LogFormat
+	defaultLevel LogLevel
+	levels       map[string]LogLevel // Level of each component that does not use defaultLevel
+}
+
+// Logger - writes entries at or above the level of its component, with its fields attached.
+type Logger struct {
+	sink      *logSink
+	component string
+	fields    Fields
+}
+
+// defaultLogger - logger of components that were not given one.
+var defaultLogger = NewLogger(os.Stderr, TextFormat)
+
+// SetDefaultLogger - Log to logger from components created afterwards without a logger of their own.
+func SetDefaultLogger(logger *Logger) {
+	defaultLogger = logger
+}
+
+// NewLogger - Constructor for a valid Logger writing entries of level info and above to out.
+func NewLogger(out io.Writer, format LogFormat) *Logger {
+	l := new(Logger)
+	l.sink = &logSink{out: out, format: format, defaultLevel: InfoLevel, levels: make(map[string]LogLevel)}
+	l.fields = Fields{}
+	return l
+}
+
+// ParseLogLevel - the level named name, one of debug, info, warn or error.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("unknown log level %q", name)
+}
+
+// SetLevel - Write entries of component at or above level; the empty component sets the default level.
+func (l *Logger) SetLevel(component string, level LogLevel) {
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+	if component == "" {
+		l.sink.defaultLevel = level
+	} else {
+		l.sink.levels[component] = level
+	}
+}
+
+// SetLevels - Set levels from a comma separated list of levels, each optionally prefixed by a component
+//   and "=", as in "warn,car=debug,websrv=info".
+func (l *Logger) SetLevels(list string) error {
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		component, name := "", entry
+		if idx := strings.Index(entry, "="); idx >= 0 {
+			component, name = entry[:idx], entry[idx+1:]
+		}
+		level, err := ParseLogLevel(name)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(component, level)
+	}
+	return nil
+}
+
+// Component - Logger for entries of the named component, sharing this logger's output and levels.
+func (l *Logger) Component(name string) *Logger {
+	return &Logger{sink: l.sink, component: name, fields: l.fields}
+}
+
+// With - Logger attaching fields to every entry, besides this logger's fields.
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for name, value := range l.fields {
+		merged[name] = value
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return &Logger{sink: l.sink, component: l.component, fields: merged}
+}
+
+// Enabled - true if entries of level would be written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+	return level >= l.level()
+}
+
+func (l *Logger) Debug(msg string, fields ...Fields) { l.write(DebugLevel, msg, fields) }
+func (l *Logger) Info(msg string, fields ...Fields)  { l.write(InfoLevel, msg, fields) }
+func (l *Logger) Warn(msg string, fields ...Fields)  { l.write(WarnLevel, msg, fields) }
+func (l *Logger) Error(msg string, fields ...Fields) { l.write(ErrorLevel, msg, fields) }
+
+// Fatal - Write an error entry and exit.
+func (l *Logger) Fatal(msg string, fields ...Fields) {
+	l.write(ErrorLevel, msg, fields)
+	os.Exit(1)
+}
+
+// level - level of the logger's component; caller must hold the sink mutex.
+func (l *Logger) level() LogLevel {
+	if level, ok := l.sink.levels[l.component]; ok {
+		return level
+	}
+	return l.sink.defaultLevel
+}
+
+func (l *Logger) write(level LogLevel, msg string, extra []Fields) {
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+	if level < l.level() {
+		return
+	}
+	fields := make(Fields, len(l.fields))
+	for name, value := range l.fields {
+		fields[name] = value
+	}
+	for _, more := range extra {
+		for name, value := range more {
+			fields[name] = value
+		}
+	}
+	for name, value := range fields {
+		if err, ok := value.(error); ok {
+			fields[name] = err.Error() // Errors would otherwise encode as empty JSON objects
+		}
+	}
+	now := time.Now()
+
+	if l.sink.format == JSONFormat {
+		fields["time"] = now.Format(time.RFC3339Nano)
+		fields["level"] = logLevelNames[level]
+		fields["msg"] = msg
+		if l.component != "" {
+			fields["component"] = l.component
+		}
+		line, err := json.Marshal(fields)
+		if err != nil {
+			line = []byte(fmt.Sprintf(`{"level":"error","msg":"could not encode log entry: %v"}`, err))
+		}
+		l.sink.out.Write(append(line, '\n'))
+		return
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s %-8s %s", now.Format("15:04:05.000"), strings.ToUpper(logLevelNames[level]), l.component, msg)
+	for _, name := range names {
+		fmt.Fprintf(&b, " %s=%v", name, fields[name])
+	}
+	b.WriteString("\n")
+	io.WriteString(l.sink.out, b.String())
+}
@@ -0,0 +1,45 @@
+package sim2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLogger_JSON(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, JSONFormat)
+	carLogger := logger.Component("car").With(Fields{CarIDField: 3})
+	carLogger.Warn("Refused ride", Fields{RiderField: "0xa", "error": errors.New("no route")})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("Log entry is not JSON %v \n", err)
+	}
+	if entry["level"] != "warn" || entry["component"] != "car" || entry["msg"] != "Refused ride" ||
+		entry[CarIDField] != float64(3) || entry[RiderField] != "0xa" || entry["error"] != "no route" {
+		t.Errorf("Log entry does not carry its level, component and fields, got %v \n", entry)
+	}
+}
+
+func TestLogger_SetLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, TextFormat)
+	if err := logger.SetLevels("warn,car=debug"); err != nil {
+		t.Fatalf("Could not set levels %v \n", err)
+	}
+	logger.Component("car").Debug("car debug")
+	logger.Component("websrv").Info("websrv info")
+	logger.Component("websrv").Error("websrv error", Fields{EdgeIDField: 7})
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "car debug") || !strings.HasSuffix(lines[1], "websrv error edge_id=7") {
+		t.Errorf("Expected entries at or above each component's level, got %q \n", out.String())
+	}
+
+	if err := logger.SetLevels("car=loud"); err == nil {
+		t.Errorf("Accepted an unknown log level \n")
+	}
+}
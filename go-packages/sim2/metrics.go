@@ -0,0 +1,295 @@
+package sim2
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics - Describes simulation and chain health metrics, served in the Prometheus text exposition format
+
+// DurationBuckets - upper bounds in seconds of the buckets of duration histograms.
+var DurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+
+// RideTimingExpiry - how long after being assigned or picked up a rider is forgotten, as when their ride was
+//   cancelled, if the car never reports the next step of their ride
+const RideTimingExpiry = time.Hour
+
+type metricKind string
+
+const (
+	counterKind   metricKind = "counter"
+	gaugeKind     metricKind = "gauge"
+	histogramKind metricKind = "histogram"
+)
+
+// family - one named metric, with a series per combination of label values.
+type family struct {
+	name   string
+	help   string
+	kind   metricKind
+	labels []string
+	series map[string]*series // By label values joined with "\xff"
+}
+
+type series struct {
+	labelValues []string
+	value       float64  // Counter or gauge value, histogram sum
+	count       uint64   // Histogram observations
+	buckets     []uint64 // Histogram observations up to each of DurationBuckets
+}
+
+// Metrics - counters, gauges and histograms of the running simulation; a nil Metrics records nothing.
+type Metrics struct {
+	mutex    sync.Mutex
+	families []*family
+
+	frameDuration    *family
+	frameOverruns    *family
+	carsByState      *family
+	ridesByStatus    *family
+	pickUpWait       *family
+	tripDuration     *family
+	intersectionWait *family
+	acceptRequests   *family
+	acceptLatency    *family
+	gethErrors       *family
+	webClients       *family
+
+	assignedAt map[string]time.Time // Riders assigned a car and not yet picked up
+	pickedUpAt map[string]time.Time // Riders picked up and not yet dropped off
+	expiredAt  time.Time            // When riders past RideTimingExpiry were last forgotten
+}
+
+// NewMetrics - Constructor for a valid Metrics object.
+func NewMetrics() *Metrics {
+	m := new(Metrics)
+	m.frameDuration = m.register("moov_world_frame_duration_seconds", "Time the world loop spent on a frame.", histogramKind)
+	m.frameOverruns = m.register("moov_world_frame_overruns_total", "Frames that took longer than the frame period.", counterKind)
+	m.carsByState = m.register("moov_cars", "Cars by path state.", gaugeKind, "state")
+	m.ridesByStatus = m.register("moov_rides_total", "Rides reaching each status.", counterKind, "status")
+	m.pickUpWait = m.register("moov_pickup_wait_seconds", "Time from a car being assigned to a rider to picking them up.", histogramKind)
+	m.tripDuration = m.register("moov_trip_duration_seconds", "Time from picking a rider up to dropping them off.", histogramKind)
+	m.intersectionWait = m.register("moov_intersection_wait_seconds", "Time cars waited at intersections before crossing.", histogramKind, "type")
+	m.acceptRequests = m.register("moov_accept_requests_total", "Ride requests cars tried to accept on the chain.", counterKind, "result")
+	m.acceptLatency = m.register("moov_accept_request_duration_seconds", "Time taken to accept a ride request on the chain.", histogramKind, "result")
+	m.gethErrors = m.register("moov_geth_rpc_errors_total", "Failed calls to geth.", counterKind, "call")
+	m.webClients = m.register("moov_websocket_clients", "Connected websocket clients.", gaugeKind)
+	m.assignedAt = make(map[string]time.Time)
+	m.pickedUpAt = make(map[string]time.Time)
+	return m
+}
+
+func (m *Metrics) register(name string, help string, kind metricKind, labels ...string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*series)}
+	m.families = append(m.families, f)
+	return f
+}
+
+// ObserveFrame - Record the duration of one world frame, an overrun if it exceeded period.
+func (m *Metrics) ObserveFrame(duration time.Duration, period time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.observe(m.frameDuration, duration.Seconds())
+	if duration > period {
+		m.add(m.frameOverruns, 1)
+	}
+}
+
+// ObserveCars - Count cars by path state.
+func (m *Metrics) ObserveCars(cars []CarInfo) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	counts := make(map[PathState]int)
+	for _, car := range cars {
+		counts[car.State]++
+	}
+	for state, name := range pathStateNames {
+		m.set(m.carsByState, float64(counts[state]), name)
+	}
+}
+
+// ObserveRide - Count the ride status and time the rider's wait for pick up and their trip.
+func (m *Metrics) ObserveRide(event RideEvent) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.add(m.ridesByStatus, 1, rideStatusNames[event.Type])
+	m.expireRides(event.Time)
+	switch event.Type {
+	case RideAssigned:
+		m.assignedAt[event.Rider] = event.Time
+	case RidePickedUp:
+		if assignedAt, ok := m.assignedAt[event.Rider]; ok {
+			m.observe(m.pickUpWait, event.Time.Sub(assignedAt).Seconds())
+			delete(m.assignedAt, event.Rider)
+		}
+		m.pickedUpAt[event.Rider] = event.Time
+	case RideDroppedOff:
+		if pickedUpAt, ok := m.pickedUpAt[event.Rider]; ok {
+			m.observe(m.tripDuration, event.Time.Sub(pickedUpAt).Seconds())
+			delete(m.pickedUpAt, event.Rider)
+		}
+	}
+}
+
+// expireRides - Forget the riders assigned or picked up more than RideTimingExpiry before now, checking
+//   once a minute. Caller must hold the mutex.
+func (m *Metrics) expireRides(now time.Time) {
+	if now.Sub(m.expiredAt) < time.Minute {
+		return
+	}
+	m.expiredAt = now
+	for _, times := range []map[string]time.Time{m.assignedAt, m.pickedUpAt} {
+		for rider, at := range times {
+			if now.Sub(at) > RideTimingExpiry {
+				delete(times, rider)
+			}
+		}
+	}
+}
+
+// ObserveIntersectionWait - Record the time a car waited at an intersection of intersectionType.
+func (m *Metrics) ObserveIntersectionWait(intersectionType IntersectionType, wait time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.observe(m.intersectionWait, wait.Seconds(), intersectionTypeNames[intersectionType])
+}
+
+// ObserveAcceptRequest - Record an attempt to accept a ride request taking latency.
+func (m *Metrics) ObserveAcceptRequest(success bool, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "failure"
+	if success {
+		result = "success"
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.add(m.acceptRequests, 1, result)
+	m.observe(m.acceptLatency, latency.Seconds(), result)
+}
+
+// GethError - Count a failed call to geth.
+func (m *Metrics) GethError(call string) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.add(m.gethErrors, 1, call)
+}
+
+// SetWebClients - Record the number of connected websocket clients.
+func (m *Metrics) SetWebClients(clients int) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.set(m.webClients, float64(clients))
+}
+
+// ServeHTTP - Serve every metric in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// WriteTo - Write every metric to out in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(out io.Writer) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var b strings.Builder
+	for _, f := range m.families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != histogramKind {
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatValue(s.value))
+				continue
+			}
+			labels := append(append([]string{}, f.labels...), "le")
+			for idx, bound := range DurationBuckets {
+				values := append(append([]string{}, s.labelValues...), formatValue(bound))
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, formatLabels(labels, values), s.buckets[idx])
+			}
+			values := append(append([]string{}, s.labelValues...), "+Inf")
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, formatLabels(labels, values), s.count)
+			fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues), formatValue(s.value))
+			fmt.Fprintf(&b, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues), s.count)
+		}
+	}
+	n, err := io.WriteString(out, b.String())
+	return int64(n), err
+}
+
+// get - the series of f with labelValues, created if needed; caller must hold the mutex.
+func (m *Metrics) get(f *family, labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if f.kind == histogramKind {
+			s.buckets = make([]uint64, len(DurationBuckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) add(f *family, value float64, labelValues ...string) {
+	m.get(f, labelValues).value += value
+}
+
+func (m *Metrics) set(f *family, value float64, labelValues ...string) {
+	m.get(f, labelValues).value = value
+}
+
+func (m *Metrics) observe(f *family, value float64, labelValues ...string) {
+	s := m.get(f, labelValues)
+	s.value += value
+	s.count++
+	for idx, bound := range DurationBuckets {
+		if value <= bound {
+			s.buckets[idx]++
+		}
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for idx, name := range names {
+		pairs[idx] = name + "=" + strconv.Quote(values[idx])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,61 @@
+package sim2
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.ObserveFrame(time.Millisecond*30, time.Millisecond*40)
+	metrics.ObserveFrame(time.Millisecond*50, time.Millisecond*40)
+	metrics.ObserveCars([]CarInfo{{State: ToPickUp}, {State: ToPickUp}, {State: Waiting}})
+	start := time.Now()
+	metrics.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xa", Time: start})
+	metrics.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xa", Time: start.Add(time.Second * 20)})
+	metrics.ObserveIntersectionWait(StopSign, time.Second*2)
+	metrics.ObserveAcceptRequest(false, time.Second)
+	metrics.GethError("Rides")
+	metrics.SetWebClients(3)
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE moov_world_frame_duration_seconds histogram",
+		"moov_world_frame_duration_seconds_bucket{le=\"0.05\"} 2",
+		"moov_world_frame_duration_seconds_count 2",
+		"moov_world_frame_overruns_total 1",
+		"moov_cars{state=\"ToPickUp\"} 2",
+		"moov_cars{state=\"DrivingAtRandom\"} 0",
+		"moov_rides_total{status=\"PickedUp\"} 1",
+		"moov_pickup_wait_seconds_sum 20",
+		"moov_pickup_wait_seconds_bucket{le=\"10\"} 0",
+		"moov_intersection_wait_seconds_bucket{type=\"StopSign\",le=\"+Inf\"} 1",
+		"moov_accept_requests_total{result=\"failure\"} 1",
+		"moov_geth_rpc_errors_total{call=\"Rides\"} 1",
+		"moov_websocket_clients 3",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Expected metrics to contain %q \n", line)
+		}
+	}
+
+	var disabled *Metrics
+	disabled.ObserveFrame(time.Second, time.Millisecond) // Must not panic
+}
+
+func TestMetrics_ExpireRides(t *testing.T) {
+	metrics := NewMetrics()
+	start := time.Now()
+	metrics.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xa", Time: start})
+	metrics.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xb", Time: start})
+	metrics.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xc", Time: start.Add(RideTimingExpiry)})
+	metrics.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xd", Time: start.Add(RideTimingExpiry + time.Minute)})
+	if len(metrics.assignedAt) != 2 || len(metrics.pickedUpAt) != 0 {
+		t.Errorf("Expected riders never picked up or dropped off to be forgotten, got %v and %v \n", metrics.assignedAt, metrics.pickedUpAt)
+	}
+}
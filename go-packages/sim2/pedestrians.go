@@ -0,0 +1,167 @@
+package sim2
+
+import (
+	"time"
+)
+
+// pedestrians - Describes people walking between points, who cross roads at crosswalks, and riders walking
+//   from where they asked to be picked up to where their car stops
+
+// WalkingSpeed - distance a pedestrian walks in a frame
+const WalkingSpeed = 0.4
+
+// RiderWalkRecheckInterval - how often a car at a pick up looks whether its rider has walked there
+const RiderWalkRecheckInterval = time.Millisecond * 500
+
+// PedestrianInfo - position of a pedestrian and the crosswalk they are on, as shared with the cars.
+type PedestrianInfo struct {
+	ID        uint
+	Pos       Coords
+	Rider     string // Walking to the pick up of their ride, empty for other pedestrians
+	Crossing  bool   // On Crosswalk
+	Crosswalk uint
+	Waiting   bool // At the curb for a chance to cross
+}
+
+// Pedestrian - a person walking from point to point of their route.
+type Pedestrian struct {
+	PedestrianInfo
+	route      []Coords
+	crosswalks []*Crosswalk // Crossed on the way to each point of route, nil off crosswalks
+}
+
+// newPedestrian - a pedestrian walking straight from from to to, over the crosswalks of graph the way runs
+//   across.
+func newPedestrian(id uint, graph *Digraph, from Coords, to Coords, rider string) *Pedestrian {
+	p := &Pedestrian{PedestrianInfo: PedestrianInfo{ID: id, Pos: from, Rider: rider}}
+	used := make(map[*Crosswalk]bool)
+	for pos := from; ; {
+		crosswalk := graph.crosswalkOnWay(pos, to, used)
+		if crosswalk == nil {
+			break
+		}
+		used[crosswalk] = true
+		near, far := crosswalk.orderedEnds(pos)
+		p.route = append(p.route, near, far)
+		p.crosswalks = append(p.crosswalks, nil, crosswalk)
+		pos = far
+	}
+	p.route = append(p.route, to)
+	p.crosswalks = append(p.crosswalks, nil)
+	return p
+}
+
+// AddPedestrian - Have a pedestrian walk from from to to from the next frame; safe to call while the world runs.
+func (w *World) AddPedestrian(from Coords, to Coords) {
+	w.addPedestrian(from, to, "")
+}
+
+// ObserveRide - Have a rider assigned a car walk from where they asked to be picked up to the pick up.
+func (w *World) ObserveRide(event RideEvent) {
+	if event.Type == RideAssigned && event.From != event.Location.intersect {
+		w.addPedestrian(event.From, event.Location.intersect, event.Rider)
+	}
+}
+
+func (w *World) addPedestrian(from Coords, to Coords, rider string) {
+	w.pedestrianMutex.Lock()
+	defer w.pedestrianMutex.Unlock()
+	w.newPedestrians = append(w.newPedestrians, newPedestrian(w.numPedestrians, w.graph, from, to, rider))
+	w.numPedestrians++
+}
+
+// walkPedestrians - Move every pedestrian on by a frame, letting them onto crosswalks when they may cross
+//   and dropping those who arrived, and share where they are with the cars.
+func (w *World) walkPedestrians() {
+	w.pedestrianMutex.Lock()
+	for _, pedestrian := range w.newPedestrians {
+		if pedestrian.Rider == "" || !w.riderWalking(pedestrian.Rider) {
+			w.pedestrians = append(w.pedestrians, pedestrian)
+		}
+	}
+	w.newPedestrians = nil
+	w.pedestrianMutex.Unlock()
+
+	walking := w.pedestrians[:0]
+	infos := make([]PedestrianInfo, 0, len(w.pedestrians))
+	for _, pedestrian := range w.pedestrians {
+		if w.walk(pedestrian) {
+			walking = append(walking, pedestrian)
+			infos = append(infos, pedestrian.PedestrianInfo)
+		}
+	}
+	w.pedestrians = walking
+	w.trafficInfo.pedestrians = infos
+}
+
+// walk - Move pedestrian towards the next point of their route, unless waiting to cross, and true while
+//   they have not arrived.
+func (w *World) walk(pedestrian *Pedestrian) bool {
+	if len(pedestrian.route) == 0 {
+		return false
+	}
+	next, crosswalk := pedestrian.route[0], pedestrian.crosswalks[0]
+	if crosswalk != nil && !pedestrian.Crossing {
+		if !w.mayCross(crosswalk) {
+			pedestrian.Waiting = true
+			return true
+		}
+		pedestrian.Waiting = false
+		pedestrian.Crossing = true
+		pedestrian.Crosswalk = crosswalk.ID
+	}
+	if pedestrian.Pos.Distance(next) > WalkingSpeed {
+		pedestrian.Pos = pedestrian.Pos.ProjectInDirection(WalkingSpeed, next)
+		return true
+	}
+	pedestrian.Pos = next
+	pedestrian.Crossing = false
+	pedestrian.route = pedestrian.route[1:]
+	pedestrian.crosswalks = pedestrian.crosswalks[1:]
+	return len(pedestrian.route) > 0
+}
+
+// mayCross - true if a pedestrian may step onto crosswalk: at a stop light with a walk time only while it
+//   stops the cars for pedestrians, and only once no car in the intersection still has to drive over it.
+func (w *World) mayCross(crosswalk *Crosswalk) bool {
+	intersection := crosswalk.intersection
+	for _, stopLight := range w.trafficInfo.stopLights {
+		if stopLight.ID == intersection.id && stopLight.plan.Walk > 0 && !stopLight.walk {
+			return false
+		}
+	}
+	for _, car := range w.trafficInfo.carStates {
+		edge, ok := w.graph.Edges[car.EdgeId]
+		if !ok || edge.crosses != intersection || car.Pos == edge.End.Pos {
+			continue
+		}
+		ahead := []Coords{car.Pos, edge.End.Pos}
+		if edge.movement != nil && edge.movement.Exit != edge.End {
+			ahead = append(ahead, edge.movement.Exit.Pos)
+		}
+		if crosswalk.crosses(ahead) {
+			return false
+		}
+	}
+	return true
+}
+
+// pedestriansWaitingAt - true if a pedestrian waits to cross at a crosswalk of the intersection with ID id.
+func (w *World) pedestriansWaitingAt(id uint) bool {
+	for _, pedestrian := range w.pedestrians {
+		if pedestrian.Waiting && pedestrian.crosswalks[0].intersection.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// riderWalking - true if rider is still walking to their pick up.
+func (w *World) riderWalking(rider string) bool {
+	for _, pedestrian := range w.pedestrians {
+		if pedestrian.Rider == rider {
+			return true
+		}
+	}
+	return false
+}
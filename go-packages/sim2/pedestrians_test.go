@@ -0,0 +1,117 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDigraph_Crosswalks(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	if len(graph.Crosswalks) != 5 {
+		t.Fatalf("Expected 5 crosswalks, got %d \n", len(graph.Crosswalks))
+	}
+	crosswalk := graph.Crosswalks[0] // South side of the stop light entered at vertex 48
+	if crosswalk.intersection != graph.Vertices[48].intersection {
+		t.Errorf("Crosswalk not attached to the intersection of vertex 48 \n")
+	}
+	if !crosswalk.crosses(graph.Edges[62].movement.path()) || !crosswalk.crosses(graph.Edges[66].movement.path()) {
+		t.Errorf("Movements from and to the south side do not cross the crosswalk \n")
+	}
+	if crosswalk.crosses(graph.Edges[67].movement.path()) {
+		t.Errorf("Movement from east to west crosses the crosswalk on the south side \n")
+	}
+}
+
+func TestWorld_WalkPedestrians(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	world := NewWorld(25, graph)
+	world.AddPedestrian(Coords{670, 440}, Coords{720, 440})
+	world.walkPedestrians()
+	if len(world.pedestrians) != 1 || len(world.pedestrians[0].route) != 3 || world.pedestrians[0].crosswalks[1] != graph.Crosswalks[0] {
+		t.Fatalf("Expected the pedestrian to walk over crosswalk 0 \n")
+	}
+	pedestrian := world.pedestrians[0]
+	for frame := 0; frame < 50; frame++ {
+		world.walkPedestrians()
+	}
+	if pedestrian.Pos != (Coords{683, 440}) || !pedestrian.Waiting || !world.pedestriansWaitingAt(graph.Vertices[48].intersection.id) {
+		t.Fatalf("Expected the pedestrian to wait at the curb for the stop light, at %v \n", pedestrian.Pos)
+	}
+
+	light := &world.trafficInfo.stopLights[0]
+	light.walk = true
+	turning := graph.Edges[66] // Left from the east side to the south side
+	world.trafficInfo.carStates = []CarInfo{{ID: 0, Pos: turning.Start.Pos.ProjectInDirection(5, turning.End.Pos), EdgeId: 66, State: ToPickUp}}
+	world.walkPedestrians()
+	if pedestrian.Crossing {
+		t.Errorf("Stepped in front of a car in the intersection \n")
+	}
+	world.trafficInfo.carStates = nil
+	world.walkPedestrians()
+	if !pedestrian.Crossing || world.trafficInfo.pedestrians[0].Crosswalk != 0 {
+		t.Errorf("Did not cross while the stop light stops the cars \n")
+	}
+	for frame := 0; frame < 200; frame++ {
+		world.walkPedestrians()
+	}
+	if len(world.pedestrians) != 0 || len(world.trafficInfo.pedestrians) != 0 {
+		t.Errorf("Pedestrian did not arrive \n")
+	}
+}
+
+func TestWorld_PedestrianPhase(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	world := NewWorld(25, graph)
+	clock := NewSimClock(time.Now())
+	world.SetClock(clock)
+	pedestrian := newPedestrian(0, graph, Coords{683, 440}, Coords{720, 440}, "")
+	pedestrian.route, pedestrian.crosswalks = pedestrian.route[1:], pedestrian.crosswalks[1:] // At the curb
+	pedestrian.Waiting = true
+	world.pedestrians = []*Pedestrian{pedestrian}
+
+	light := &world.trafficInfo.stopLights[0]
+	light.lightstates[North] = Orange
+	world.updateStopLights()
+	if !light.walk || light.lightstates != [NumberOfDirections]LightState{} {
+		t.Fatalf("Expected every light red for pedestrians after the cycle, got %v \n", light.lightstates)
+	}
+	clock.Advance(DefaultSignalPlan.Walk + time.Millisecond)
+	world.updateStopLights()
+	if light.walk || light.lightstates[West] != Green {
+		t.Errorf("Expected the cycle to start again after the walk time, got %v \n", light.lightstates)
+	}
+
+	world.pedestrians = nil
+	light.lightstates = [NumberOfDirections]LightState{North: Orange}
+	light.alarm = time.Time{}
+	world.updateStopLights()
+	if light.walk || light.lightstates[West] != Green {
+		t.Errorf("Stopped the cars with no pedestrian waiting \n")
+	}
+}
+
+func TestCar_PedestrianCrossing(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	for _, edge := range graph.Edges {
+		if edge.End.ID == 48 {
+			car.path.edge = *edge
+		}
+	}
+	car.path.pos = car.path.edge.End.Pos
+	car.path.routeEdges = []Edge{*graph.Edges[62]}
+
+	car.path.trafficInfo.pedestrians = []PedestrianInfo{{ID: 0, Pos: Coords{690, 440}, Crossing: true, Crosswalk: 0}}
+	if !car.pedestrianCrossing() {
+		t.Errorf("Did not give way to a pedestrian crossing in front \n")
+	}
+	car.path.trafficInfo.pedestrians = []PedestrianInfo{{ID: 0, Pos: Coords{742, 390}, Crossing: true, Crosswalk: 1}}
+	if car.pedestrianCrossing() {
+		t.Errorf("Gave way to a pedestrian crossing another road \n")
+	}
+
+	car.path.trafficInfo.pedestrians = []PedestrianInfo{{ID: 1, Pos: Coords{690, 460}, Rider: "0xa"}}
+	if !car.riderWalking("0xa") || car.riderWalking("0xb") {
+		t.Errorf("Rider walking to the pick up not recognised \n")
+	}
+}
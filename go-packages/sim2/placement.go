@@ -0,0 +1,166 @@
+package sim2
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// placement - Describes where cars start: spread at random, around the depots of the map, or at given positions
+
+// DefaultPlacementSpacing - road distance kept between cars placed at random or around depots
+const DefaultPlacementSpacing = 100
+
+// MaxPlacementOffset - distance from the closest road beyond which a given position is refused
+const MaxPlacementOffset = 50
+
+// FleetPlacement - decides where each car of a fleet starts.
+type FleetPlacement interface {
+	// Place - start positions of cars cars, in car ID order; cars are snapped to the roads when placed.
+	Place(cars uint) ([]Coords, error)
+}
+
+// RandomPlacement - cars on random plain roads, at least spacing apart along the road.
+type RandomPlacement struct {
+	slots   []Coords
+	spacing float64
+	rand    *rand.Rand
+}
+
+// NewRandomPlacement - Constructor for a valid RandomPlacement drawing positions from seed.
+func NewRandomPlacement(graph *Digraph, spacing float64, seed int64) *RandomPlacement {
+	return &RandomPlacement{slots: placementSlots(graph, spacing), spacing: spacing, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (p *RandomPlacement) Place(cars uint) ([]Coords, error) {
+	if int(cars) > len(p.slots) {
+		return nil, fmt.Errorf("the roads fit %d cars spaced %v apart, %d requested", len(p.slots), p.spacing, cars)
+	}
+	positions := make([]Coords, len(p.slots))
+	for idx, swap := range p.rand.Perm(len(p.slots)) {
+		positions[idx] = p.slots[swap]
+	}
+	return positions[:cars], nil
+}
+
+// DepotPlacement - cars shared out over the depots of the map in turn, each on the free spot closest to its depot.
+type DepotPlacement struct {
+	depots  []Depot
+	slots   []Coords
+	spacing float64
+}
+
+// NewDepotPlacement - Constructor for a valid DepotPlacement around the depots of graph.
+func NewDepotPlacement(graph *Digraph, spacing float64) *DepotPlacement {
+	return &DepotPlacement{depots: graph.Depots, slots: placementSlots(graph, spacing), spacing: spacing}
+}
+
+func (p *DepotPlacement) Place(cars uint) ([]Coords, error) {
+	if len(p.depots) == 0 {
+		return nil, errors.New("the map has no depots")
+	}
+	if int(cars) > len(p.slots) {
+		return nil, fmt.Errorf("the roads fit %d cars spaced %v apart, %d requested", len(p.slots), p.spacing, cars)
+	}
+	taken := make([]bool, len(p.slots))
+	positions := make([]Coords, cars)
+	for id := range positions {
+		depot := p.depots[id%len(p.depots)]
+		closest, shortest := 0, math.Inf(1)
+		for idx, slot := range p.slots {
+			if dist := slot.Distance(depot.Pos); !taken[idx] && dist < shortest {
+				closest, shortest = idx, dist
+			}
+		}
+		taken[closest] = true
+		positions[id] = p.slots[closest]
+	}
+	return positions, nil
+}
+
+// ExplicitPlacement - cars at given positions, one per car.
+type ExplicitPlacement struct {
+	graph     *Digraph
+	positions []Coords
+}
+
+// NewExplicitPlacement - Constructor for a valid ExplicitPlacement of cars at positions, in car ID order.
+func NewExplicitPlacement(graph *Digraph, positions []Coords) *ExplicitPlacement {
+	return &ExplicitPlacement{graph: graph, positions: positions}
+}
+
+func (p *ExplicitPlacement) Place(cars uint) ([]Coords, error) {
+	if uint(len(p.positions)) < cars {
+		return nil, fmt.Errorf("positions given for %d cars, %d requested", len(p.positions), cars)
+	}
+	locations := make([]Location, cars)
+	for id := range locations {
+		location, err := placementLocation(p.graph, p.positions[id])
+		if err != nil {
+			return nil, fmt.Errorf("car %d: %v", id, err)
+		}
+		for other := 0; other < id; other++ {
+			if locations[other].edge.ID == location.edge.ID &&
+				locations[other].intersect.Distance(location.intersect) < MinimumStopDistance {
+				return nil, fmt.Errorf("cars %d and %d start closer than %v on edge %d", other, id, MinimumStopDistance, location.edge.ID)
+			}
+		}
+		locations[id] = location
+	}
+	return p.positions[:cars], nil
+}
+
+// NewFleetPlacement - Construct a placement by name: "random", "depots" or "positions"; positions are
+//   only used by, and required for, "positions".
+func NewFleetPlacement(name string, graph *Digraph, spacing float64, positions []Coords, seed int64) (FleetPlacement, error) {
+	if spacing <= 0 {
+		return nil, errors.New("placement spacing must be positive")
+	}
+	switch name {
+	case "random":
+		return NewRandomPlacement(graph, spacing, seed), nil
+	case "depots":
+		if len(graph.Depots) == 0 {
+			return nil, errors.New("depot placement needs a map with depots")
+		}
+		return NewDepotPlacement(graph, spacing), nil
+	case "positions":
+		if len(positions) == 0 {
+			return nil, errors.New("position placement needs at least one position")
+		}
+		return NewExplicitPlacement(graph, positions), nil
+	}
+	return nil, errors.New("unknown placement " + name)
+}
+
+// placementLocation - where a car given pos starts, refusing positions too far from a plain road.
+func placementLocation(graph *Digraph, pos Coords) (Location, error) {
+	location := closestParkingLocation(graph, pos)
+	if location.edge.Start == nil {
+		return location, errors.New("the map has no roads to place cars on")
+	}
+	if offset := location.intersect.Distance(pos); offset > MaxPlacementOffset {
+		return location, fmt.Errorf("position %v is %.0f from the closest road, more than %v", pos, offset, MaxPlacementOffset)
+	}
+	return location, nil
+}
+
+// placementSlots - spots along every plain road, spacing apart and at least half of spacing from
+//   either end so cars on consecutive roads are spacing apart too; in edge ID order.
+func placementSlots(graph *Digraph, spacing float64) (slots []Coords) {
+	if spacing <= 0 {
+		return
+	}
+	for id := uint(0); id < uint(len(graph.Edges)); id++ {
+		edge := graph.Edges[id]
+		if !isParkable(*edge) {
+			continue
+		}
+		length := edge.Start.Pos.Distance(edge.End.Pos)
+		for along := spacing / 2; along <= length-spacing/2; along += spacing {
+			slots = append(slots, edge.Start.Pos.ProjectInDirection(along, edge.End.Pos))
+		}
+	}
+	return
+}
@@ -0,0 +1,103 @@
+package sim2
+
+import (
+	"testing"
+)
+
+func TestDigraph_Depots(t *testing.T) {
+	for _, fname := range []string{"../../maps/4by4.map", "../../maps/final.map"} {
+		graph := GetDigraphFromFile(fname)
+		if len(graph.Depots) < 2 {
+			t.Fatalf("Map %s has %d depots, expected at least 2 \n", fname, len(graph.Depots))
+		}
+		for _, depot := range graph.Depots {
+			if _, err := placementLocation(graph, depot.Pos); err != nil {
+				t.Errorf("Depot %s of map %s is not on a road: %v \n", depot.Name, fname, err)
+			}
+		}
+	}
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	if graph.Depots[0].Name != "northwest" || graph.Depots[0].Pos != (Coords{250, 88}) {
+		t.Errorf("First depot parsed as %v \n", graph.Depots[0])
+	}
+}
+
+func TestRandomPlacement_Spacing(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	placement := NewRandomPlacement(graph, DefaultPlacementSpacing, 1)
+	positions, err := placement.Place(40)
+	if err != nil {
+		t.Fatalf("Failed to place 40 cars on final.map: %v \n", err)
+	}
+	for id, pos := range positions {
+		if _, err := placementLocation(graph, pos); err != nil {
+			t.Errorf("Car %d placed off the roads: %v \n", id, err)
+		}
+		for other := 0; other < id; other++ {
+			if positions[other] == pos {
+				t.Errorf("Cars %d and %d placed at the same position %v \n", other, id, pos)
+			}
+		}
+	}
+	if _, err := placement.Place(uint(len(placement.slots) + 1)); err == nil {
+		t.Errorf("Placed more cars than the roads fit \n")
+	}
+}
+
+func TestDepotPlacement_NearDepots(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	positions, err := NewDepotPlacement(graph, DefaultPlacementSpacing).Place(4)
+	if err != nil {
+		t.Fatalf("Failed to place cars around depots: %v \n", err)
+	}
+	for id, pos := range positions {
+		depot := graph.Depots[id%len(graph.Depots)]
+		if dist := pos.Distance(depot.Pos); dist > 2*DefaultPlacementSpacing {
+			t.Errorf("Car %d placed %v from depot %s \n", id, dist, depot.Name)
+		}
+	}
+
+	graph.Depots = nil
+	if _, err := NewDepotPlacement(graph, DefaultPlacementSpacing).Place(1); err == nil {
+		t.Errorf("Placed cars around depots of a map without depots \n")
+	}
+	if _, err := NewFleetPlacement("depots", graph, DefaultPlacementSpacing, nil, 0); err == nil {
+		t.Errorf("Created depot placement for a map without depots \n")
+	}
+}
+
+func TestExplicitPlacement_Validation(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	valid := []Coords{{250, 88}, {700, 636}}
+	if _, err := NewExplicitPlacement(graph, valid).Place(2); err != nil {
+		t.Errorf("Valid positions refused: %v \n", err)
+	}
+	invalid := map[string][]Coords{
+		"too few positions":   {{250, 88}},
+		"too far from a road": {{250, 88}, {250, 230}},
+		"too close together":  {{250, 88}, {255, 88}},
+	}
+	for name, positions := range invalid {
+		if _, err := NewExplicitPlacement(graph, positions).Place(2); err == nil {
+			t.Errorf("Positions %s accepted \n", name)
+		}
+	}
+	if _, err := NewFleetPlacement("nowhere", graph, DefaultPlacementSpacing, valid, 0); err == nil {
+		t.Errorf("Created unknown placement \n")
+	}
+}
+
+func TestNewCar_LargeIDs(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	for _, id := range []uint{0, 30, 1000} {
+		car := NewCar(id, graph, nil, nil, nil, nil)
+		car.SetRebalancePolicy(NewStayParked(graph))
+		if car.placed || len(car.path.routeEdges) > 0 {
+			t.Errorf("Car %d placed and routed before its loop began \n", id)
+		}
+		car.placeByID()
+		if _, err := placementLocation(graph, car.path.pos); err != nil {
+			t.Errorf("Car %d placed off the roads: %v \n", id, err)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package sim2
+
+import (
+	"math"
+)
+
+// pooling - Describes the scheduled stops of a car and inserting new riders into them
+
+type StopKind int
+const (
+	PickUpStop  StopKind = 0
+	DropOffStop StopKind = 1
+)
+
+// Stop - a scheduled pick up or drop off of one rider.
+type Stop struct {
+	rider    string
+	kind     StopKind
+	location Location
+}
+
+// Rider - a rider accepted by a car and not yet scheduled into its stops.
+type Rider struct {
+	address string
+	from    Coords // Where the rider asked to be picked up
+	pickUp  Location
+	dropOff Location
+	amount  uint64 // MoovCoins the rider escrowed for the ride
+}
+
+// numRiders - number of distinct riders with a stop left, waiting or on board.
+func numRiders(stops []Stop) (count uint) {
+	for _, stop := range stops {
+		if stop.kind == DropOffStop {
+			count++
+		}
+	}
+	return
+}
+
+// stopRiders - distinct riders with a stop left, in the order of their next stop.
+func stopRiders(stops []Stop) (riders []string) {
+	seen := make(map[string]bool)
+	for _, stop := range stops {
+		if !seen[stop.rider] {
+			seen[stop.rider] = true
+			riders = append(riders, stop.rider)
+		}
+	}
+	return
+}
+
+// planInsertion - insert a rider's pick up and drop off where they add the least distance to the stops.
+//   Detour is the distance added beyond the rider's own trip; infinite if the rider cannot be served.
+func planInsertion(graph *Digraph, start Location, stops []Stop, rider Rider) (planned []Stop, detour float64) {
+	pickUp := Stop{rider: rider.address, kind: PickUpStop, location: rider.pickUp}
+	dropOff := Stop{rider: rider.address, kind: DropOffStop, location: rider.dropOff}
+	legs := newLegCache(graph)
+
+	baseDistance := legs.routeDistance(start, stops)
+	detour = math.Inf(1)
+	for i := 0; i <= len(stops); i++ {
+		for j := i; j <= len(stops); j++ {
+			candidate := make([]Stop, 0, len(stops)+2)
+			candidate = append(candidate, stops[:i]...)
+			candidate = append(candidate, pickUp)
+			candidate = append(candidate, stops[i:j]...)
+			candidate = append(candidate, dropOff)
+			candidate = append(candidate, stops[j:]...)
+			if distance := legs.routeDistance(start, candidate) - baseDistance; distance < detour {
+				detour = distance
+				planned = candidate
+			}
+		}
+	}
+	return planned, detour - legs.distance(rider.pickUp, rider.dropOff)
+}
+
+// legCache - memoized route distances between locations while planning one insertion.
+type legCache struct {
+	graph     *Digraph
+	distances map[[2]Location]float64
+}
+
+func newLegCache(graph *Digraph) *legCache {
+	return &legCache{graph: graph, distances: make(map[[2]Location]float64)}
+}
+
+func (l *legCache) distance(from Location, to Location) float64 {
+	key := [2]Location{from, to}
+	if dist, ok := l.distances[key]; ok {
+		return dist
+	}
+	dist := l.graph.routeDistance(from, to)
+	l.distances[key] = dist
+	return dist
+}
+
+// routeDistance - distance from start through every stop in order.
+func (l *legCache) routeDistance(start Location, stops []Stop) (dist float64) {
+	from := start
+	for _, stop := range stops {
+		dist += l.distance(from, stop.location)
+		from = stop.location
+	}
+	return
+}
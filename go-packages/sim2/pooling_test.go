@@ -0,0 +1,43 @@
+package sim2
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPlanInsertion(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	start := graph.closestEdgeAndCoord(Coords{27, 300})
+	first := Rider{address: "first", pickUp: graph.closestEdgeAndCoord(Coords{27, 400}), dropOff: graph.closestEdgeAndCoord(Coords{900, 430})}
+
+	stops, detour := planInsertion(graph, start, nil, first)
+	if len(stops) != 2 || stops[0].kind != PickUpStop || stops[1].kind != DropOffStop {
+		t.Fatalf("Rider into an empty schedule not planned as pick up then drop off, got %v \n", stops)
+	}
+	if math.Abs(detour-graph.routeDistance(start, first.pickUp)) > 0.001 {
+		t.Errorf("Detour of the only rider is not the distance to their pick up, got %f \n", detour)
+	}
+	if numRiders(stops) != 1 {
+		t.Errorf("Expected one rider scheduled, got %d \n", numRiders(stops))
+	}
+
+	// A second rider along the first rider's trip should be picked up on the way
+	second := Rider{address: "second", pickUp: graph.closestEdgeAndCoord(Coords{27, 400}), dropOff: graph.closestEdgeAndCoord(Coords{900, 430})}
+	pooled, detour := planInsertion(graph, start, stops, second)
+	if len(pooled) != 4 || numRiders(pooled) != 2 {
+		t.Fatalf("Second rider not scheduled, got %v \n", pooled)
+	}
+	if detour > 0.001 {
+		t.Errorf("Rider sharing the same trip added a detour of %f \n", detour)
+	}
+	for idx, stop := range pooled {
+		if stop.rider == "second" && stop.kind == DropOffStop {
+			for _, earlier := range pooled[:idx] {
+				if earlier.rider == "second" && earlier.kind == PickUpStop {
+					return
+				}
+			}
+		}
+	}
+	t.Errorf("Second rider dropped off before being picked up \n")
+}
@@ -0,0 +1,102 @@
+package sim2
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pricing - Describes fare quotes for rides based on the routed distance and travel time
+
+// FareRates - configurable rates, in MoovCoins, used to price a ride.
+type FareRates struct {
+	Base        float64 // Flat amount charged for every ride
+	PerDistance float64 // Amount charged per unit of routed distance
+	PerSecond   float64 // Amount charged per second of estimated travel time
+}
+
+// DefaultFareRates - rates used when none are configured.
+var DefaultFareRates = FareRates{Base: 2, PerDistance: 0.01, PerSecond: 0.1}
+
+// FareQuote - price and route estimate for a ride between two points.
+type FareQuote struct {
+	PickUp   Location
+	DropOff  Location
+	Distance float64       // Routed distance from pick up to drop off
+	Duration time.Duration // Estimated travel time from pick up to drop off
+	Surge    float64       // Surge multiplier of the pick up zone applied to the fare
+	Fare     uint64        // Price in MoovCoins, rounded up
+}
+
+// PricingService - computes fare quotes on a world graph.
+type PricingService struct {
+	graph *Digraph
+	fps   float64
+	rates FareRates
+	surge *SurgeMonitor // Nil when surge pricing is disabled
+}
+
+// NewPricingService - Constructor for a valid PricingService object.
+func NewPricingService(graph *Digraph, fps float64, rates FareRates) *PricingService {
+	p := new(PricingService)
+	p.graph = graph
+	p.fps = fps
+	p.rates = rates
+	return p
+}
+
+// ApplySurge - Multiply quoted fares by the surge multiplier of the pick up zone.
+func (p *PricingService) ApplySurge(surge *SurgeMonitor) {
+	p.surge = surge
+}
+
+// Quote - snap the from and to points ("x,y") to the graph and price the route between them.
+func (p *PricingService) Quote(from string, to string) (quote FareQuote, err error) {
+	fromCoords, err := parseCoords(from)
+	if err != nil {
+		return
+	}
+	toCoords, err := parseCoords(to)
+	if err != nil {
+		return
+	}
+	quote.PickUp = p.graph.closestEdgeAndCoord(fromCoords)
+	quote.DropOff = p.graph.closestEdgeAndCoord(toCoords)
+	quote.Distance = p.graph.routeDistance(quote.PickUp, quote.DropOff)
+	if math.IsInf(quote.Distance, 1) {
+		return quote, errors.New("no route between pick up and drop off")
+	}
+	quote.Duration = p.travelTime(quote.Distance)
+	quote.Surge = 1
+	if p.surge != nil {
+		quote.Surge = p.surge.Multiplier(quote.PickUp.intersect)
+	}
+	quote.Fare = p.fare(quote.Distance, quote.Duration, quote.Surge)
+	return
+}
+
+// travelTime - time a car needs to drive a distance at full speed.
+func (p *PricingService) travelTime(distance float64) time.Duration {
+	unitsPerSecond := MovementPerFrame * p.fps
+	return time.Duration(distance / unitsPerSecond * float64(time.Second))
+}
+
+func (p *PricingService) fare(distance float64, duration time.Duration, surge float64) uint64 {
+	fare := p.rates.Base + p.rates.PerDistance*distance + p.rates.PerSecond*duration.Seconds()
+	return uint64(math.Ceil(fare * surge))
+}
+
+// parseCoords - parse an "x,y" location string without aborting on malformed input.
+func parseCoords(location string) (coords Coords, err error) {
+	numbers := strings.Split(location, ",")
+	if len(numbers) != 2 {
+		return coords, errors.New("location " + location + " is not of the form x,y")
+	}
+	if coords.X, err = strconv.ParseFloat(numbers[0], 64); err != nil {
+		return
+	}
+	coords.Y, err = strconv.ParseFloat(numbers[1], 64)
+	return
+}
@@ -0,0 +1,43 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCoords(t *testing.T) {
+	coords, err := parseCoords("12,34")
+	if err != nil || coords != (Coords{12, 34}) {
+		t.Errorf("Did not parse 12,34 into coordinates, got %v %v \n", coords, err)
+	}
+	if _, err := parseCoords("12"); err == nil {
+		t.Errorf("Accepted a location without a y coordinate \n")
+	}
+	if _, err := parseCoords("a,b"); err == nil {
+		t.Errorf("Accepted a location that is not a number \n")
+	}
+}
+
+func TestPricingService_Quote(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	pricing := NewPricingService(graph, 25, FareRates{Base: 1, PerDistance: 0.1, PerSecond: 1})
+
+	quote, err := pricing.Quote("27,300", "900,430")
+	if err != nil {
+		t.Fatalf("Could not quote a ride across the map: %v \n", err)
+	}
+	if quote.Distance <= quote.PickUp.intersect.Distance(quote.DropOff.intersect) {
+		t.Errorf("Routed distance %f is shorter than the straight line \n", quote.Distance)
+	}
+	expectedDuration := time.Duration(quote.Distance / (MovementPerFrame * 25) * float64(time.Second))
+	if quote.Duration != expectedDuration {
+		t.Errorf("Duration %v does not match distance at full speed %v \n", quote.Duration, expectedDuration)
+	}
+	if float64(quote.Fare) < 1+0.1*quote.Distance+quote.Duration.Seconds() {
+		t.Errorf("Fare %d is less than the rates add up to \n", quote.Fare)
+	}
+
+	if _, err := pricing.Quote("27,300", "nowhere"); err == nil {
+		t.Errorf("Quoted a ride to a malformed location \n")
+	}
+}
@@ -0,0 +1,220 @@
+package sim2
+
+import (
+	"encoding/json"
+)
+
+// protocol - Describes the versioned websocket protocol between WebSrv and its clients
+//
+// Every frame sent to a client is an Envelope whose Data has the schema named by Type. A client
+// only receives the broadcast updates it subscribed to, numbered consecutively per connection, so a
+// client that sees a gap knows it missed an update; it catches up by replacing its state with the
+// next Snapshot. Replies to one client carry sequence number 0.
+
+// ProtocolVersion - version of the message schemas below; bumped on any incompatible change.
+const ProtocolVersion = 4
+
+// Envelope - one frame sent to a client.
+type Envelope struct {
+	Version int         `json:"version"`
+	Seq     uint64      `json:"seq"`
+	Type    string      `json:"type"`
+	Data    interface{} `json:"data"`
+}
+
+// ClientEnvelope - one frame received from a client, Data is decoded by Type.
+type ClientEnvelope struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Message - an update or reply for web clients.
+type Message interface {
+	MessageType() string
+}
+
+// offer - Send msg to webChan unless it is full, and true if sent, so that no loop waits on the web
+//   layer falling behind.
+func offer(webChan chan Message, msg Message) bool {
+	select {
+	case webChan <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// HelloMessage - first message to a new client, describing the server.
+type HelloMessage struct {
+	Testing    bool   `json:"testing"`
+	MrmAddress string `json:"mrmAddress,omitempty"` // Ride manager contract address when not testing
+	Nonce      string `json:"nonce"`                // Sign SignInMessage(Nonce) to authenticate
+	Guest      string `json:"guest,omitempty"`      // Anonymous rider address of this connection while testing
+}
+
+// SessionMessage - answer to an AuthenticateRequest.
+type SessionMessage struct {
+	Address string `json:"address,omitempty"`
+	Admin   bool   `json:"admin"`
+	Token   string `json:"token,omitempty"` // Bearer token for the REST API
+	Error   string `json:"error,omitempty"`
+	Nonce   string `json:"nonce,omitempty"` // Fresh nonce to retry with after an error
+}
+
+// ErrorMessage - a client request that was refused.
+type ErrorMessage struct {
+	Request string `json:"request"` // Type of the refused request
+	Error   string `json:"error"`
+}
+
+// SnapshotMessage - full state of the world as of the broadcast update with the envelope's sequence number.
+type SnapshotMessage struct {
+	Cars       []CarMessage       `json:"cars"`
+	StopLights []StopLightMessage `json:"stopLights"`
+	Surge      []SurgeMessage     `json:"surge"`
+	OnTime     *OnTimeMessage     `json:"onTime,omitempty"`
+	Roads      []RoadMessage      `json:"roads"` // Every edge whose road conditions have changed
+}
+
+// CarMessage - position of one car.
+type CarMessage struct {
+	ID          uint    `json:"id"`
+	X           float64 `json:"x"`
+	Y           float64 `json:"y"`
+	Orientation float64 `json:"orientation"` // Degrees
+}
+
+// StopLightMessage - light states of one stop light.
+type StopLightMessage struct {
+	ID    uint       `json:"id"`
+	West  LightState `json:"west"`
+	South LightState `json:"south"`
+	East  LightState `json:"east"`
+	North LightState `json:"north"`
+}
+
+// RideStatusMessage - progress of one rider's ride.
+type RideStatusMessage struct {
+	CarID   *uint  `json:"carId,omitempty"` // Car serving the ride, if one is
+	Address string `json:"address"`
+	State   string `json:"state"`
+}
+
+// SurgeMessage - surge multiplier of one pricing zone.
+type SurgeMessage struct {
+	Zone       int     `json:"zone"`
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+	Size       float64 `json:"size"`
+	Multiplier float64 `json:"multiplier"`
+	Requests   int     `json:"requests"`
+	IdleCars   int     `json:"idleCars"`
+}
+
+// OnTimeMessage - punctuality of the scheduled rides picked up so far.
+type OnTimeMessage struct {
+	PickedUp        uint    `json:"pickedUp"`
+	OnTime          uint    `json:"onTime"`
+	Late            uint    `json:"late"`
+	AverageLateness float64 `json:"averageLateness"` // Seconds, averaged over late pick ups
+}
+
+// RoadMessage - road conditions of one edge, sent when they change.
+type RoadMessage struct {
+	Edge       uint    `json:"edge"`
+	Closed     bool    `json:"closed"`
+	Multiplier float64 `json:"multiplier"` // Of the travel time, 1 for normal traffic
+}
+
+// QuoteMessage - answer to a QuoteRequest.
+type QuoteMessage struct {
+	From     string  `json:"from"`
+	To       string  `json:"to"`
+	Distance float64 `json:"distance"`
+	Duration float64 `json:"duration"` // Estimated travel time in seconds
+	Fare     uint64  `json:"fare"`
+	Surge    float64 `json:"surge"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// QuoteRequest - client request for a fare quote, Type "QuoteRequest".
+type QuoteRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AuthenticateRequest - client request to sign in, Type "Authenticate". Signature is the
+//   personal_sign signature of SignInMessage with the nonce of the connection.
+type AuthenticateRequest struct {
+	Address   string `json:"address"`
+	Signature string `json:"signature"`
+}
+
+// Subscription - client request to receive only these topics, Type "Subscribe". Answered with a Snapshot.
+//   A signed in client always receives the ride statuses of its own rides.
+type Subscription struct {
+	AllCars    bool      `json:"allCars"`
+	Viewport   *Viewport `json:"viewport,omitempty"` // Cars inside this area, with one last update as they leave it
+	CarIDs     []uint    `json:"carIds,omitempty"`
+	StopLights bool      `json:"stopLights"`
+	Surge      bool      `json:"surge"`
+	OnTime     bool      `json:"onTime"`
+	Riders     []string  `json:"riders,omitempty"` // AllRiders for every rider's ride status, admins only
+}
+
+// Viewport - area of the map, in map units.
+type Viewport struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// coversCar - true if the subscription includes car's position updates.
+func (s Subscription) coversCar(car CarMessage) bool {
+	if s.AllCars {
+		return true
+	}
+	for _, id := range s.CarIDs {
+		if id == car.ID {
+			return true
+		}
+	}
+	return s.Viewport != nil && car.X >= s.Viewport.X && car.X <= s.Viewport.X+s.Viewport.Width &&
+		car.Y >= s.Viewport.Y && car.Y <= s.Viewport.Y+s.Viewport.Height
+}
+
+// RideRequestMessage - client request for a ride, Type "RideRequest".
+type RideRequestMessage struct {
+	From       string `json:"from"`
+	To         string `json:"to"`
+	Amount     uint64 `json:"amount"`
+	Count      int    `json:"count,omitempty"`      // Number of identical rides to request, 1 if 0, at most MaxBulkRides
+	PickUpTime int64  `json:"pickUpTime,omitempty"` // Unix seconds of a scheduled pick up, 0 to request now
+	Rider      string `json:"rider,omitempty"`      // Ignored, rides are bound to the signed in address
+}
+
+// RoadConditionRequest - admin request to close or open an edge or slow traffic on it, Type "RoadCondition".
+//   Fields left out keep their current value. Answered with an Error if refused, else broadcast as a Road.
+type RoadConditionRequest struct {
+	Edge       uint     `json:"edge"`
+	Closed     *bool    `json:"closed,omitempty"`
+	Multiplier *float64 `json:"multiplier,omitempty"` // Of the travel time, 1 for normal traffic
+}
+
+func (HelloMessage) MessageType() string      { return "Hello" }
+func (SnapshotMessage) MessageType() string   { return "Snapshot" }
+func (CarMessage) MessageType() string        { return "Car" }
+func (StopLightMessage) MessageType() string  { return "Stoplight" }
+func (RideStatusMessage) MessageType() string { return "RideStatus" }
+func (SurgeMessage) MessageType() string      { return "Surge" }
+func (OnTimeMessage) MessageType() string     { return "OnTime" }
+func (QuoteMessage) MessageType() string      { return "Quote" }
+func (SessionMessage) MessageType() string    { return "Session" }
+func (ErrorMessage) MessageType() string      { return "Error" }
+func (RoadMessage) MessageType() string       { return "Road" }
+
+// envelope - wrap msg for sending with sequence number seq.
+func envelope(msg Message, seq uint64) Envelope {
+	return Envelope{Version: ProtocolVersion, Seq: seq, Type: msg.MessageType(), Data: msg}
+}
@@ -0,0 +1,37 @@
+package sim2
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEnvelope(t *testing.T) {
+	frame, err := json.Marshal(envelope(CarMessage{ID: 2, X: 10.5, Y: 20, Orientation: 90}, 7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"version":4,"seq":7,"type":"Car","data":{"id":2,"x":10.5,"y":20,"orientation":90}}`
+	if string(frame) != expected {
+		t.Errorf("Expected %s, got %s \n", expected, frame)
+	}
+}
+
+func TestWebSrv_Snapshot(t *testing.T) {
+	s := newWebSrv(nil)
+	s.remember(CarMessage{ID: 1, X: 5})
+	s.remember(CarMessage{ID: 0, X: 1})
+	s.remember(CarMessage{ID: 1, X: 6})
+	s.remember(StopLightMessage{ID: 0, West: Green})
+	s.remember(RideStatusMessage{Address: "0xa", State: "Scheduled"})
+
+	snapshot := s.snapshot()
+	if len(snapshot.Cars) != 2 || snapshot.Cars[0].ID != 0 || snapshot.Cars[1].X != 6 {
+		t.Errorf("Snapshot does not hold the latest position of every car, got %+v \n", snapshot.Cars)
+	}
+	if len(snapshot.StopLights) != 1 || snapshot.StopLights[0].West != Green {
+		t.Errorf("Snapshot does not hold the stop light states, got %+v \n", snapshot.StopLights)
+	}
+	if len(snapshot.Surge) != 0 || snapshot.OnTime != nil {
+		t.Errorf("Snapshot holds updates that were never sent \n")
+	}
+}
@@ -0,0 +1,183 @@
+package sim2
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// rebalance - Describes policies for where cars without a ride drive or park
+
+// RebalancePolicy - decides where a car without a ride heads next.
+type RebalancePolicy interface {
+	// IdleDestination - destination for an idle car at pos on edge, and whether it parks there.
+	//   Cars not parking ask again as soon as they reach the destination edge.
+	IdleDestination(pos Coords, edge Edge) (destination Location, park bool)
+}
+
+// RandomCruise - drive to random edges forever.
+type RandomCruise struct {
+	graph *Digraph
+	rand  *rand.Rand
+}
+
+// NewRandomCruise - Constructor for a valid RandomCruise policy.
+func NewRandomCruise(graph *Digraph) *RandomCruise {
+	return &RandomCruise{graph: graph, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (p *RandomCruise) IdleDestination(pos Coords, edge Edge) (destination Location, park bool) {
+	destination.edge = p.graph.getRandomEdge(edge.End.ID, p.rand)
+	destination.intersect = destination.edge.End.Pos
+	return destination, false
+}
+
+// StayParked - pull over on the current road and wait for a ride.
+type StayParked struct {
+	graph *Digraph
+}
+
+// NewStayParked - Constructor for a valid StayParked policy.
+func NewStayParked(graph *Digraph) *StayParked {
+	return &StayParked{graph: graph}
+}
+
+func (p *StayParked) IdleDestination(pos Coords, edge Edge) (destination Location, park bool) {
+	// Park at the middle of the current edge unless already past it
+	if isParkable(edge) && pos.Distance(edge.End.Pos) > edge.Start.Pos.Distance(edge.End.Pos)/2 {
+		return parkingSpot(edge), true
+	}
+	for _, next := range edge.End.AdjEdges {
+		if isParkable(*next) {
+			return parkingSpot(*next), true
+		}
+	}
+	// Nowhere to pull over nearby; keep driving until there is
+	return NewRandomCruise(p.graph).IdleDestination(pos, edge)
+}
+
+// NearestDepot - drive to the depot with the shortest route and park there.
+type NearestDepot struct {
+	graph  *Digraph
+	depots []Location
+}
+
+// NewNearestDepot - Constructor for a valid NearestDepot policy; depots are snapped to the closest road.
+func NewNearestDepot(graph *Digraph, depots []Coords) *NearestDepot {
+	p := &NearestDepot{graph: graph}
+	for _, depot := range depots {
+		p.depots = append(p.depots, closestParkingLocation(graph, depot))
+	}
+	return p
+}
+
+func (p *NearestDepot) IdleDestination(pos Coords, edge Edge) (destination Location, park bool) {
+	shortest := math.Inf(1)
+	for _, depot := range p.depots {
+		dist := p.graph.routeDistance(Location{intersect: pos, edge: edge}, depot)
+		if dist < shortest {
+			shortest = dist
+			destination = depot
+		}
+	}
+	if math.IsInf(shortest, 1) {
+		return NewStayParked(p.graph).IdleDestination(pos, edge)
+	}
+	return destination, true
+}
+
+// DemandSeeking - park in the zone with the most recent ride requests.
+type DemandSeeking struct {
+	graph    *Digraph
+	history  *DemandHistory
+	fallback RebalancePolicy // Used while there is no recent demand
+}
+
+// NewDemandSeeking - Constructor for a valid DemandSeeking policy.
+func NewDemandSeeking(graph *Digraph, history *DemandHistory, fallback RebalancePolicy) *DemandSeeking {
+	return &DemandSeeking{graph: graph, history: history, fallback: fallback}
+}
+
+func (p *DemandSeeking) IdleDestination(pos Coords, edge Edge) (destination Location, park bool) {
+	hotspot, ok := p.history.Hotspot()
+	if !ok {
+		return p.fallback.IdleDestination(pos, edge)
+	}
+	return closestParkingLocation(p.graph, hotspot), true
+}
+
+// isParkable - cars may pull over on plain roads, not inside intersections or on wrap-arounds.
+func isParkable(edge Edge) bool {
+	return !edge.Extends && !edge.Wraps
+}
+
+// parkingSpot - middle of an edge, clear of the intersections at either end.
+func parkingSpot(edge Edge) Location {
+	length := edge.Start.Pos.Distance(edge.End.Pos)
+	return Location{intersect: edge.Start.Pos.ProjectInDirection(length/2, edge.End.Pos), edge: edge}
+}
+
+// closestParkingLocation - closest point to pos on a parkable edge.
+func closestParkingLocation(graph *Digraph, pos Coords) (location Location) {
+	shortestDistance := math.Inf(1)
+	for id := uint(0); id < uint(len(graph.Edges)); id++ {
+		edge := graph.Edges[id]
+		if !isParkable(*edge) {
+			continue
+		}
+		coord, dist := edge.checkIntersect(pos)
+		// Pull over between the ends rather than on an intersection stop line
+		if coord.Equals(edge.Start.Pos) || coord.Equals(edge.End.Pos) {
+			coord = parkingSpot(*edge).intersect
+			dist = coord.Distance(pos)
+		}
+		if dist < shortestDistance {
+			shortestDistance = dist
+			location = Location{intersect: coord, edge: *edge}
+		}
+	}
+	return
+}
+
+// NewRebalancePolicy - Construct a policy by name: "random", "park", "depot" or "demand".
+//   Demand seeking falls back to the nearest depot when depots are given, otherwise to parking.
+func NewRebalancePolicy(name string, graph *Digraph, history *DemandHistory, depots []Coords) (RebalancePolicy, error) {
+	var idle RebalancePolicy = NewStayParked(graph)
+	if len(depots) > 0 {
+		idle = NewNearestDepot(graph, depots)
+	}
+	switch name {
+	case "random":
+		return NewRandomCruise(graph), nil
+	case "park":
+		return NewStayParked(graph), nil
+	case "depot":
+		if len(depots) == 0 {
+			return nil, errors.New("depot rebalancing needs at least one depot")
+		}
+		return idle, nil
+	case "demand":
+		if history == nil {
+			return nil, errors.New("demand rebalancing needs a demand history")
+		}
+		return NewDemandSeeking(graph, history, idle), nil
+	}
+	return nil, errors.New("unknown rebalance policy " + name)
+}
+
+// ParseLocations - parse a list of "x,y" locations separated by ";".
+func ParseLocations(list string) (locations []Coords, err error) {
+	if list == "" {
+		return
+	}
+	for _, location := range strings.Split(list, ";") {
+		coords, err := parseCoords(location)
+		if err != nil {
+			return nil, err
+		}
+		locations = append(locations, coords)
+	}
+	return
+}
@@ -0,0 +1,66 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStayParked_IdleDestination(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	policy := NewStayParked(graph)
+	for _, edge := range graph.Edges {
+		if !isParkable(*edge) {
+			continue
+		}
+		destination, park := policy.IdleDestination(edge.Start.Pos, *edge)
+		if !park {
+			t.Errorf("Stay parked policy did not park \n")
+		}
+		if destination.edge.ID != edge.ID || !destination.intersect.Equals(parkingSpot(*edge).intersect) {
+			t.Errorf("Car at the start of edge %d did not park in the middle of it \n", edge.ID)
+		}
+		break
+	}
+}
+
+func TestNearestDepot_IdleDestination(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	policy := NewNearestDepot(graph, []Coords{{900, 430}, {30, 300}})
+	start := closestParkingLocation(graph, Coords{30, 300})
+	destination, park := policy.IdleDestination(start.edge.Start.Pos, start.edge)
+	if !park {
+		t.Errorf("Depot policy did not park \n")
+	}
+	if destination.intersect != policy.depots[1].intersect {
+		t.Errorf("Car did not head to the depot on its own road, got %v \n", destination.intersect)
+	}
+}
+
+func TestDemandHistory_Hotspot(t *testing.T) {
+	graph := NewDigraph()
+	graph.Vertices[0] = &Vertex{ID: 0, Pos: Coords{0, 0}}
+	graph.Vertices[1] = &Vertex{ID: 1, Pos: Coords{199, 199}}
+	history := NewDemandHistory(graph, nil, 100, time.Minute)
+	if _, ok := history.Hotspot(); ok {
+		t.Errorf("Found a hotspot without any demand \n")
+	}
+
+	now := time.Now()
+	history.observe([]RideRequest{{Rider: "a", From: "10,10"}}, now)
+	history.observe([]RideRequest{{Rider: "a", From: "10,10"}, {Rider: "b", From: "150,150"}, {Rider: "c", From: "160,160"}}, now)
+	if len(history.events) != 3 {
+		t.Errorf("Expected each request recorded once, got %d events \n", len(history.events))
+	}
+	hotspot, ok := history.Hotspot()
+	if !ok || hotspot != (Coords{150, 150}) {
+		t.Errorf("Hotspot is not the center of the zone with two requests, got %v \n", hotspot)
+	}
+	if len(history.OpenRideRequests()) != 3 {
+		t.Errorf("Open ride requests not served from the latest poll \n")
+	}
+
+	history.observe(nil, now.Add(time.Hour))
+	if len(history.events) != 0 {
+		t.Errorf("Old demand was not forgotten \n")
+	}
+}
@@ -0,0 +1,148 @@
+package sim2
+
+import (
+	"sort"
+	"time"
+)
+
+// reservations - Describes autonomous intersections, where cars reserve the time they take on their path
+//   through the intersection from the world and drive through without stopping while their reservation holds
+
+// ReservationDistance - distance before an autonomous intersection from which cars request a reservation
+const ReservationDistance = 150
+
+// ReservationMargin - time kept clear before and after each reservation for cars whose paths conflict
+const ReservationMargin = time.Millisecond * 500
+
+// ReservationRecheckInterval - how often a car waiting at an autonomous intersection looks for its reservation
+const ReservationRecheckInterval = time.Millisecond * 200
+
+// ReservationRequest - a car's request to cross an autonomous intersection over Edge, Distance ahead of it.
+type ReservationRequest struct {
+	Edge     uint
+	Distance float64
+}
+
+// reservation - the time a car holds its path through an autonomous intersection.
+type reservation struct {
+	car          uint
+	intersection *Intersection
+	movement     *Movement // Nil for a car in the intersection without a reservation
+	from, until  time.Time
+	seq          uint64    // Order the reservation was granted in, reservations granted earlier keep theirs
+	promised     time.Time // When the car was to arrive as granted
+	inside       bool      // The car is on its path through the intersection
+}
+
+// reservationManager - the reservations held at every autonomous intersection.
+type reservationManager struct {
+	graph        *Digraph
+	speed        float64              // Of the cars in map units per second
+	reservations map[uint]reservation // By car ID
+	granted      uint64               // Reservations granted so far
+}
+
+func newReservationManager(graph *Digraph, speed float64) *reservationManager {
+	return &reservationManager{graph: graph, speed: speed, reservations: make(map[uint]reservation)}
+}
+
+// update - Move the reservations of the cars to when they will reach and clear their intersection, grant
+//   the requests that conflict with no reservation kept and answer with the IDs of the cars holding one.
+//   Cars inside an intersection keep their reservation; cars held up on the way by more than
+//   ReservationMargin queue again with the new requests and lose theirs when it conflicts.
+func (m *reservationManager) update(cars []CarInfo, now time.Time) map[uint]bool {
+	var wanted []reservation
+	reservations := m.reservations
+	m.reservations = make(map[uint]reservation)
+	for _, car := range cars {
+		previous, held := reservations[car.ID]
+		edge, ok := m.graph.Edges[car.EdgeId]
+		if !ok {
+			continue
+		}
+		if edge.crosses != nil && edge.crosses.intersectionType == Autonomous && car.Pos != edge.End.Pos ||
+			held && previous.inside && edge.crosses == previous.intersection && !previous.through(car.Pos) {
+			movement := edge.movement
+			if movement == nil && held {
+				movement = previous.movement // Past the bend of a curved movement
+			}
+			wanted = append(wanted, reservation{car.ID, edge.crosses, movement, now,
+				now.Add(m.crossingTime(movement, edge, car.Pos)), previous.seq, previous.promised, true})
+			continue
+		}
+		if car.Reservation == nil {
+			continue
+		}
+		request, ok := m.graph.Edges[car.Reservation.Edge]
+		if !ok || request.movement == nil || request.crosses.intersectionType != Autonomous {
+			continue
+		}
+		arrival := now.Add(time.Duration(car.Reservation.Distance / m.speed * float64(time.Second)))
+		want := reservation{car.ID, request.crosses, request.movement, arrival,
+			arrival.Add(m.crossingTime(request.movement, request, request.Start.Pos)), 0, arrival, false}
+		if held && previous.movement == request.movement && !arrival.After(previous.promised.Add(ReservationMargin)) {
+			want.seq, want.promised = previous.seq, previous.promised
+		}
+		wanted = append(wanted, want)
+	}
+
+	// Cars inside first, then the reservations granted earliest, then new requests by when the cars arrive
+	sort.SliceStable(wanted, func(i, j int) bool {
+		a, b := wanted[i], wanted[j]
+		if a.inside != b.inside {
+			return a.inside
+		}
+		if (a.seq == 0) != (b.seq == 0) {
+			return b.seq == 0
+		}
+		if a.seq != b.seq {
+			return a.seq < b.seq
+		}
+		return a.from.Before(b.from)
+	})
+	grants := make(map[uint]bool)
+	for _, want := range wanted {
+		if !want.inside && m.conflicts(want) {
+			continue
+		}
+		if want.seq == 0 {
+			m.granted++
+			want.seq = m.granted
+		}
+		m.reservations[want.car] = want
+		grants[want.car] = true
+	}
+	return grants
+}
+
+// conflicts - true if a reservation kept would overlap want in time on a conflicting path.
+func (m *reservationManager) conflicts(want reservation) bool {
+	for _, kept := range m.reservations {
+		if kept.intersection != want.intersection {
+			continue
+		}
+		overlap := kept.from.Add(-ReservationMargin).Before(want.until) && want.from.Add(-ReservationMargin).Before(kept.until)
+		if overlap && kept.movement.conflictsWith(want.movement) {
+			return true
+		}
+	}
+	return false
+}
+
+// crossingTime - time a car at pos on edge takes to clear the intersection making movement, with
+//   ReservationMargin.
+func (m *reservationManager) crossingTime(movement *Movement, edge *Edge, pos Coords) time.Duration {
+	distance := 0.0
+	if movement != nil {
+		distance = pos.Distance(movement.Exit.Pos)
+		if edge == movement.Edge && edge.End != movement.Exit {
+			distance = pos.Distance(edge.End.Pos) + edge.End.Pos.Distance(movement.Exit.Pos)
+		}
+	}
+	return time.Duration(distance/m.speed*float64(time.Second)) + ReservationMargin
+}
+
+// through - true if a car at pos has made the movement of r and left the intersection.
+func (r reservation) through(pos Coords) bool {
+	return r.movement == nil || pos == r.movement.Exit.Pos
+}
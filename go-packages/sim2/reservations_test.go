@@ -0,0 +1,89 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+// approaching - a car on edge ahead of the autonomous intersection, distance before it, requesting to cross
+//   over the edge with ID next.
+func approaching(graph *Digraph, id uint, edge uint, distance float64, next uint) CarInfo {
+	end := graph.Edges[edge].End.Pos
+	start := graph.Edges[edge].Start.Pos
+	pos := end.ProjectInDirection(distance, start)
+	return CarInfo{ID: id, Pos: pos, EdgeId: edge, State: ToPickUp, Route: []uint{next},
+		Reservation: &ReservationRequest{Edge: next, Distance: distance}}
+}
+
+func TestDigraph_Autonomous(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	intersection := graph.Vertices[96].intersection
+	if intersection == nil || intersection.intersectionType != Autonomous {
+		t.Fatalf("Expected vertex 96 to enter an autonomous intersection \n")
+	}
+	if len(graph.Movements(105)) != 3 {
+		t.Errorf("Expected 3 movements from vertex 105, got %d \n", len(graph.Movements(105)))
+	}
+}
+
+func TestReservationManager_Update(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	manager := newReservationManager(graph, MovementPerFrame*25)
+	now := time.Now()
+	fromSouth := approaching(graph, 0, 146, 100, 121) // Through to the north
+	fromEast := approaching(graph, 1, 115, 100, 126)  // Through to the west, across its path
+	fromNorth := approaching(graph, 2, 0, 100, 131)   // Through to the south, beside it
+
+	grants := manager.update([]CarInfo{fromSouth, fromEast, fromNorth}, now)
+	if !grants[0] || grants[1] || !grants[2] {
+		t.Fatalf("Expected reservations for the paths that do not cross, got %v \n", grants)
+	}
+
+	now = now.Add(2 * time.Second)
+	crossing := CarInfo{ID: 0, Pos: Coords{82, 400}, EdgeId: 121, State: ToPickUp}
+	fromEast = approaching(graph, 1, 115, 0, 126)
+	if grants = manager.update([]CarInfo{crossing, fromEast}, now); !grants[0] || grants[1] {
+		t.Errorf("Expected the car at the intersection to wait for the one crossing, got %v \n", grants)
+	}
+	crossing.Pos = graph.Vertices[101].Pos
+	if grants = manager.update([]CarInfo{crossing, fromEast}, now.Add(time.Second)); grants[0] || !grants[1] {
+		t.Errorf("Expected a reservation once the crossing car left, got %v \n", grants)
+	}
+}
+
+func TestReservationManager_HeldUp(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	manager := newReservationManager(graph, MovementPerFrame*25)
+	now := time.Now()
+	fromSouth := approaching(graph, 0, 146, 100, 121)
+	if grants := manager.update([]CarInfo{fromSouth}, now); !grants[0] {
+		t.Fatalf("First request not granted \n")
+	}
+
+	// Still as far away two seconds later, when it should have reached the intersection
+	now = now.Add(2 * time.Second)
+	fromEast := approaching(graph, 1, 115, 0, 126)
+	if grants := manager.update([]CarInfo{fromSouth, fromEast}, now); grants[0] || !grants[1] {
+		t.Errorf("Expected the car at the intersection to go before the held up one, got %v \n", grants)
+	}
+}
+
+func TestCar_ReservationRequest(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/final.map")
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.path.edge = *graph.Edges[146]
+	car.path.routeEdges = []Edge{*graph.Edges[121]}
+
+	car.path.pos = Coords{82, 800}
+	if request := car.reservationRequest(); request != nil {
+		t.Errorf("Requested a reservation far from the intersection \n")
+	}
+	car.path.pos = Coords{82, 500}
+	if request := car.reservationRequest(); request == nil || request.Edge != 121 || request.Distance != 58 {
+		t.Errorf("Expected a request to cross over edge 121 from 58 away, got %+v \n", request)
+	}
+	car.path.state = Waiting
+	if request := car.reservationRequest(); request != nil {
+		t.Errorf("Requested a reservation while stopped on the way \n")
+	}
+}
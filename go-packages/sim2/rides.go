@@ -0,0 +1,115 @@
+package sim2
+
+import (
+	"sync"
+	"time"
+)
+
+// rides - Describes events in the life of a ride reported by cars
+
+type RideEventType int
+const (
+	RideAssigned   RideEventType = 0
+	RidePickedUp   RideEventType = 1
+	RideDroppedOff RideEventType = 2
+)
+
+// RideEvent - a car assigned, picked up or dropped off a rider.
+type RideEvent struct {
+	Type     RideEventType
+	Rider    string
+	CarID    uint
+	Time     time.Time
+	Location Location // Pick up or drop off location of the rider
+	From     Coords   // Where the rider asked to be picked up, reported when the car is assigned
+	Amount   uint64   // MoovCoins the rider escrowed, reported when the car is assigned
+	Distance float64  // Route distance from pick up to drop off, reported when the car is assigned
+}
+
+// RideObserver - receives ride events from cars; called from the car loop so it must not block.
+type RideObserver interface {
+	ObserveRide(event RideEvent)
+}
+
+// RequestTimes - tells when riders requested their rides.
+type RequestTimes interface {
+	RequestedAt(rider string) (time.Time, bool)
+}
+
+// RideRecord - progress of one ride as reported by the car serving it.
+type RideRecord struct {
+	Rider        string
+	CarID        uint
+	Status       RideEventType // Latest event of the ride
+	PickUp       Coords
+	DropOff      Coords // Known once the rider is dropped off
+	PickUpEdge   uint
+	DropOffEdge  uint      // Known once the rider is dropped off
+	Distance     float64   // Route distance from pick up to drop off
+	Fare         uint64    // MoovCoins the rider escrowed
+	RequestedAt  time.Time // Zero if the request was not seen
+	AssignedAt   time.Time
+	PickedUpAt   time.Time
+	DroppedOffAt time.Time
+}
+
+// RideTracker - records the progress of every ride from the ride events of all cars.
+type RideTracker struct {
+	mutex    sync.Mutex
+	records  []RideRecord
+	current  map[string]int // Index into records of each rider's latest ride
+	requests RequestTimes   // Dates rides by their request, nil to leave request times out
+}
+
+// NewRideTracker - Constructor for a valid RideTracker object.
+func NewRideTracker() *RideTracker {
+	t := new(RideTracker)
+	t.current = make(map[string]int)
+	return t
+}
+
+// SetRequestTimes - Record when each ride was requested from requests, as its car is assigned.
+func (t *RideTracker) SetRequestTimes(requests RequestTimes) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.requests = requests
+}
+
+// ObserveRide - Record event against the rider's ride, starting a new ride when a car is assigned.
+func (t *RideTracker) ObserveRide(event RideEvent) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	idx, ok := t.current[event.Rider]
+	if event.Type == RideAssigned || !ok {
+		t.records = append(t.records, RideRecord{Rider: event.Rider, CarID: event.CarID, PickUp: event.Location.intersect,
+			PickUpEdge: event.Location.edge.ID})
+		idx = len(t.records) - 1
+		t.current[event.Rider] = idx
+	}
+	record := &t.records[idx]
+	record.Status = event.Type
+	switch event.Type {
+	case RideAssigned:
+		record.AssignedAt = event.Time
+		record.Fare = event.Amount
+		record.Distance = event.Distance
+		if t.requests != nil {
+			record.RequestedAt, _ = t.requests.RequestedAt(event.Rider)
+		}
+	case RidePickedUp:
+		record.PickedUpAt = event.Time
+	case RideDroppedOff:
+		record.DropOff = event.Location.intersect
+		record.DropOffEdge = event.Location.edge.ID
+		record.DroppedOffAt = event.Time
+	}
+}
+
+// Rides - every ride recorded so far, oldest first.
+func (t *RideTracker) Rides() []RideRecord {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	records := make([]RideRecord, len(t.records))
+	copy(records, t.records)
+	return records
+}
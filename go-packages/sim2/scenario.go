@@ -0,0 +1,526 @@
+package sim2
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scenario - Describes scripted experiments: a map, a fleet and a timeline of events run headlessly on a
+//   simulated clock, with assertions on how they turned out
+
+// DefaultScenarioFPS - frames per simulated second of scenarios that do not set fps
+const DefaultScenarioFPS = 25
+
+// Scenario event types
+const (
+	RideRequestEvent = "ride"        // Request a ride From To for Amount
+	CloseRoadEvent   = "close_road"  // Close Edge to traffic
+	OpenRoadEvent    = "open_road"   // Reopen Edge
+	SlowRoadEvent    = "slow_road"   // Set the travel time Multiplier of Edge, 1 to restore it
+	SignalPlanEvent  = "signal_plan" // Switch the stop light of Intersection to Green, Orange and Walk
+	BreakdownEvent   = "breakdown"   // Stop Car where it is For a while
+	PedestrianEvent  = "pedestrian"  // Have a pedestrian walk From To
+)
+
+// Scenario assertion types
+const (
+	RidesCompletedWithin = "all_rides_completed_within" // Every requested ride dropped off Within the start
+	RidesCompleted       = "rides_completed"            // AtLeast rides dropped off
+	MaxPickUpWait        = "max_pickup_wait"            // No rider waits longer than AtMost to be picked up
+	MaxStall             = "max_stall"                  // No car outside a breakdown stands still longer than AtMost
+)
+
+// ScenarioDuration - a duration written as in "90s" or "5m".
+type ScenarioDuration time.Duration
+
+// UnmarshalJSON - Parse a duration string.
+func (d *ScenarioDuration) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = ScenarioDuration(duration)
+	return nil
+}
+
+// MarshalJSON - Write the duration as a string.
+func (d ScenarioDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Scenario - a scripted experiment, read from a JSON file.
+type Scenario struct {
+	Name       string              `json:"name"`
+	Map        string              `json:"map"` // Relative to the scenario file
+	FPS        float64             `json:"fps"` // DefaultScenarioFPS if 0
+	Duration   ScenarioDuration    `json:"duration"`
+	Cars       uint                `json:"cars"`
+	Placement  string              `json:"placement"`  // "random" or "depots" to place the fleet, where NewCar puts cars if empty
+	Spacing    float64             `json:"spacing"`    // Of the fleet placement, DefaultPlacementSpacing if 0
+	Seed       int64               `json:"seed"`       // Of random fleet placement, detours, idle destinations and ride offers
+	Placements []CarPlacement      `json:"placements"` // Positions of single cars, overriding the fleet placement
+	Routing    string              `json:"routing"`    // "distance" or "congestion", distance if empty
+	Events     []ScenarioEvent     `json:"events"`
+	Assertions []ScenarioAssertion `json:"assertions"`
+}
+
+// CarPlacement - where a car starts, snapped to the closest road.
+type CarPlacement struct {
+	Car uint   `json:"car"`
+	At  string `json:"at"`
+}
+
+// ScenarioEvent - something happening At a time after the scenario starts; the fields used depend on Type.
+type ScenarioEvent struct {
+	At           ScenarioDuration `json:"at"`
+	Type         string           `json:"type"`
+	From         string           `json:"from,omitempty"`
+	To           string           `json:"to,omitempty"`
+	Amount       uint64           `json:"amount,omitempty"`
+	Edge         uint             `json:"edge,omitempty"`
+	Multiplier   float64          `json:"multiplier,omitempty"`
+	Intersection uint             `json:"intersection,omitempty"`
+	Green        ScenarioDuration `json:"green,omitempty"`
+	Orange       ScenarioDuration `json:"orange,omitempty"`
+	Walk         ScenarioDuration `json:"walk,omitempty"`
+	Car          uint             `json:"car,omitempty"`
+	For          ScenarioDuration `json:"for,omitempty"`
+}
+
+// ScenarioAssertion - a condition the outcome of a scenario must meet; the fields used depend on Type.
+type ScenarioAssertion struct {
+	Type    string           `json:"type"`
+	Within  ScenarioDuration `json:"within,omitempty"`
+	AtLeast int              `json:"at_least,omitempty"`
+	AtMost  ScenarioDuration `json:"at_most,omitempty"`
+}
+
+// LoadScenario - Read and check the scenario in the JSON file path.
+func LoadScenario(path string) (*Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	s := new(Scenario)
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields() // Catch misspelled fields rather than silently ignoring them
+	if err := decoder.Decode(s); err != nil {
+		return nil, err
+	}
+	if s.Name == "" {
+		s.Name = filepath.Base(path)
+	}
+	if s.Map != "" && !filepath.IsAbs(s.Map) {
+		s.Map = filepath.Join(filepath.Dir(path), s.Map)
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// validate - Check the scenario for anything that cannot be run, without loading its map.
+func (s *Scenario) validate() error {
+	if _, err := os.Stat(s.Map); err != nil {
+		return fmt.Errorf("map: %v", err)
+	}
+	if s.Duration <= 0 {
+		return errors.New("duration must be positive")
+	}
+	if s.Cars == 0 {
+		return errors.New("cars must be positive")
+	}
+	switch s.Placement {
+	case "", "random", "depots":
+	default:
+		return fmt.Errorf("unknown placement %q", s.Placement)
+	}
+	switch s.Routing {
+	case "", "distance", "congestion":
+	default:
+		return fmt.Errorf("unknown routing %q", s.Routing)
+	}
+	for _, placement := range s.Placements {
+		if placement.Car >= s.Cars {
+			return fmt.Errorf("placement of car %d: the fleet has %d cars", placement.Car, s.Cars)
+		}
+		if _, err := parseCoords(placement.At); err != nil {
+			return fmt.Errorf("placement of car %d: %v", placement.Car, err)
+		}
+	}
+	for idx, event := range s.Events {
+		if err := event.validate(s.Cars); err != nil {
+			return fmt.Errorf("event %d (%s): %v", idx, event.Type, err)
+		}
+	}
+	for idx, assertion := range s.Assertions {
+		switch assertion.Type {
+		case RidesCompletedWithin, RidesCompleted, MaxPickUpWait, MaxStall:
+		default:
+			return fmt.Errorf("assertion %d: unknown type %q", idx, assertion.Type)
+		}
+	}
+	return nil
+}
+
+func (e ScenarioEvent) validate(cars uint) error {
+	switch e.Type {
+	case RideRequestEvent, PedestrianEvent:
+		if _, err := parseCoords(e.From); err != nil {
+			return err
+		}
+		if _, err := parseCoords(e.To); err != nil {
+			return err
+		}
+	case CloseRoadEvent, OpenRoadEvent:
+	case SlowRoadEvent:
+		if !(e.Multiplier > 0) || math.IsInf(e.Multiplier, 1) {
+			return errors.New("a travel time multiplier must be a positive number")
+		}
+	case SignalPlanEvent:
+		if e.Green <= 0 || e.Orange < 0 || e.Walk < 0 {
+			return errors.New("a signal plan needs a positive green time")
+		}
+	case BreakdownEvent:
+		if e.Car >= cars {
+			return fmt.Errorf("the fleet has %d cars", cars)
+		}
+		if e.For <= 0 {
+			return errors.New("a breakdown must last a positive time")
+		}
+	default:
+		return errors.New("unknown event type")
+	}
+	return nil
+}
+
+// checkMap - Check that the car positions, edges and stop lights the scenario refers to are on graph.
+func (s *Scenario) checkMap(graph *Digraph) error {
+	for _, placement := range s.Placements {
+		pos, _ := parseCoords(placement.At)
+		if _, err := placementLocation(graph, pos); err != nil {
+			return fmt.Errorf("placement of car %d: %v", placement.Car, err)
+		}
+	}
+	for idx, event := range s.Events {
+		switch event.Type {
+		case CloseRoadEvent, OpenRoadEvent, SlowRoadEvent:
+			if _, ok := graph.Edges[event.Edge]; !ok {
+				return fmt.Errorf("event %d (%s): no edge %d on the map", idx, event.Type, event.Edge)
+			}
+		case SignalPlanEvent:
+			if int(event.Intersection) >= len(graph.Intersections) ||
+				graph.Intersections[event.Intersection].intersectionType != StopLight {
+				return fmt.Errorf("event %d (%s): intersection %d is not a stop light", idx, event.Type, event.Intersection)
+			}
+		}
+	}
+	return nil
+}
+
+// ScenarioResult - how a scenario turned out.
+type ScenarioResult struct {
+	Name         string
+	Passed       bool // Every assertion held
+	Outcomes     []AssertionOutcome
+	Requested    int          // Rides requested by the events
+	Rides        []RideRecord // Every ride recorded, oldest first
+	LongestStall time.Duration
+	StalledCar   uint // Car that stood still for LongestStall
+}
+
+// AssertionOutcome - whether an assertion held, and what was measured.
+type AssertionOutcome struct {
+	Assertion ScenarioAssertion
+	Passed    bool
+	Detail    string
+}
+
+// scenarioRun - state of a scenario while it runs.
+type scenarioRun struct {
+	scenario  *Scenario
+	graph     *Digraph
+	world     *World
+	chain     *TestChain
+	cars      []*Car
+	clock     *SimClock
+	start     time.Time
+	requested map[string]time.Time // Rider addresses by when their ride was requested
+	riders    []string             // In request order
+	stillAt   map[uint]stillCar    // Where each car last moved
+	stall     time.Duration
+	stalled   uint
+	loops     sync.WaitGroup // Car loops still running
+	done      chan struct{}  // Closed by stop
+	logger    *Logger
+}
+
+type stillCar struct {
+	pos   Coords
+	since time.Time
+}
+
+// Run - Run the scenario headlessly against a test chain, as fast as the frames can be simulated, and
+//   check its assertions.
+func (s *Scenario) Run() (*ScenarioResult, error) {
+	graph := GetDigraphFromFile(s.Map)
+	if err := s.checkMap(graph); err != nil {
+		return nil, err
+	}
+	var positions []Coords
+	if s.Placement != "" {
+		spacing := s.Spacing
+		if spacing == 0 {
+			spacing = DefaultPlacementSpacing
+		}
+		placement, err := NewFleetPlacement(s.Placement, graph, spacing, nil, s.Seed)
+		if err != nil {
+			return nil, err
+		}
+		if positions, err = placement.Place(s.Cars); err != nil {
+			return nil, err
+		}
+	}
+	fps := s.FPS
+	if fps == 0 {
+		fps = DefaultScenarioFPS
+	}
+	r := new(scenarioRun)
+	r.scenario = s
+	r.graph = graph
+	r.start = time.Now()
+	r.clock = NewSimClock(r.start)
+	r.requested = make(map[string]time.Time)
+	r.stillAt = make(map[uint]stillCar)
+	r.done = make(chan struct{})
+	r.logger = defaultLogger.Component("scenario").With(Fields{"scenario": s.Name})
+
+	r.world = NewWorld(fps, graph)
+	r.world.SetClock(r.clock)
+	if s.Routing != "" {
+		graph.SetRouting(s.Routing, r.world.TravelTimes())
+	}
+	webChan, _ := r.world.RegisterWeb()
+	go func() {
+		for {
+			select {
+			case <-webChan:
+				// Nobody watches a headless run
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	r.chain = NewTestChain()
+	r.chain.SetSeed(s.Seed)
+	rides := NewRideTracker()
+	rides.SetRequestTimes(r)
+	for i := uint(0); i < s.Cars; i++ {
+		id, syncChan, sendChan, _ := r.world.RegisterCar()
+		car := NewCar(id, graph, r.chain.RegisterBlockchainInteractor(), syncChan, sendChan, webChan)
+		car.SetClock(r.clock)
+		car.SetSeed(s.Seed + int64(id))
+		car.AddRideObserver(rides)
+		car.AddRideObserver(r.world)
+		r.cars = append(r.cars, car)
+	}
+	for idx, pos := range positions {
+		r.cars[idx].PlaceAt(pos)
+	}
+	for _, placement := range s.Placements {
+		pos, _ := parseCoords(placement.At)
+		r.cars[placement.Car].PlaceAt(pos)
+	}
+	r.chain.StartTestChain()
+	for _, car := range r.cars {
+		r.loops.Add(1)
+		go func(car *Car) {
+			defer r.loops.Done()
+			car.CarLoop()
+		}(car)
+	}
+	defer r.stop()
+
+	events := make([]ScenarioEvent, len(s.Events))
+	copy(events, s.Events)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At < events[j].At })
+	r.world.startStopLights()
+	period := r.world.FramePeriod()
+	next := 0
+	for elapsed := time.Duration(0); elapsed < time.Duration(s.Duration); elapsed += period {
+		for ; next < len(events) && time.Duration(events[next].At) <= elapsed; next++ {
+			r.apply(events[next])
+		}
+		r.world.step()
+		r.clock.Advance(period)
+		cars, _ := r.world.Snapshot()
+		r.observeStalls(cars)
+	}
+	return r.result(rides.Rides()), nil
+}
+
+// stop - Stop the car loops, the test chain and the web output drain once the run is over.
+func (r *scenarioRun) stop() {
+	r.world.stopCars()
+	r.loops.Wait()
+	r.chain.StopTestChain()
+	close(r.done)
+}
+
+// RequestedAt - when the ride of rider was requested.
+func (r *scenarioRun) RequestedAt(rider string) (time.Time, bool) {
+	at, ok := r.requested[rider]
+	return at, ok
+}
+
+// apply - Make event happen now.
+func (r *scenarioRun) apply(event ScenarioEvent) {
+	fields := Fields{"at": time.Duration(event.At), "type": event.Type}
+	switch event.Type {
+	case RideRequestEvent:
+		rider := r.chain.RequestRide("", event.From, event.To, event.Amount)
+		r.requested[rider] = r.clock.Now()
+		r.riders = append(r.riders, rider)
+		fields[RiderField] = rider
+	case CloseRoadEvent:
+		r.graph.CloseEdge(event.Edge)
+		fields[EdgeIDField] = event.Edge
+	case OpenRoadEvent:
+		r.graph.OpenEdge(event.Edge)
+		fields[EdgeIDField] = event.Edge
+	case SlowRoadEvent:
+		r.graph.SetTravelTimeMultiplier(event.Edge, event.Multiplier)
+		fields[EdgeIDField] = event.Edge
+		fields["multiplier"] = event.Multiplier
+	case SignalPlanEvent:
+		r.world.SetSignalPlan(event.Intersection, SignalPlan{Green: time.Duration(event.Green), Orange: time.Duration(event.Orange),
+			Walk: time.Duration(event.Walk)})
+		fields["intersection"] = event.Intersection
+	case PedestrianEvent:
+		from, _ := parseCoords(event.From)
+		to, _ := parseCoords(event.To)
+		r.world.AddPedestrian(from, to)
+	case BreakdownEvent:
+		if !r.cars[event.Car].BreakDown(time.Duration(event.For)) {
+			r.logger.Warn("Car already has a breakdown starting", Fields{CarIDField: event.Car})
+		}
+		fields[CarIDField] = event.Car
+	}
+	r.logger.Info("Applied event", fields)
+}
+
+// observeStalls - Time how long each car has stood still, leaving out parked and broken down cars.
+func (r *scenarioRun) observeStalls(cars []CarInfo) {
+	now := r.clock.Now()
+	for _, car := range cars {
+		still, ok := r.stillAt[car.ID]
+		if !ok || car.Parked || car.BrokenDown || car.Pos != still.pos {
+			r.stillAt[car.ID] = stillCar{car.Pos, now}
+			continue
+		}
+		if stall := now.Sub(still.since); stall > r.stall {
+			r.stall = stall
+			r.stalled = car.ID
+		}
+	}
+}
+
+// result - Check the assertions against the rides recorded.
+func (r *scenarioRun) result(records []RideRecord) *ScenarioResult {
+	result := &ScenarioResult{Name: r.scenario.Name, Passed: true, Requested: len(r.riders), Rides: records,
+		LongestStall: r.stall, StalledCar: r.stalled}
+	byRider := make(map[string]RideRecord)
+	for _, record := range records {
+		byRider[record.Rider] = record
+	}
+	end := r.clock.Now()
+	for _, assertion := range r.scenario.Assertions {
+		outcome := AssertionOutcome{Assertion: assertion}
+		switch assertion.Type {
+		case RidesCompletedWithin:
+			within := time.Duration(assertion.Within)
+			completed, last := 0, time.Duration(0)
+			for _, rider := range r.riders {
+				record := byRider[rider]
+				if record.DroppedOffAt.IsZero() {
+					continue
+				}
+				completed++
+				if at := record.DroppedOffAt.Sub(r.start); at > last {
+					last = at
+				}
+			}
+			outcome.Passed = completed == len(r.riders) && last <= within
+			outcome.Detail = fmt.Sprintf("%d of %d rides completed, the last after %v", completed, len(r.riders), last)
+		case RidesCompleted:
+			completed := 0
+			for _, record := range records {
+				if record.Status == RideDroppedOff {
+					completed++
+				}
+			}
+			outcome.Passed = completed >= assertion.AtLeast
+			outcome.Detail = fmt.Sprintf("%d rides completed", completed)
+		case MaxPickUpWait:
+			longest, waiting := time.Duration(0), ""
+			for _, rider := range r.riders {
+				pickedUpAt := byRider[rider].PickedUpAt
+				if pickedUpAt.IsZero() {
+					pickedUpAt = end // Still waiting when the scenario ended
+				}
+				if wait := pickedUpAt.Sub(r.requested[rider]); wait > longest {
+					longest, waiting = wait, rider
+				}
+			}
+			outcome.Passed = longest <= time.Duration(assertion.AtMost)
+			outcome.Detail = fmt.Sprintf("longest wait %v by rider %s", longest, waiting)
+		case MaxStall:
+			outcome.Passed = r.stall <= time.Duration(assertion.AtMost)
+			outcome.Detail = fmt.Sprintf("car %d stood still for %v", r.stalled, r.stall)
+		}
+		if !outcome.Passed {
+			result.Passed = false
+		}
+		result.Outcomes = append(result.Outcomes, outcome)
+	}
+	return result
+}
+
+// WriteReport - Write a line per assertion and the verdict of the scenario to out.
+func (result *ScenarioResult) WriteReport(out io.Writer) {
+	fmt.Fprintf(out, "scenario %s\n", result.Name)
+	for _, outcome := range result.Outcomes {
+		verdict := "PASS"
+		if !outcome.Passed {
+			verdict = "FAIL"
+		}
+		limit := ""
+		switch outcome.Assertion.Type {
+		case RidesCompletedWithin:
+			limit = time.Duration(outcome.Assertion.Within).String()
+		case RidesCompleted:
+			limit = fmt.Sprint(outcome.Assertion.AtLeast)
+		case MaxPickUpWait, MaxStall:
+			limit = time.Duration(outcome.Assertion.AtMost).String()
+		}
+		fmt.Fprintf(out, "  %s %s %s: %s\n", verdict, outcome.Assertion.Type, limit, outcome.Detail)
+	}
+	if result.Passed {
+		fmt.Fprintln(out, "PASS")
+	} else {
+		fmt.Fprintln(out, "FAIL")
+	}
+}
@@ -0,0 +1,126 @@
+package sim2
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeScenario(t *testing.T, content string) string {
+	mapPath, _ := filepath.Abs("../../maps/4by4.map")
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	if err := os.WriteFile(path, []byte(strings.Replace(content, "MAP", mapPath, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScenario_Invalid(t *testing.T) {
+	invalid := map[string]string{
+		"unknown field":   `{"map": "MAP", "duration": "1m", "cars": 1, "speed": 2}`,
+		"no duration":     `{"map": "MAP", "cars": 1}`,
+		"placement":       `{"map": "MAP", "duration": "1m", "cars": 1, "placements": [{"car": 1, "at": "10,10"}]}`,
+		"event type":      `{"map": "MAP", "duration": "1m", "cars": 1, "events": [{"at": "1s", "type": "flood"}]}`,
+		"ride location":   `{"map": "MAP", "duration": "1m", "cars": 1, "events": [{"at": "1s", "type": "ride", "from": "north"}]}`,
+		"breakdown car":   `{"map": "MAP", "duration": "1m", "cars": 1, "events": [{"at": "1s", "type": "breakdown", "car": 3, "for": "5s"}]}`,
+		"road multiplier": `{"map": "MAP", "duration": "1m", "cars": 1, "events": [{"at": "1s", "type": "slow_road", "edge": 3}]}`,
+		"assertion type":  `{"map": "MAP", "duration": "1m", "cars": 1, "assertions": [{"type": "no_crashes"}]}`,
+		"duration format": `{"map": "MAP", "duration": "soon", "cars": 1}`,
+	}
+	for name, content := range invalid {
+		if _, err := LoadScenario(writeScenario(t, content)); err == nil {
+			t.Errorf("Scenario with invalid %s loaded \n", name)
+		}
+	}
+	scenario, err := LoadScenario(writeScenario(t, `{"map": "MAP", "duration": "1m", "cars": 1,
+		"events": [{"at": "1s", "type": "close_road", "edge": 1000}]}`))
+	if err != nil {
+		t.Fatalf("Valid scenario did not load: %v \n", err)
+	}
+	if _, err := scenario.Run(); err == nil {
+		t.Errorf("Scenario closing an edge that is not on the map ran \n")
+	}
+}
+
+func TestScenario_Run(t *testing.T) {
+	scenario, err := LoadScenario("../../scenarios/stoplight_crossing.json")
+	if err != nil {
+		t.Fatalf("Could not load scenario: %v \n", err)
+	}
+	result, err := scenario.Run()
+	if err != nil {
+		t.Fatalf("Could not run scenario: %v \n", err)
+	}
+	if !result.Passed || result.Requested != 4 {
+		var report bytes.Buffer
+		result.WriteReport(&report)
+		t.Errorf("Expected the stop light scenario to pass with 4 rides, got \n%s", report.String())
+	}
+}
+
+func TestScenario_RunAll(t *testing.T) {
+	paths, err := filepath.Glob("../../scenarios/*.json")
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("Could not find the scenarios: %v \n", err)
+	}
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			scenario, err := LoadScenario(path)
+			if err != nil {
+				t.Fatalf("Could not load scenario: %v \n", err)
+			}
+			result, err := scenario.Run()
+			if err != nil {
+				t.Fatalf("Could not run scenario: %v \n", err)
+			}
+			if !result.Passed {
+				var report bytes.Buffer
+				result.WriteReport(&report)
+				t.Errorf("Expected the scenario to pass, got \n%s", report.String())
+			}
+		})
+	}
+}
+
+func TestScenario_RunStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+	scenario, err := LoadScenario(writeScenario(t, `{"map": "MAP", "duration": "20s", "cars": 3,
+		"events": [{"at": "0s", "type": "ride", "from": "131,350", "to": "880,520"}]}`))
+	if err != nil {
+		t.Fatalf("Could not load scenario: %v \n", err)
+	}
+	if _, err := scenario.Run(); err != nil {
+		t.Fatalf("Could not run scenario: %v \n", err)
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Run left %d goroutines running \n", after-before)
+	}
+}
+
+func TestScenario_RunFailingAssertion(t *testing.T) {
+	scenario, err := LoadScenario(writeScenario(t, `{"map": "MAP", "duration": "30s", "cars": 1,
+		"events": [{"at": "0s", "type": "ride", "from": "131,350", "to": "880,520"}],
+		"assertions": [{"type": "all_rides_completed_within", "within": "20s"}, {"type": "max_stall", "at_most": "1m"}]}`))
+	if err != nil {
+		t.Fatalf("Could not load scenario: %v \n", err)
+	}
+	result, _ := scenario.Run()
+	if result.Passed || result.Outcomes[0].Passed || !result.Outcomes[1].Passed {
+		t.Errorf("Expected only the ride completion to fail, got %+v \n", result.Outcomes)
+	}
+	var report bytes.Buffer
+	result.WriteReport(&report)
+	if !strings.HasSuffix(report.String(), "FAIL\n") {
+		t.Errorf("Report does not end with the verdict: %q \n", report.String())
+	}
+	if time.Duration(scenario.Duration) != 30*time.Second {
+		t.Errorf("Duration parsed as %v \n", time.Duration(scenario.Duration))
+	}
+}
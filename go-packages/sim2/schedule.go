@@ -0,0 +1,222 @@
+package sim2
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schedule - Describes rides booked for a future pick up time and how punctually they are picked up
+
+// ScheduledRide - a ride booked for a future pick up time.
+type ScheduledRide struct {
+	Rider      string // Rider address; the dispatcher assigns one when empty
+	From       string // Pick up location as "x,y"
+	To         string // Drop off location as "x,y"
+	Amount     uint64
+	PickUpTime time.Time
+}
+
+// RideDispatcher - releases a held ride to the cars and returns the rider address it was released for.
+type RideDispatcher interface {
+	DispatchRide(ride ScheduledRide) (rider string)
+}
+
+// SchedulerConfig - configurable dispatch timing of scheduled rides.
+type SchedulerConfig struct {
+	Lead            time.Duration // Time allowed for a car to find and accept the ride
+	EtaFactor       float64       // Multiplier on the full speed ETA for intersections along the route
+	OnTimeTolerance time.Duration // Pick ups later than this after the pick up time are late
+}
+
+// DefaultSchedulerConfig - scheduler configuration used when none is configured.
+var DefaultSchedulerConfig = SchedulerConfig{Lead: time.Second * 20, EtaFactor: 1.5, OnTimeTolerance: time.Second * 30}
+
+// OnTimePerformance - punctuality of the scheduled rides picked up so far.
+type OnTimePerformance struct {
+	PickedUp      uint
+	OnTime        uint
+	Late          uint
+	TotalLateness time.Duration // Sum of how late the late pick ups were
+}
+
+// RideScheduler - holds scheduled rides until a car has just enough time to reach the pick up.
+type RideScheduler struct {
+	graph       *Digraph
+	fps         float64
+	config      SchedulerConfig
+	dispatcher  RideDispatcher
+	webChan     chan Message
+	mutex       sync.Mutex
+	cars        []CarInfo                // Latest car states observed from World
+	pending     []ScheduledRide          // Held rides, not yet dispatched
+	dispatched  map[string]ScheduledRide // Dispatched rides waiting for pick up, by rider
+	performance OnTimePerformance
+	logger      *Logger
+}
+
+// NewRideScheduler - Constructor for a valid RideScheduler object.
+func NewRideScheduler(graph *Digraph, fps float64, config SchedulerConfig, dispatcher RideDispatcher, webChan chan Message) *RideScheduler {
+	s := new(RideScheduler)
+	s.graph = graph
+	s.fps = fps
+	s.config = config
+	s.dispatcher = dispatcher
+	s.webChan = webChan
+	s.dispatched = make(map[string]ScheduledRide)
+	s.logger = defaultLogger.Component("scheduler")
+	return s
+}
+
+// Schedule - Hold ride until it is time to dispatch a car for it.
+func (s *RideScheduler) Schedule(ride ScheduledRide) error {
+	if !ride.PickUpTime.After(time.Now()) {
+		return errors.New("pick up time is not in the future")
+	}
+	if _, err := parseCoords(ride.From); err != nil {
+		return err
+	}
+	if _, err := parseCoords(ride.To); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.pending = append(s.pending, ride)
+	s.mutex.Unlock()
+	s.logger.Info("Scheduled ride", Fields{RiderField: ride.Rider, "from": ride.From, "to": ride.To, "pick_up_time": ride.PickUpTime.Format(time.Kitchen)})
+	return nil
+}
+
+// ObserveCars - Record the latest car states; called from the World loop so it must not block.
+func (s *RideScheduler) ObserveCars(cars []CarInfo) {
+	s.mutex.Lock()
+	s.cars = cars
+	s.mutex.Unlock()
+}
+
+// ObserveRide - Score the pick up of a dispatched ride against its pick up time.
+func (s *RideScheduler) ObserveRide(event RideEvent) {
+	if event.Type != RidePickedUp {
+		return
+	}
+	s.mutex.Lock()
+	ride, ok := s.dispatched[strings.ToLower(event.Rider)]
+	if !ok {
+		s.mutex.Unlock()
+		return
+	}
+	delete(s.dispatched, strings.ToLower(event.Rider))
+	lateness := event.Time.Sub(ride.PickUpTime)
+	s.performance.PickedUp++
+	if lateness > s.config.OnTimeTolerance {
+		s.performance.Late++
+		s.performance.TotalLateness += lateness
+	} else {
+		s.performance.OnTime++
+	}
+	performance := s.performance
+	s.mutex.Unlock()
+
+	s.logger.Info("Scheduled ride picked up", Fields{RiderField: event.Rider, CarIDField: event.CarID, "lateness": lateness.Round(time.Second).String()})
+	if !offer(s.webChan, performance.message()) {
+		s.logger.Warn("Dropped on-time performance update, web output is not keeping up")
+	}
+}
+
+// Performance - punctuality of the scheduled rides picked up so far.
+func (s *RideScheduler) Performance() OnTimePerformance {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.performance
+}
+
+// LoopScheduler - Begin dispatching held rides, checking every interval.
+func (s *RideScheduler) LoopScheduler(interval time.Duration) {
+	for {
+		for _, ride := range s.dueRides(time.Now()) {
+			rider := s.dispatcher.DispatchRide(ride)
+			ride.Rider = rider
+			s.mutex.Lock()
+			s.dispatched[strings.ToLower(rider)] = ride
+			s.mutex.Unlock()
+			if !offer(s.webChan, RideStatusMessage{Address: rider, State: "Dispatching"}) {
+				s.logger.Warn("Dropped ride status, web output is not keeping up", Fields{RiderField: rider})
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+// dueRides - remove and return the held rides whose pick up is no further away than a car's ETA.
+func (s *RideScheduler) dueRides(now time.Time) (due []ScheduledRide) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var held []ScheduledRide
+	for _, ride := range s.pending {
+		if !now.Before(ride.PickUpTime.Add(-s.eta(ride) - s.config.Lead)) {
+			due = append(due, ride)
+		} else {
+			held = append(held, ride)
+		}
+	}
+	s.pending = held
+	return
+}
+
+// eta - routed time for the closest idle car, or any car if none is idle, to reach the pick up.
+//   Caller must hold the mutex.
+func (s *RideScheduler) eta(ride ScheduledRide) time.Duration {
+	from, _ := parseCoords(ride.From)
+	pickUp := s.graph.closestEdgeAndCoord(from)
+	closestIdle, closest := math.Inf(1), math.Inf(1)
+	for _, car := range s.cars {
+		edge, ok := s.graph.Edges[car.EdgeId]
+		if !ok {
+			continue
+		}
+		dist := s.graph.routeDistance(Location{intersect: car.Pos, edge: *edge}, pickUp)
+		closest = math.Min(closest, dist)
+		if car.isIdle() {
+			closestIdle = math.Min(closestIdle, dist)
+		}
+	}
+	if !math.IsInf(closestIdle, 1) {
+		closest = closestIdle
+	}
+	if math.IsInf(closest, 1) {
+		return 0
+	}
+	unitsPerSecond := MovementPerFrame * s.fps
+	return time.Duration(closest / unitsPerSecond * s.config.EtaFactor * float64(time.Second))
+}
+
+func (p OnTimePerformance) message() OnTimeMessage {
+	averageLateness := time.Duration(0)
+	if p.Late > 0 {
+		averageLateness = p.TotalLateness / time.Duration(p.Late)
+	}
+	return OnTimeMessage{
+		PickedUp:        p.PickedUp,
+		OnTime:          p.OnTime,
+		Late:            p.Late,
+		AverageLateness: averageLateness.Seconds(),
+	}
+}
+
+// RiderDispatcher - dispatches rides by asking the rider's own client to submit them to the contract.
+type RiderDispatcher struct {
+	webChan chan Message
+}
+
+// NewRiderDispatcher - Constructor for a valid RiderDispatcher object.
+func NewRiderDispatcher(webChan chan Message) *RiderDispatcher {
+	return &RiderDispatcher{webChan: webChan}
+}
+
+func (d *RiderDispatcher) DispatchRide(ride ScheduledRide) (rider string) {
+	if !offer(d.webChan, RideStatusMessage{Address: ride.Rider, State: "Request Now"}) {
+		defaultLogger.Component("scheduler").Warn("Dropped ride request to rider, web output is not keeping up", Fields{RiderField: ride.Rider})
+	}
+	return ride.Rider
+}
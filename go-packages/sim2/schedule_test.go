@@ -0,0 +1,75 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRideScheduler_DueRides(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	scheduler := NewRideScheduler(graph, 25, SchedulerConfig{Lead: time.Second * 10, EtaFactor: 1}, nil, nil)
+	pickUp := closestParkingLocation(graph, Coords{30, 300})
+	scheduler.ObserveCars([]CarInfo{{ID: 0, Pos: pickUp.intersect, EdgeId: pickUp.edge.ID, State: DrivingAtRandom}})
+
+	now := time.Now()
+	from := "30,300"
+	scheduler.pending = []ScheduledRide{
+		{Rider: "soon", From: from, To: from, PickUpTime: now.Add(time.Second * 5)},
+		{Rider: "later", From: from, To: from, PickUpTime: now.Add(time.Hour)},
+	}
+	due := scheduler.dueRides(now)
+	if len(due) != 1 || due[0].Rider != "soon" {
+		t.Fatalf("Expected only the ride within the lead time to be due, got %v \n", due)
+	}
+	if len(scheduler.pending) != 1 || scheduler.pending[0].Rider != "later" {
+		t.Errorf("Ride not yet due was not held, got %v \n", scheduler.pending)
+	}
+	if due = scheduler.dueRides(now.Add(time.Hour - time.Second*5)); len(due) != 1 {
+		t.Errorf("Held ride was not released ahead of its pick up time \n")
+	}
+}
+
+func TestRideScheduler_ObserveRide(t *testing.T) {
+	webChan := make(chan Message, 4)
+	scheduler := NewRideScheduler(NewDigraph(), 25, SchedulerConfig{OnTimeTolerance: time.Second * 30}, nil, webChan)
+	pickUpTime := time.Now()
+	scheduler.dispatched["0xa"] = ScheduledRide{Rider: "0xA", PickUpTime: pickUpTime}
+	scheduler.dispatched["0xb"] = ScheduledRide{Rider: "0xB", PickUpTime: pickUpTime}
+
+	scheduler.ObserveRide(RideEvent{Type: RideAssigned, Rider: "0xA", Time: pickUpTime.Add(time.Minute)})
+	scheduler.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xA", Time: pickUpTime.Add(time.Second * 10)})
+	scheduler.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xB", Time: pickUpTime.Add(time.Minute)})
+	scheduler.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xC", Time: pickUpTime})
+
+	performance := scheduler.Performance()
+	if performance.PickedUp != 2 || performance.OnTime != 1 || performance.Late != 1 {
+		t.Errorf("Pick ups not scored against their pick up time, got %+v \n", performance)
+	}
+	if performance.TotalLateness != time.Minute {
+		t.Errorf("Expected a minute of lateness, got %v \n", performance.TotalLateness)
+	}
+	if len(webChan) != 2 {
+		t.Errorf("Expected a report published per scored pick up, got %d \n", len(webChan))
+	}
+}
+
+func TestRideScheduler_ObserveRideFullWeb(t *testing.T) {
+	webChan := make(chan Message, 1)
+	webChan <- RideStatusMessage{}
+	scheduler := NewRideScheduler(NewDigraph(), 25, SchedulerConfig{}, nil, webChan)
+	scheduler.dispatched["0xa"] = ScheduledRide{Rider: "0xA", PickUpTime: time.Now()}
+
+	done := make(chan bool)
+	go func() {
+		scheduler.ObserveRide(RideEvent{Type: RidePickedUp, Rider: "0xA", Time: time.Now()})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Scoring a pick up waited on the web output \n")
+	}
+	if scheduler.Performance().PickedUp != 1 {
+		t.Errorf("Pick up not scored while the web output was full \n")
+	}
+}
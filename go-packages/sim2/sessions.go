@@ -0,0 +1,147 @@
+package sim2
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// sessions - Describes rider sessions authenticated by signing a server nonce with an Ethereum key
+
+type Role int
+const (
+	RiderRole Role = 0
+	AdminRole Role = 1 // May also control the simulation
+)
+
+// Session - an authenticated rider address.
+type Session struct {
+	Address string // Lower case hex address
+	Role    Role
+	Token   string // Bearer token for the REST API
+	Guest   bool   // Anonymous test chain rider, not backed by a key
+}
+
+// Sessions - issues nonces, verifies their signatures and keeps the sessions they open.
+type Sessions struct {
+	mutex   sync.Mutex
+	admins  map[string]bool     // Lower case hex addresses with the admin role
+	byToken map[string]*Session
+}
+
+// NewSessions - Constructor for a valid Sessions object granting admins the admin role.
+func NewSessions(admins []string) *Sessions {
+	s := new(Sessions)
+	s.admins = make(map[string]bool)
+	for _, admin := range admins {
+		s.admins[strings.ToLower(admin)] = true
+	}
+	s.byToken = make(map[string]*Session)
+	return s
+}
+
+// ParseAddresses - Parse comma separated hex addresses, as given on the command line.
+func ParseAddresses(list string) (addresses []string, err error) {
+	for _, address := range strings.Split(list, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if !common.IsHexAddress(address) {
+			return nil, fmt.Errorf("%q is not a hex address", address)
+		}
+		addresses = append(addresses, strings.ToLower(address))
+	}
+	return
+}
+
+// NewNonce - Random nonce for one sign in attempt.
+func (s *Sessions) NewNonce() string {
+	return randomHex(32)
+}
+
+// SignInMessage - text a rider signs with personal_sign to prove they hold the key of their address.
+func SignInMessage(nonce string) string {
+	return "Sign in to the Moov simulator with nonce " + nonce
+}
+
+// Authenticate - Open a session for address if signature is its personal_sign signature of SignInMessage(nonce).
+func (s *Sessions) Authenticate(nonce string, address string, signature string) (Session, error) {
+	if !common.IsHexAddress(address) {
+		return Session{}, errors.New("invalid address")
+	}
+	signer, err := recoverSigner(SignInMessage(nonce), signature)
+	if err != nil {
+		return Session{}, err
+	}
+	if signer != common.HexToAddress(address) {
+		return Session{}, errors.New("signature does not match address")
+	}
+	return s.open(strings.ToLower(signer.Hex()), false), nil
+}
+
+// Guest - Open a session for an anonymous test chain rider with a random address.
+func (s *Sessions) Guest() Session {
+	return s.open("0x"+randomHex(20), true)
+}
+
+// Lookup - the session of token.
+func (s *Sessions) Lookup(token string) (Session, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.byToken[token]
+	if !ok {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// End - Close the session of token.
+func (s *Sessions) End(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.byToken, token)
+}
+
+func (s *Sessions) open(address string, guest bool) Session {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session := &Session{Address: address, Role: RiderRole, Token: randomHex(32), Guest: guest}
+	if s.admins[address] && !guest {
+		session.Role = AdminRole
+	}
+	s.byToken[session.Token] = session
+	return *session
+}
+
+// recoverSigner - address whose key made signature, an Ethereum personal_sign signature of message.
+func recoverSigner(message string, signature string) (common.Address, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil || len(sig) != 65 {
+		return common.Address{}, errors.New("invalid signature")
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27 // Wallets add 27 to the recovery ID
+	}
+	hash := crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return common.Address{}, err
+	}
+	return crypto.PubkeyToAddress(*pub), nil
+}
+
+func randomHex(numBytes int) string {
+	b := make([]byte, numBytes)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,78 @@
+package sim2
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// personalSign - sign message the way a wallet's personal_sign does
+func personalSign(t *testing.T, message string) (address string, signature string) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("Could not generate key %v \n", err)
+	}
+	hash := crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+	sig, err := crypto.Sign(hash, key)
+	if err != nil {
+		t.Fatalf("Could not sign %v \n", err)
+	}
+	sig[64] += 27
+	return crypto.PubkeyToAddress(key.PublicKey).Hex(), hexutil.Encode(sig)
+}
+
+func TestSessions_Authenticate(t *testing.T) {
+	sessions := NewSessions(nil)
+	nonce := sessions.NewNonce()
+	address, signature := personalSign(t, SignInMessage(nonce))
+
+	session, err := sessions.Authenticate(nonce, address, signature)
+	if err != nil {
+		t.Fatalf("Could not authenticate a valid signature %v \n", err)
+	}
+	if session.Address != strings.ToLower(address) || session.Role != RiderRole || session.Guest {
+		t.Errorf("Session does not match the signer, got %+v \n", session)
+	}
+	if found, ok := sessions.Lookup(session.Token); !ok || found.Address != session.Address {
+		t.Errorf("Session not found by its token \n")
+	}
+	sessions.End(session.Token)
+	if _, ok := sessions.Lookup(session.Token); ok {
+		t.Errorf("Ended session still found by its token \n")
+	}
+
+	if _, err := sessions.Authenticate(sessions.NewNonce(), address, signature); err == nil {
+		t.Errorf("Authenticated a signature of another nonce \n")
+	}
+	other, _ := personalSign(t, SignInMessage(nonce))
+	if _, err := sessions.Authenticate(nonce, other, signature); err == nil {
+		t.Errorf("Authenticated a signature by another address \n")
+	}
+	if _, err := sessions.Authenticate(nonce, address, "0x1234"); err == nil {
+		t.Errorf("Authenticated a malformed signature \n")
+	}
+}
+
+func TestSessions_Admins(t *testing.T) {
+	nonce := "0"
+	address, signature := personalSign(t, SignInMessage(nonce))
+	admins, err := ParseAddresses(" " + address + ",")
+	if err != nil || len(admins) != 1 {
+		t.Fatalf("Could not parse admin addresses %v \n", err)
+	}
+	if _, err := ParseAddresses("0xnotanaddress"); err == nil {
+		t.Errorf("Parsed an invalid address \n")
+	}
+
+	sessions := NewSessions(admins)
+	session, err := sessions.Authenticate(nonce, address, signature)
+	if err != nil || session.Role != AdminRole {
+		t.Errorf("Admin address not granted the admin role \n")
+	}
+	if guest := sessions.Guest(); guest.Role != RiderRole || !guest.Guest || len(guest.Address) != 42 {
+		t.Errorf("Guest session is not an anonymous rider, got %+v \n", guest)
+	}
+}
@@ -0,0 +1,156 @@
+package sim2
+
+import (
+	"sort"
+	"time"
+)
+
+// stopsigns - Describes right of way at all-way stop intersections, granted by the world first come first
+//   served, with the car on the right first among cars arriving together, and to several cars at once
+//   where their movements do not conflict
+
+// stopSignArrival - a car stopped at the stop line of an entry, wanting to make movement.
+type stopSignArrival struct {
+	car          uint
+	intersection *Intersection
+	from         Direction
+	movement     *Movement // Nil if the car has no route through the intersection
+	arrivedAt    time.Time
+}
+
+// stopSignManager - cars waiting at each stop sign intersection and the cars granted right of way.
+type stopSignManager struct {
+	graph    *Digraph
+	waiting  map[uint][]stopSignArrival // By intersection ID, in order of right of way
+	crossing map[uint]stopSignArrival   // Granted right of way and not yet through, by car ID
+}
+
+func newStopSignManager(graph *Digraph) *stopSignManager {
+	return &stopSignManager{graph: graph, waiting: make(map[uint][]stopSignArrival), crossing: make(map[uint]stopSignArrival)}
+}
+
+// update - Note the cars arriving at, waiting at and crossing stop sign intersections and answer with the
+//   IDs of the cars that have right of way.
+func (m *stopSignManager) update(cars []CarInfo, now time.Time) map[uint]bool {
+	waiting := make(map[uint]bool)
+	for _, car := range cars {
+		edge, ok := m.graph.Edges[car.EdgeId]
+		if !ok {
+			delete(m.crossing, car.ID)
+			continue
+		}
+		arrival, granted := m.crossing[car.ID]
+		atStopLine := car.Pos == edge.End.Pos && !car.Parked && edge.End.intersection != nil &&
+			edge.End.intersection.intersectionType == StopSign
+		var movement *Movement
+		if atStopLine {
+			movement = stopSignMovement(edge.End, car.Route)
+		}
+		if granted {
+			stillCrossing := (atStopLine && movement == arrival.movement) ||
+				(edge.crosses == arrival.intersection && !atStopLine && !arrival.through(car.Pos))
+			if stillCrossing {
+				continue
+			}
+			delete(m.crossing, car.ID)
+			if !atStopLine || edge.End.intersection != arrival.intersection {
+				continue
+			}
+			// Rerouted before crossing; wait again in the same place in the queue
+			m.enqueue(stopSignArrival{car.ID, arrival.intersection, arrival.from, movement, arrival.arrivedAt})
+			waiting[car.ID] = true
+			continue
+		}
+		if atStopLine {
+			intersection := edge.End.intersection
+			m.enqueue(stopSignArrival{car.ID, intersection, edge.End.directionFromIntersection, movement, now})
+			waiting[car.ID] = true
+		}
+	}
+
+	grants := make(map[uint]bool)
+	for id, queue := range m.waiting {
+		var left []stopSignArrival
+		var taken []*Movement // Movements of the cars crossing and of the cars first in line
+		for _, arrival := range m.crossing {
+			if arrival.intersection.id == id {
+				taken = append(taken, arrival.movement)
+			}
+		}
+		for _, arrival := range queue {
+			if !waiting[arrival.car] {
+				continue // Left the stop line
+			}
+			conflicts := false
+			for _, movement := range taken {
+				conflicts = conflicts || arrival.movement.conflictsWith(movement)
+			}
+			taken = append(taken, arrival.movement)
+			if conflicts {
+				left = append(left, arrival)
+			} else {
+				m.crossing[arrival.car] = arrival
+			}
+		}
+		m.waiting[id] = left
+	}
+	for car := range m.crossing {
+		grants[car] = true
+	}
+	return grants
+}
+
+// enqueue - Add arrival to the queue of its intersection unless its car waits there already, keeping the
+//   queue in order of arrival with the car on the right first among cars arriving together.
+func (m *stopSignManager) enqueue(arrival stopSignArrival) {
+	queue := m.waiting[arrival.intersection.id]
+	for idx := range queue {
+		if queue[idx].car == arrival.car {
+			queue[idx].movement = arrival.movement
+			return
+		}
+	}
+	queue = append(queue, arrival)
+	sort.SliceStable(queue, func(i, j int) bool {
+		if !queue[i].arrivedAt.Equal(queue[j].arrivedAt) {
+			return queue[i].arrivedAt.Before(queue[j].arrivedAt)
+		}
+		return onTheRight(queue[i], queue, j)
+	})
+	m.waiting[arrival.intersection.id] = queue
+}
+
+// onTheRight - true if arrival goes before queue[j], having arrived at the same time: it comes from the entry
+//   to the right of that car, or no car arrived then on its own right and its entry comes first.
+func onTheRight(arrival stopSignArrival, queue []stopSignArrival, j int) bool {
+	if (queue[j].from+1)%NumberOfDirections == arrival.from {
+		return true
+	}
+	if (arrival.from+1)%NumberOfDirections == queue[j].from {
+		return false
+	}
+	for _, other := range queue {
+		if other.arrivedAt.Equal(arrival.arrivedAt) && (arrival.from+1)%NumberOfDirections == other.from {
+			return false // Gives way to the car on its own right
+		}
+	}
+	return arrival.from < queue[j].from
+}
+
+// through - true if a car at pos has made the movement of arrival and left the intersection.
+func (arrival stopSignArrival) through(pos Coords) bool {
+	return arrival.movement == nil || pos == arrival.movement.Exit.Pos
+}
+
+// stopSignMovement - movement through the intersection entered at vertex of a car whose route is route.
+func stopSignMovement(vertex *Vertex, route []uint) *Movement {
+	if len(route) == 0 {
+		return nil
+	}
+	for _, movement := range vertex.intersection.entries[vertex.directionFromIntersection].movements {
+		if movement.Edge.ID == route[0] {
+			return movement
+		}
+	}
+	return nil
+}
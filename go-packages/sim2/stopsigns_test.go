@@ -0,0 +1,84 @@
+package sim2
+
+import (
+	"testing"
+	"time"
+)
+
+// atStopLine - a car waiting at vertex, the stop sign entry with ID vertex, to drive route next.
+func atStopLine(t *testing.T, graph *Digraph, id uint, vertex uint, route ...uint) CarInfo {
+	for _, edge := range graph.Edges {
+		if edge.End.ID == vertex {
+			return CarInfo{ID: id, Pos: edge.End.Pos, EdgeId: edge.ID, State: Waiting, Route: route}
+		}
+	}
+	t.Fatalf("No edge leads to vertex %d \n", vertex)
+	return CarInfo{}
+}
+
+func TestMovement_ConflictsWith(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	through, opposite := graph.Edges[13].movement, graph.Edges[10].movement
+	if through.conflictsWith(opposite) {
+		t.Errorf("Opposite through movements conflict \n")
+	}
+	if crossing := graph.Edges[36].movement; !through.conflictsWith(crossing) || !crossing.conflictsWith(through) {
+		t.Errorf("Crossing movements do not conflict \n")
+	}
+	if !graph.Edges[6].movement.conflictsWith(graph.Edges[4].movement) { // Both to vertex 1
+		t.Errorf("Movements to the same exit do not conflict \n")
+	}
+	if !through.conflictsWith(nil) {
+		t.Errorf("A movement does not conflict with an unknown one \n")
+	}
+}
+
+func TestStopSignManager_FirstComeFirstServed(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	manager := newStopSignManager(graph)
+	now := time.Now()
+	fromEast := atStopLine(t, graph, 0, 4, 6)  // Turning right to vertex 1
+	fromSouth := atStopLine(t, graph, 1, 3, 4) // Through to vertex 1
+
+	if grants := manager.update([]CarInfo{fromEast}, now); !grants[0] {
+		t.Fatalf("First car at the stop sign not granted right of way \n")
+	}
+	now = now.Add(time.Second)
+	if grants := manager.update([]CarInfo{fromEast, fromSouth}, now); !grants[0] || grants[1] {
+		t.Errorf("Expected only the first car to have right of way, got %v \n", grants)
+	}
+	crossing := CarInfo{ID: 0, Pos: Coords{100, 310}, EdgeId: 6, State: ToPickUp}
+	if grants := manager.update([]CarInfo{crossing, fromSouth}, now.Add(time.Second)); !grants[0] || grants[1] {
+		t.Errorf("Expected the second car to wait for the first to cross, got %v \n", grants)
+	}
+	crossing.Pos = graph.Edges[6].End.Pos
+	if grants := manager.update([]CarInfo{crossing, fromSouth}, now.Add(2*time.Second)); grants[0] || !grants[1] {
+		t.Errorf("Expected the second car to have right of way once the first crossed, got %v \n", grants)
+	}
+}
+
+func TestStopSignManager_SameTime(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	now := time.Now()
+	fromEast := atStopLine(t, graph, 0, 4, 6)
+	fromSouth := atStopLine(t, graph, 1, 3, 4)
+	fromNorth := atStopLine(t, graph, 2, 0, 0) // Through to vertex 2
+
+	grants := newStopSignManager(graph).update([]CarInfo{fromSouth, fromEast}, now)
+	if !grants[0] || grants[1] {
+		t.Errorf("Expected the car on the right to go first, got %v \n", grants)
+	}
+
+	grants = newStopSignManager(graph).update([]CarInfo{fromSouth, fromNorth}, now)
+	if !grants[1] || !grants[2] {
+		t.Errorf("Expected opposite through movements to go together, got %v \n", grants)
+	}
+
+	manager := newStopSignManager(graph)
+	fromSouth.Route = []uint{5} // Turning right to vertex 5 instead
+	manager.update([]CarInfo{fromEast, fromSouth}, now)
+	fromSouth.Route = []uint{4}
+	if grants := manager.update([]CarInfo{fromEast, fromSouth}, now.Add(time.Second)); !grants[0] || grants[1] {
+		t.Errorf("Expected a rerouted car to wait for conflicting movements, got %v \n", grants)
+	}
+}
@@ -0,0 +1,130 @@
+package sim2
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// surge - Describes per-zone surge multipliers from open ride requests versus idle cars
+
+// SurgeConfig - configurable zoning and sensitivity of surge pricing.
+type SurgeConfig struct {
+	ZoneSize      float64 // Width and height of a square zone in map units
+	Sensitivity   float64 // Multiplier increase per open request beyond the idle cars in a zone
+	MaxMultiplier float64 // Upper bound on any zone's multiplier
+}
+
+// DefaultSurgeConfig - surge configuration used when none is configured.
+var DefaultSurgeConfig = SurgeConfig{ZoneSize: 350, Sensitivity: 0.25, MaxMultiplier: 3}
+
+// SurgeMonitor - tracks supply and demand per map zone and derives surge multipliers.
+type SurgeMonitor struct {
+	config      SurgeConfig
+	demand      RideDemand
+	webChan     chan Message
+	grid        zoneGrid
+	mutex       sync.Mutex
+	cars        []CarInfo // Latest car states observed from World
+	multipliers []float64 // Index by zone ID
+}
+
+// NewSurgeMonitor - Constructor for a valid SurgeMonitor object covering every vertex of graph.
+func NewSurgeMonitor(graph *Digraph, config SurgeConfig, demand RideDemand, webChan chan Message) *SurgeMonitor {
+	m := new(SurgeMonitor)
+	m.config = config
+	m.demand = demand
+	m.webChan = webChan
+	m.grid = newZoneGrid(graph, config.ZoneSize)
+	m.multipliers = make([]float64, m.grid.numZones())
+	for idx := range m.multipliers {
+		m.multipliers[idx] = 1
+	}
+	return m
+}
+
+// ObserveCars - Record the latest car states; called from the World loop so it must not block.
+func (m *SurgeMonitor) ObserveCars(cars []CarInfo) {
+	m.mutex.Lock()
+	m.cars = cars
+	m.mutex.Unlock()
+}
+
+// Multiplier - current surge multiplier for the zone containing pos.
+func (m *SurgeMonitor) Multiplier(pos Coords) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if zone, ok := m.grid.zone(pos); ok {
+		return m.multipliers[zone]
+	}
+	return 1
+}
+
+// LoopSurge - Begin recomputing the surge multipliers every interval.
+func (m *SurgeMonitor) LoopSurge(interval time.Duration) {
+	for {
+		m.update(m.demand.OpenRideRequests())
+		time.Sleep(interval)
+	}
+}
+
+func (m *SurgeMonitor) update(openRides []RideRequest) {
+	requests := make([]int, len(m.multipliers))
+	for _, ride := range openRides {
+		pos, err := parseCoords(ride.From)
+		if err != nil {
+			continue
+		}
+		if zone, ok := m.grid.zone(pos); ok {
+			requests[zone]++
+		}
+	}
+
+	m.mutex.Lock()
+	idleCars := make([]int, len(m.multipliers))
+	for _, car := range m.cars {
+		if car.isIdle() {
+			if zone, ok := m.grid.zone(car.Pos); ok {
+				idleCars[zone]++
+			}
+		}
+	}
+	var changed []int
+	for zone := range m.multipliers {
+		multiplier := m.surgeMultiplier(requests[zone], idleCars[zone])
+		if multiplier != m.multipliers[zone] {
+			m.multipliers[zone] = multiplier
+			changed = append(changed, zone)
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, zone := range changed {
+		offer(m.webChan, m.zoneMessage(zone, requests[zone], idleCars[zone]))
+	}
+}
+
+// surgeMultiplier - 1 while idle cars cover the open requests, rising with each uncovered request.
+func (m *SurgeMonitor) surgeMultiplier(requests int, idleCars int) float64 {
+	uncovered := requests - idleCars
+	if uncovered <= 0 {
+		return 1
+	}
+	multiplier := 1 + m.config.Sensitivity*float64(uncovered)
+	return math.Min(multiplier, m.config.MaxMultiplier)
+}
+
+func (m *SurgeMonitor) zoneMessage(zone int, requests int, idleCars int) SurgeMessage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	origin := m.grid.origin(zone)
+	return SurgeMessage{
+		Zone:       zone,
+		X:          origin.X,
+		Y:          origin.Y,
+		Size:       m.config.ZoneSize,
+		Multiplier: m.multipliers[zone],
+		Requests:   requests,
+		IdleCars:   idleCars,
+	}
+}
@@ -0,0 +1,35 @@
+package sim2
+
+import (
+	"testing"
+)
+
+func TestSurgeMonitor_Update(t *testing.T) {
+	graph := NewDigraph()
+	graph.Vertices[0] = &Vertex{ID: 0, Pos: Coords{0, 0}}
+	graph.Vertices[1] = &Vertex{ID: 1, Pos: Coords{199, 99}}
+	webChan := make(chan Message, 4)
+	surge := NewSurgeMonitor(graph, SurgeConfig{ZoneSize: 100, Sensitivity: 0.5, MaxMultiplier: 2}, nil, webChan)
+	if surge.grid.columns != 2 || surge.grid.rows != 1 {
+		t.Fatalf("Zones do not cover the map, got %d columns %d rows \n", surge.grid.columns, surge.grid.rows)
+	}
+
+	surge.ObserveCars([]CarInfo{
+		{ID: 0, Pos: Coords{10, 10}, State: DrivingAtRandom},
+		{ID: 1, Pos: Coords{20, 10}, State: ToPickUp},
+	})
+	surge.update([]RideRequest{{From: "10,10"}, {From: "150,50"}, {From: "160,50"}, {From: "170,50"}, {From: "180,50"}, {From: "190,50"}})
+
+	if multiplier := surge.Multiplier(Coords{50, 50}); multiplier != 1 {
+		t.Errorf("Zone with an idle car per request surged to %f \n", multiplier)
+	}
+	if multiplier := surge.Multiplier(Coords{150, 50}); multiplier != 2 {
+		t.Errorf("Zone with five uncovered requests not capped at the max multiplier, got %f \n", multiplier)
+	}
+	if multiplier := surge.Multiplier(Coords{500, 500}); multiplier != 1 {
+		t.Errorf("Position off the map surged to %f \n", multiplier)
+	}
+	if len(webChan) != 1 {
+		t.Errorf("Expected one zone change published, got %d \n", len(webChan))
+	}
+}
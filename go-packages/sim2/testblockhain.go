@@ -5,6 +5,9 @@ import (
 	"fmt"
 	"sync"
 	"strings"
+	"math/rand"
+	"time"
+	"strconv"
 )
 
 type TestChain struct {
@@ -14,30 +17,58 @@ type TestChain struct {
 	requestedRides []Ride
 	RecvServer chan Ride
 	mutex *sync.Mutex
+	numRequests uint
+	random *rand.Rand  // Picks the open ride offered to a car; guarded by mutex
+	done chan struct{}  // Closed by StopTestChain
 }
 
 type Ride struct {
 	from string
 	to string
+	amount uint64
+	address string
+}
+
+// NewRide - Construct a ride request for the test chain; the chain assigns the rider address.
+func NewRide(from string, to string, amount uint64) Ride {
+	return Ride{from:from, to:to, amount:amount}
+}
+
+// NewRiderRide - Construct a ride request for the test chain on behalf of the rider at address.
+func NewRiderRide(address string, from string, to string, amount uint64) Ride {
+	return Ride{from:from, to:to, amount:amount, address:address}
 }
 
 func NewTestChain() *TestChain {
 	tc := new(TestChain)
 	tc.RecvServer = make(chan Ride)
 	tc.mutex = &sync.Mutex{}
+	tc.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	tc.done = make(chan struct{})
 	return tc
 }
 
+// SetSeed - Seed the choice of open ride offered to a car; call before StartTestChain.
+func (tc *TestChain) SetSeed(seed int64) {
+	tc.random.Seed(seed)
+}
+
 func (tc *TestChain) StartTestChain() {
 	go tc.receiveRideRequestsThread()
 	go tc.blockchainInteractorsThread()
 }
 
+// StopTestChain - Stop the chain threads; blockchain interactors get empty replies from then on.
+func (tc *TestChain) StopTestChain() {
+	close(tc.done)
+}
+
 
 func (tc *TestChain) RegisterBlockchainInteractor()(testchainApi *TestChainAPI){
 	testchainApi = new(TestChainAPI)
 	testchainApi.recvChan = make(chan string)
 	testchainApi.sendChan = make(chan string)
+	testchainApi.done = tc.done
 	ride := new(Ride)
 	tc.recvChans = append(tc.recvChans, testchainApi.sendChan)
 	tc.sendChans = append(tc.sendChans, testchainApi.recvChan)
@@ -48,23 +79,56 @@ func (tc *TestChain) RegisterBlockchainInteractor()(testchainApi *TestChainAPI){
 
 func (tc *TestChain)receiveRideRequestsThread() {
 	for {
-		ride := <-tc.RecvServer
-		tc.mutex.Lock()
-		tc.requestedRides = append(tc.requestedRides, ride)
-		tc.mutex.Unlock()
+		select {
+		case ride := <-tc.RecvServer:
+			tc.mutex.Lock()
+			tc.addRequestedRide(ride)
+			tc.mutex.Unlock()
+		case <-tc.done:
+			return
+		}
 	}
 }
 
+// addRequestedRide - open a ride request, assigning a rider address if it has none; caller must hold the mutex.
+func (tc *TestChain) addRequestedRide(ride Ride) (address string) {
+	if ride.address == "" {
+		ride.address = fmt.Sprintf("0x%040x", tc.numRequests)
+	}
+	tc.numRequests++
+	tc.requestedRides = append(tc.requestedRides, ride)
+	return ride.address
+}
+
+// RequestRide - Open a ride request for rider right away, or for a new rider address if rider is "", and return
+//   the rider address.
+func (tc *TestChain) RequestRide(rider string, from string, to string, amount uint64) string {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return tc.addRequestedRide(NewRiderRide(rider, from, to, amount))
+}
+
+// DispatchRide - Open a held scheduled ride as a ride request right away.
+func (tc *TestChain) DispatchRide(ride ScheduledRide) (rider string) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return tc.addRequestedRide(Ride{from:ride.From, to:ride.To, amount:ride.Amount, address:ride.Rider})
+}
+
 func (tc *TestChain)blockchainInteractorsThread() {
 	for {
-		cases := make([]reflect.SelectCase, len(tc.recvChans))
+		cases := make([]reflect.SelectCase, len(tc.recvChans), len(tc.recvChans) + 1)
 		for i, ch := range tc.recvChans {
 			cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch)}
 		}
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(tc.done)})
 
 		remaining := len(cases)
 		for remaining > 0 {
 			chosen, value, ok := reflect.Select(cases)
+			if chosen == len(tc.recvChans) {
+				return  // The chain stopped
+			}
 			if !ok {
 				// The chosen channel has been closed, so zero out the channel to disable the case
 				cases[chosen].Chan = reflect.ValueOf(nil)
@@ -72,49 +136,115 @@ func (tc *TestChain)blockchainInteractorsThread() {
 				continue
 			}
 
-			switch value.String() {
+			request := strings.Split(value.String(), " ")
+			switch request[0] {
 			case "GetRides":
+				tc.mutex.Lock()
 				if len(tc.requestedRides) > 0 {
-					tc.sendChans[chosen] <- "true"
+					tc.reply(chosen, tc.requestedRides[tc.random.Intn(len(tc.requestedRides))].address)
 				} else {
-					tc.sendChans[chosen] <- "false"
+					tc.reply(chosen, "")
 				}
+				tc.mutex.Unlock()
 			case "AcceptRide":
-				if len(tc.requestedRides) > 0 {
-					tc.currentRides[chosen] = tc.requestedRides[0]
-					tc.mutex.Lock()
-					tc.requestedRides = append(tc.requestedRides[:0], tc.requestedRides[1:]...)
-					tc.mutex.Unlock()
-					tc.sendChans[chosen] <- "true"
+				tc.mutex.Lock()
+				if idx, ok := tc.requestedRideIndex(request[1]); ok {
+					tc.currentRides[chosen] = tc.requestedRides[idx]
+					tc.requestedRides = append(tc.requestedRides[:idx], tc.requestedRides[idx+1:]...)
+					tc.reply(chosen, "true")
 				} else {
-					tc.sendChans[chosen] <- "false"
+					tc.reply(chosen, "false")
 				}
+				tc.mutex.Unlock()
 			case "GetLocations":
-				tc.sendChans[chosen] <- fmt.Sprintf("%s %s", tc.currentRides[chosen].from, tc.currentRides[chosen].to)
+				ride := tc.findRide(chosen, request[1])
+				tc.reply(chosen, fmt.Sprintf("%s %s", ride.from, ride.to))
+			case "GetAmount":
+				ride := tc.findRide(chosen, request[1])
+				tc.reply(chosen, strconv.FormatUint(ride.amount, 10))
 			}
 
 		}
 	}
 }
 
+// reply - Send msg to the blockchain interactor chosen unless the chain stops first.
+func (tc *TestChain) reply(chosen int, msg string) {
+	select {
+	case tc.sendChans[chosen] <- msg:
+	case <-tc.done:
+	}
+}
+
+// requestedRideIndex - find a requested ride by rider address; caller must hold the mutex.
+func (tc *TestChain) requestedRideIndex(address string) (int, bool) {
+	for idx, ride := range tc.requestedRides {
+		if ride.address == address {
+			return idx, true
+		}
+	}
+	return 0, false
+}
+
+// findRide - find a ride by rider address, either the interactor's current ride or a requested one.
+func (tc *TestChain) findRide(interactor int, address string) (ride Ride) {
+	if tc.currentRides[interactor].address == address {
+		return tc.currentRides[interactor]
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if idx, ok := tc.requestedRideIndex(address); ok {
+		ride = tc.requestedRides[idx]
+	}
+	return
+}
+
+// OpenRideRequests - rides no car has accepted yet.
+func (tc *TestChain) OpenRideRequests() (rides []RideRequest) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	for _, ride := range tc.requestedRides {
+		rides = append(rides, RideRequest{Rider:ride.address, From:ride.from, To:ride.to})
+	}
+	return
+}
 
 type TestChainAPI struct {
 	recvChan chan string
 	sendChan chan string
+	done chan struct{}  // Closed when the chain stops
+}
+
+// request - Send req to the test chain and return its reply, "" once the chain has stopped.
+func (testChainApi *TestChainAPI) request(req string) string {
+	select {
+	case testChainApi.sendChan <- req:
+	case <-testChainApi.done:
+		return ""
+	}
+	select {
+	case reply := <-testChainApi.recvChan:
+		return reply
+	case <-testChainApi.done:
+		return ""
+	}
 }
 
 func (testChainApi *TestChainAPI) GetRideAddressIfAvailable() (available bool, address string) {
-	testChainApi.sendChan <- "GetRides"
-	return "true" == <-testChainApi.recvChan, ""
+	address = testChainApi.request("GetRides")
+	return address != "", address
 }
 
 func (testChainApi *TestChainAPI) AcceptRequest(address string) (status bool) {
-	testChainApi.sendChan <- "AcceptRide"
-	return "true" == <-testChainApi.recvChan
+	return "true" == testChainApi.request("AcceptRide " + address)
 }
 
 func (testChainApi *TestChainAPI) GetLocations(address string) (from string, to string) {
-	testChainApi.sendChan <- "GetLocations"
-	locations := strings.Split(<-testChainApi.recvChan, " ")
-	return locations[0], locations[1]
+	from, to, _ = strings.Cut(testChainApi.request("GetLocations " + address), " ")
+	return
+}
+
+func (testChainApi *TestChainAPI) GetAmount(address string) (amount uint64) {
+	amount, _ = strconv.ParseUint(testChainApi.request("GetAmount " + address), 10, 64)
+	return
 }
@@ -0,0 +1,207 @@
+package sim2
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// turns - Describes the movements through intersections, which way they turn, what turning costs when
+//   routing and which turns a map forbids
+
+// Turn - which way a movement through an intersection turns.
+type Turn int
+
+const (
+	Through Turn = 0
+	Right   Turn = 1
+	Left    Turn = 2
+	UTurn   Turn = 3
+)
+
+// NumberOfTurns - the number of ways a movement can turn
+const NumberOfTurns = 4
+
+var turnNames = [NumberOfTurns]string{"Through", "Right", "Left", "UTurn"}
+
+// DefaultTurnCosts - added to the weight of a movement when routing, in map units, so routes go straight
+//   through intersections where turning saves little
+var DefaultTurnCosts = [NumberOfTurns]float64{Through: 0, Right: 10, Left: 30, UTurn: 120}
+
+// Movement - one way through an intersection from one of its entries.
+type Movement struct {
+	Edge    *Edge     // Leaves the entry vertex; extends into the next edge for curved movements
+	Exit    *Vertex   // Where the movement leaves the intersection
+	From    Direction // Of the entry
+	Turn    Turn
+	Allowed bool // False where the map forbids the turn
+}
+
+// ParseTurn - the turn named name, in any case.
+func ParseTurn(name string) (Turn, error) {
+	for turn, turnName := range turnNames {
+		if strings.EqualFold(name, turnName) {
+			return Turn(turn), nil
+		}
+	}
+	return Through, errors.New("unknown turn " + name)
+}
+
+func (t Turn) String() string {
+	if t < 0 || t >= NumberOfTurns {
+		return "Turn(" + strconv.Itoa(int(t)) + ")"
+	}
+	return turnNames[t]
+}
+
+// Movements - movements through the intersection entered at the vertex with ID id, nil if it is not an
+//   intersection entry.
+func (g *Digraph) Movements(id uint) []*Movement {
+	vertex, ok := g.Vertices[id]
+	if !ok || vertex.intersection == nil {
+		return nil
+	}
+	return vertex.intersection.entries[vertex.directionFromIntersection].movements
+}
+
+// ForbidTurn - Route no car through the intersection entered at the vertex with ID id by turning turn.
+func (g *Digraph) ForbidTurn(id uint, turn Turn) error {
+	found := false
+	for _, movement := range g.Movements(id) {
+		if movement.Turn == turn {
+			movement.Allowed = false
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("no " + turn.String() + " movement from vertex " + strconv.Itoa(int(id)))
+	}
+	return nil
+}
+
+// SetTurnCost - Add cost map units to the weight of movements turning turn when routing, and true OK.
+//   False if cost is negative.
+func (g *Digraph) SetTurnCost(turn Turn, cost float64) bool {
+	if turn < 0 || turn >= NumberOfTurns || !(cost >= 0) || math.IsInf(cost, 1) {
+		return false
+	}
+	g.turnCosts[turn] = cost
+	return true
+}
+
+// canDrive - true if edge is open to traffic and, crossing an intersection, its turn is allowed.
+func (g *Digraph) canDrive(edge *Edge) bool {
+	return !g.IsClosed(edge.ID) && (edge.movement == nil || edge.movement.Allowed)
+}
+
+// turnCost - cost of the turn edge makes through an intersection, 0 for edges between intersections.
+func (g *Digraph) turnCost(edge *Edge) float64 {
+	if edge.movement == nil {
+		return 0
+	}
+	return g.turnCosts[edge.movement.Turn]
+}
+
+// findMovements - Find the movements through intersection and the turns they make, from the heading of the
+//   road into each entry and of the road leaving the movement's exit.
+func (g *Digraph) findMovements(intersection *Intersection) {
+	for direction := range intersection.entries {
+		entry := &intersection.entries[direction]
+		if !entry.present {
+			continue
+		}
+		in := directionHeadings[direction]
+		for id := uint(0); id < uint(len(g.Edges)); id++ {
+			if g.Edges[id].End == entry.vertex {
+				in = heading(g.Edges[id])
+				break
+			}
+		}
+		entry.movements = nil
+		for _, edge := range entry.vertex.AdjEdges {
+			last := edge
+			if edge.Extends && len(edge.End.AdjEdges) > 0 {
+				last = edge.End.AdjEdges[0]
+			}
+			out := heading(last)
+			if len(last.End.AdjEdges) > 0 {
+				out = heading(last.End.AdjEdges[0])
+			}
+			movement := &Movement{Edge: edge, Exit: last.End, From: Direction(direction), Turn: turnBetween(in, out), Allowed: true}
+			edge.movement = movement
+			edge.crosses = intersection
+			last.crosses = intersection
+			entry.movements = append(entry.movements, movement)
+		}
+	}
+}
+
+// directionHeadings - heading of cars entering an intersection from each direction, in map coordinates
+//   where y grows southwards; used where no road leads into an entry
+var directionHeadings = [NumberOfDirections]Coords{West: {1, 0}, South: {0, -1}, East: {-1, 0}, North: {0, 1}}
+
+// heading - direction cars drive edge in; edges wrapping around the map point back across it.
+func heading(edge *Edge) Coords {
+	h := Coords{edge.End.Pos.X - edge.Start.Pos.X, edge.End.Pos.Y - edge.Start.Pos.Y}
+	if edge.Wraps {
+		h = Coords{-h.X, -h.Y}
+	}
+	return h
+}
+
+// turnBetween - the turn from heading in to heading out: through within 45 degrees, a U-turn beyond 135.
+func turnBetween(in Coords, out Coords) Turn {
+	angle := math.Atan2(in.X*out.Y-in.Y*out.X, in.X*out.X+in.Y*out.Y) * 180 / math.Pi
+	switch {
+	case math.Abs(angle) <= 45:
+		return Through
+	case math.Abs(angle) > 135:
+		return UTurn
+	case angle > 0: // Clockwise on the map, as y grows southwards
+		return Right
+	default:
+		return Left
+	}
+}
+
+// conflictsWith - true if cars could not make movement m and other at the same time: their paths through
+//   the intersection cross or touch, or they leave by the same exit. Nil movements conflict with any.
+func (m *Movement) conflictsWith(other *Movement) bool {
+	if m == nil || other == nil || m.Exit == other.Exit {
+		return true
+	}
+	path, otherPath := m.path(), other.path()
+	for i := 1; i < len(path); i++ {
+		for j := 1; j < len(otherPath); j++ {
+			if segmentsTouch(path[i-1], path[i], otherPath[j-1], otherPath[j]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// path - positions a car passes making the movement, from the entry to the exit.
+func (m *Movement) path() []Coords {
+	if m.Edge.End == m.Exit {
+		return []Coords{m.Edge.Start.Pos, m.Exit.Pos}
+	}
+	return []Coords{m.Edge.Start.Pos, m.Edge.End.Pos, m.Exit.Pos}
+}
+
+// segmentsTouch - true if the segment from a to b and the segment from c to d have a point in common.
+func segmentsTouch(a, b, c, d Coords) bool {
+	side := func(p, q, r Coords) float64 { // Positive if r lies to one side of p to q, negative the other
+		return (q.X-p.X)*(r.Y-p.Y) - (q.Y-p.Y)*(r.X-p.X)
+	}
+	within := func(p, q, r Coords) bool { // r lies in the bounding box of p and q
+		return math.Min(p.X, q.X) <= r.X && r.X <= math.Max(p.X, q.X) && math.Min(p.Y, q.Y) <= r.Y && r.Y <= math.Max(p.Y, q.Y)
+	}
+	d1, d2, d3, d4 := side(c, d, a), side(c, d, b), side(a, b, c), side(a, b, d)
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+	return (d1 == 0 && within(c, d, a)) || (d2 == 0 && within(c, d, b)) ||
+		(d3 == 0 && within(a, b, c)) || (d4 == 0 && within(a, b, d))
+}
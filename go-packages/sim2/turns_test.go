@@ -0,0 +1,124 @@
+package sim2
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestDigraph_Movements(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	expected := map[uint]Turn{13: Through, 14: Right, 15: Left}
+	movements := graph.Movements(8)
+	if len(movements) != len(expected) {
+		t.Fatalf("Expected %d movements from vertex 8, got %d \n", len(expected), len(movements))
+	}
+	for _, movement := range movements {
+		if turn, ok := expected[movement.Edge.ID]; !ok || movement.Turn != turn || movement.From != West || !movement.Allowed {
+			t.Errorf("Movement over edge %d classified as %v from %v \n", movement.Edge.ID, movement.Turn, movement.From)
+		}
+	}
+	if exit := movements[2].Exit.ID; exit != 23 {
+		t.Errorf("Left turn over an extending edge exits at vertex %d, expected 23 \n", exit)
+	}
+	if graph.Movements(9) != nil || graph.Edges[16].movement != nil {
+		t.Errorf("Vertex 9 is not an intersection entry \n")
+	}
+
+	// Entries of final.map are not listed in map direction order; turns follow the roads
+	graph = GetDigraphFromFile("../../maps/final.map")
+	for _, intersection := range graph.Intersections {
+		for _, entry := range intersection.entries {
+			turns := make(map[Turn]bool)
+			for _, movement := range entry.movements {
+				if movement.Turn == UTurn || turns[movement.Turn] {
+					t.Errorf("Entry %d has an unexpected %v movement \n", entry.vertex.ID, movement.Turn)
+				}
+				turns[movement.Turn] = true
+			}
+		}
+	}
+	for _, movement := range graph.Movements(48) {
+		if movement.Allowed != (movement.Turn != Left) {
+			t.Errorf("Map forbids left turns from vertex 48, %v movement allowed %v \n", movement.Turn, movement.Allowed)
+		}
+	}
+}
+
+func TestDigraph_ForbidTurn(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	edges, _ := graph.shortestPath(8, 23)
+	if len(edges) == 0 || edges[0].ID != 15 {
+		t.Fatalf("Expected the left turn over edge 15, got %v \n", edges)
+	}
+	if err := graph.ForbidTurn(8, Left); err != nil {
+		t.Fatal(err)
+	}
+	edges, dist := graph.shortestPath(8, 23)
+	if len(edges) == 0 || edges[0].ID == 15 {
+		t.Errorf("Route still turns left from vertex 8, got %v \n", edges)
+	}
+	for idx := 1; idx < len(edges); idx++ {
+		if edges[idx].Start.ID != edges[idx-1].End.ID {
+			t.Errorf("Route is not connected at edge %d \n", edges[idx].ID)
+		}
+	}
+	if len(edges) > 0 && edges[len(edges)-1].End.ID != 23 || dist <= graph.Edges[15].Weight {
+		t.Errorf("Route around the forbidden turn does not reach vertex 23, got %v \n", edges)
+	}
+	if err := graph.ForbidTurn(8, UTurn); err == nil {
+		t.Errorf("Forbade a U-turn that does not exist \n")
+	}
+	if err := graph.ForbidTurn(9, Left); err == nil {
+		t.Errorf("Forbade a turn from a vertex that enters no intersection \n")
+	}
+}
+
+func TestDigraph_Destinations(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	graph.CloseEdge(8)
+	if err := graph.ForbidTurn(8, Left); err != nil {
+		t.Fatal(err)
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		if edge := graph.getRandomEdge(22, random); edge.ID == 8 || edge.movement != nil {
+			t.Fatalf("Sent a car to edge %d, closed or through an intersection \n", edge.ID)
+		}
+	}
+	if location := graph.closestEdgeAndCoord(Coords{260, 386}); location.edge.ID == 8 {
+		t.Errorf("Snapped a location to closed edge 8 \n")
+	}
+
+	car := NewCar(0, graph, nil, nil, nil, nil)
+	car.path.edge = *graph.Edges[52] // Ends at vertex 5, whose only exit is edge 8
+	if edges, dist := car.getShortestPathToEdge(*graph.Edges[8]); edges != nil || !math.IsInf(dist, 1) {
+		t.Errorf("Routed onto closed edge 8, got %v \n", edges)
+	}
+	if edges, dist := car.getShortestPathToEdge(*graph.Edges[15]); edges != nil || !math.IsInf(dist, 1) {
+		t.Errorf("Routed onto forbidden left turn 15, got %v \n", edges)
+	}
+}
+
+func TestDigraph_TurnCosts(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	left := graph.Edges[15]
+	if weight := graph.travelWeight(left); weight != left.Weight+DefaultTurnCosts[Left] {
+		t.Errorf("Left turn weighs %v, expected its length plus the turn cost \n", weight)
+	}
+	if weight := graph.travelWeight(graph.Edges[16]); weight != graph.Edges[16].Weight {
+		t.Errorf("Edge between intersections weighs %v, expected its length \n", weight)
+	}
+	if !graph.SetTurnCost(Left, 0) || graph.travelWeight(left) != left.Weight {
+		t.Errorf("Left turn cost not changed \n")
+	}
+	if graph.SetTurnCost(Left, -1) {
+		t.Errorf("Set a negative turn cost \n")
+	}
+	if turn, err := ParseTurn("uturn"); err != nil || turn != UTurn {
+		t.Errorf("Parsed uturn as %v, %v \n", turn, err)
+	}
+	if _, err := ParseTurn("sideways"); err == nil {
+		t.Errorf("Parsed an unknown turn \n")
+	}
+}
@@ -0,0 +1,265 @@
+package sim2
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// webclient - Describes a connected web client, what it subscribed to and its bounded queue of outgoing frames
+
+// ClientQueueSize - frames queued for a client before its oldest updates are dropped
+const ClientQueueSize = 256
+
+// ClientWriteTimeout - time a client has to accept one frame before it is disconnected
+const ClientWriteTimeout = time.Second * 10
+
+// AllRiders - rider subscription to every rider's ride status, only honoured for admins
+const AllRiders = "*"
+
+// DefaultSubscription - topics of a client that has not subscribed, besides its own rides.
+var DefaultSubscription = Subscription{AllCars: true, StopLights: true, Surge: true, OnTime: true}
+
+// webClient - one websocket connection, written only by its own goroutine.
+type webClient struct {
+	conn         *websocket.Conn
+	mutex        sync.Mutex
+	session      *Session // Nil until the client signs in
+	nonce        string   // Nonce the client signs to sign in
+	subscription Subscription
+	riders       map[string]bool // Lower case addresses whose ride statuses are sent
+	visibleCars  map[uint]bool   // Cars last sent inside the subscribed viewport
+	queue        []Envelope
+	seq          uint64 // Sequence number of the last queued broadcast update
+	resync       bool   // An update other than a car position was dropped, send a fresh snapshot instead
+	wake         chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+	logger       *Logger
+}
+
+func newWebClient(conn *websocket.Conn) *webClient {
+	c := new(webClient)
+	c.conn = conn
+	c.wake = make(chan struct{}, 1)
+	c.done = make(chan struct{})
+	c.visibleCars = make(map[uint]bool)
+	c.logger = defaultLogger.Component("websrv")
+	c.subscribe(DefaultSubscription)
+	return c
+}
+
+// subscribe - Replace the client's topics.
+func (c *webClient) subscribe(subscription Subscription) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.subscription = subscription
+	c.updateRiders()
+}
+
+// signIn - Bind the client to session, replacing any previous session which is returned.
+func (c *webClient) signIn(session Session) (previous *Session) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	previous = c.session
+	c.session = &session
+	c.updateRiders()
+	return
+}
+
+// currentSession - the client's session, nil if it has not signed in.
+func (c *webClient) currentSession() *Session {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.session
+}
+
+// updateRiders - Riders whose statuses the client may receive: its own, and everyone's for an admin who
+//   subscribed to AllRiders. Caller must hold the mutex.
+func (c *webClient) updateRiders() {
+	c.riders = make(map[string]bool)
+	if c.session == nil {
+		return
+	}
+	c.riders[c.session.Address] = true
+	for _, rider := range c.subscription.Riders {
+		if rider == AllRiders && c.session.Role == AdminRole {
+			c.riders[AllRiders] = true
+		}
+	}
+}
+
+// send - Queue a broadcast update if the client subscribed to it, without blocking. A car position
+//   replaces the car's queued position, keeping its sequence number as the client misses nothing it needs.
+func (c *webClient) send(msg Message) {
+	c.mutex.Lock()
+	if !c.wants(msg) {
+		c.mutex.Unlock()
+		return
+	}
+	if car, ok := msg.(CarMessage); ok {
+		if idx := c.queuedCar(int(car.ID)); idx >= 0 {
+			c.queue[idx].Data = car
+			c.mutex.Unlock()
+			return
+		}
+	}
+	c.seq++
+	c.enqueue(envelope(msg, c.seq))
+	c.mutex.Unlock()
+	c.signal()
+}
+
+// reply - Queue msg for this client only, outside the broadcast sequence.
+func (c *webClient) reply(msg Message) {
+	c.mutex.Lock()
+	c.enqueue(envelope(msg, 0))
+	c.mutex.Unlock()
+	c.signal()
+}
+
+// resetTo - Replace the queued broadcast updates with the subscribed part of snapshot.
+//   Caller must keep broadcasts from interleaving, so snapshot is current as of the last queued update.
+func (c *webClient) resetTo(snapshot SnapshotMessage) {
+	c.mutex.Lock()
+	queue := []Envelope{envelope(c.filter(snapshot), c.seq)}
+	for _, frame := range c.queue {
+		if frame.Seq == 0 {
+			queue = append(queue, frame)
+		}
+	}
+	c.queue = queue
+	c.resync = false
+	c.mutex.Unlock()
+	c.signal()
+}
+
+// wants - true if the client subscribed to msg; caller must hold the mutex.
+func (c *webClient) wants(msg Message) bool {
+	switch update := msg.(type) {
+	case CarMessage:
+		if c.subscription.coversCar(update) {
+			c.visibleCars[update.ID] = true
+			return true
+		}
+		if c.visibleCars[update.ID] {
+			delete(c.visibleCars, update.ID) // One last update as the car leaves the viewport
+			return true
+		}
+		return false
+	case StopLightMessage:
+		return c.subscription.StopLights
+	case SurgeMessage:
+		return c.subscription.Surge
+	case OnTimeMessage:
+		return c.subscription.OnTime
+	case RideStatusMessage:
+		return c.riders[AllRiders] || c.riders[strings.ToLower(update.Address)]
+	}
+	return true
+}
+
+// filter - the subscribed part of snapshot; caller must hold the mutex.
+func (c *webClient) filter(snapshot SnapshotMessage) (filtered SnapshotMessage) {
+	c.visibleCars = make(map[uint]bool)
+	filtered.Cars = []CarMessage{}
+	for _, car := range snapshot.Cars {
+		if c.subscription.coversCar(car) {
+			c.visibleCars[car.ID] = true
+			filtered.Cars = append(filtered.Cars, car)
+		}
+	}
+	filtered.StopLights = []StopLightMessage{}
+	if c.subscription.StopLights {
+		filtered.StopLights = snapshot.StopLights
+	}
+	filtered.Surge = []SurgeMessage{}
+	if c.subscription.Surge {
+		filtered.Surge = snapshot.Surge
+	}
+	if c.subscription.OnTime {
+		filtered.OnTime = snapshot.OnTime
+	}
+	filtered.Roads = snapshot.Roads // Every client needs to know which roads are closed
+	if filtered.Roads == nil {
+		filtered.Roads = []RoadMessage{}
+	}
+	return
+}
+
+// enqueue - Queue frame; a full queue drops its oldest car position, or its oldest frame if it holds none.
+//   Caller must hold the mutex.
+func (c *webClient) enqueue(frame Envelope) {
+	if len(c.queue) >= ClientQueueSize {
+		idx := c.queuedCar(-1)
+		if idx < 0 {
+			idx = 0
+			if c.queue[0].Seq != 0 {
+				c.resync = true
+			}
+		}
+		c.queue = append(c.queue[:idx], c.queue[idx+1:]...)
+	}
+	c.queue = append(c.queue, frame)
+}
+
+func (c *webClient) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default: // Already woken
+	}
+}
+
+// queuedCar - index of the queued position of car id, or of any car if id is -1; -1 if none is queued.
+//   Caller must hold the mutex.
+func (c *webClient) queuedCar(id int) int {
+	for idx, frame := range c.queue {
+		if car, ok := frame.Data.(CarMessage); ok && (id < 0 || car.ID == uint(id)) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// writeLoop - Write queued frames to the connection until it fails or the client is closed.
+//   resync resets the client to a fresh snapshot after updates were dropped; onError is called on a failed write.
+func (c *webClient) writeLoop(resync func(), onError func()) {
+	for {
+		select {
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+		c.mutex.Lock()
+		needsResync := c.resync
+		c.mutex.Unlock()
+		if needsResync {
+			resync()
+		}
+
+		c.mutex.Lock()
+		frames := c.queue
+		c.queue = nil
+		c.mutex.Unlock()
+		for _, frame := range frames {
+			c.conn.SetWriteDeadline(time.Now().Add(ClientWriteTimeout))
+			if err := c.conn.WriteJSON(frame); err != nil {
+				c.logger.Warn("Could not write to client", Fields{"error": err})
+				onError()
+				return
+			}
+		}
+	}
+}
+
+// close - Stop the write loop and close the connection; safe to call more than once.
+func (c *webClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
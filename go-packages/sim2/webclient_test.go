@@ -0,0 +1,92 @@
+package sim2
+
+import (
+	"testing"
+)
+
+func TestWebClient_Send(t *testing.T) {
+	client := newWebClient(nil)
+	client.subscribe(Subscription{AllCars: true, Riders: []string{AllRiders}})
+	client.signIn(Session{Address: "0xa", Role: AdminRole})
+	client.send(CarMessage{ID: 0, X: 1})
+	client.send(RideStatusMessage{Address: "0xa"})
+	client.send(CarMessage{ID: 0, X: 2})
+	if len(client.queue) != 2 {
+		t.Fatalf("Expected the car position to be coalesced, got %d queued frames \n", len(client.queue))
+	}
+	if car := client.queue[0].Data.(CarMessage); car.X != 2 || client.queue[0].Seq != 1 || client.seq != 2 {
+		t.Errorf("Queued car position was not replaced by the latest, got %+v \n", car)
+	}
+
+	for len(client.queue) < ClientQueueSize {
+		client.send(RideStatusMessage{Address: "0xb"})
+	}
+	client.send(CarMessage{ID: 1})
+	if len(client.queue) != ClientQueueSize {
+		t.Fatalf("Queue grew past its bound to %d \n", len(client.queue))
+	}
+	if _, ok := client.queue[0].Data.(CarMessage); ok || client.resync {
+		t.Errorf("Full queue did not drop its oldest car position first \n")
+	}
+
+	client.queue = client.queue[:len(client.queue)-1]
+	client.send(RideStatusMessage{Address: "0xc"})
+	client.send(RideStatusMessage{Address: "0xd"})
+	if !client.resync {
+		t.Errorf("Dropping a ride status did not ask for a fresh snapshot \n")
+	}
+
+	client.reply(QuoteMessage{})
+	client.resetTo(SnapshotMessage{Cars: []CarMessage{{ID: 0}}})
+	if len(client.queue) != 2 || client.queue[0].Type != "Snapshot" || client.queue[0].Seq != client.seq || client.queue[1].Seq != 0 {
+		t.Errorf("Reset did not replace the queued updates with a snapshot, keeping replies \n")
+	}
+}
+
+func TestWebClient_Subscription(t *testing.T) {
+	client := newWebClient(nil)
+	client.send(RideStatusMessage{Address: "0xa"})
+	if len(client.queue) != 0 {
+		t.Errorf("Ride status sent without a subscription to its rider \n")
+	}
+
+	client.signIn(Session{Address: "0xa", Role: RiderRole})
+	client.subscribe(Subscription{Viewport: &Viewport{X: 0, Y: 0, Width: 100, Height: 100}, CarIDs: []uint{7}, Riders: []string{AllRiders}})
+	client.send(RideStatusMessage{Address: "0xb"})
+	if len(client.queue) != 0 {
+		t.Errorf("Every rider's status sent to a rider who is not an admin \n")
+	}
+	client.send(CarMessage{ID: 1, X: 50, Y: 50})
+	client.send(StopLightMessage{ID: 0})
+	client.send(CarMessage{ID: 2, X: 500, Y: 50})
+	client.send(CarMessage{ID: 7, X: 500, Y: 50})
+	if client.seq != 2 {
+		t.Errorf("Expected only the car in the viewport and the subscribed car, got %d updates \n", client.seq)
+	}
+	client.send(CarMessage{ID: 1, X: 150, Y: 50})
+	client.send(CarMessage{ID: 1, X: 160, Y: 50})
+	if car := client.queue[0].Data.(CarMessage); car.X != 150 || client.seq != 2 {
+		t.Errorf("Expected one last update as the car left the viewport, got %+v \n", car)
+	}
+
+	client.send(RideStatusMessage{Address: "0xA"})
+	if client.seq != 3 {
+		t.Errorf("Rider's own status not sent \n")
+	}
+	client.signIn(Session{Address: "0xa", Role: AdminRole})
+	client.send(RideStatusMessage{Address: "0xb"})
+	if client.seq != 4 {
+		t.Errorf("Every rider's status not sent to an admin \n")
+	}
+}
+
+func TestWorld_Publish(t *testing.T) {
+	world := NewWorld(25, NewDigraph())
+	webChan, _ := world.RegisterWeb()
+	for i := 0; i < WebChanSize+1; i++ {
+		world.publish(CarMessage{}) // Must not block with nobody reading
+	}
+	if len(webChan) != WebChanSize || world.droppedWebMessages != 1 {
+		t.Errorf("Expected one message dropped once the web output was full, got %d \n", world.droppedWebMessages)
+	}
+}
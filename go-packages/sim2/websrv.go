@@ -3,136 +3,431 @@ package sim2
 import (
   "github.com/gorilla/websocket"
   "net/http"
-	"log"
+	"context"
+	"strconv"
+	"time"
+	"encoding/json"
+	"sort"
+	"sync"
 
 	"fmt"
 )
 
-// Message - struct to contain all data relevant to rendering a Car on the frontend.
-type Message struct {
-	Type            string `json:"type"`
-	ID              string `json:"id"`
-	X               string `json:"x"`
-	Y               string `json:"y"`
-	Orientation     string `json:"orientation"`
-	State           string `json:"state"`
-	Address         string `json:"address"`
-	West            string `json:"west"`
-	South           string `json:"south"`
-	East            string `json:"east"`
-	North           string `json:"north"`
-}
-
-// Message struct to handshake the connection type with the client
-type HandshakeMessage struct {
-	Testing       string `json:"testing"`
-	MrmAddress    string `json:"mrmAddress"`
-}
-
-// ride struct to receive locations
-type RideRequestMessage struct {
-	From   string `json:"from"`
-	To     string `json:"to"`
-}
-
+// MaxBulkRides - rides an admin may request at once with one RideRequest count
+const MaxBulkRides = 100
 
 // WebSrv - container for web server variables for the simulator.
 type WebSrv struct {
-  // TODO: other fields here as necessary
   webChan chan Message  // Incoming car information from simulator
+  testing bool  // Rides are requested on sendTestChain instead of the contract
+  guests bool  // While testing, clients ride as anonymous guests until they sign in
+  mrmAddress string  // Ride manager contract address when not testing
+  sendTestChain chan Ride
+  upgrader websocket.Upgrader
+  server *http.Server  // Set by LoopWebSrv
+  done chan struct{}  // Closed by Shutdown
+  pricing *PricingService  // Answers fare quote requests, nil when quotes are disabled
+  scheduler *RideScheduler  // Holds scheduled rides, nil when scheduling is disabled
+  api *API  // Serves the REST API under /api/, nil when disabled
+  sessions *Sessions  // Signs riders in
+  roadGraph *Digraph  // Admins may close its edges and slow traffic on them, nil when road control is disabled
+  metrics *Metrics  // Served under /metrics and counting clients, nil when disabled
+  logger *Logger
+  mutex sync.Mutex  // Guards clients and the world state below
+  clients map[*webClient]bool  // connected clients
+  cars map[uint]CarMessage  // Latest update per car, for snapshots
+  stopLights map[uint]StopLightMessage  // Latest update per stop light
+  surge map[int]SurgeMessage  // Latest update per surge zone
+  roads map[uint]RoadMessage  // Latest update per edge whose road conditions changed
+  onTime *OnTimeMessage
 }
 
-// TODO: find a way to move these into the WebSrv struct without violating handleConnection
-var clients = make(map[*websocket.Conn]bool) // connected clients
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-var ExistingMrmAddress string
-var SendTestChain chan Ride
-var Testing bool
 // NewWebSrv - Constructor for a valid WebSrv object.
 func NewWebSrv(web chan Message, existingMrmAddress string) *WebSrv {
-  s := new(WebSrv)
-  s.webChan = web
-  ExistingMrmAddress = existingMrmAddress
-  Testing = false
+  s := newWebSrv(web)
+  s.mrmAddress = existingMrmAddress
   return s
 }
 
+// NewTestChainWebSrv - Constructor for a valid WebSrv object requesting rides on the test chain.
 func NewTestChainWebSrv(web chan Message, sendTestChain chan Ride) *WebSrv {
+	s := newWebSrv(web)
+	s.testing = true
+	s.sendTestChain = sendTestChain
+	return s
+}
+
+func newWebSrv(web chan Message) *WebSrv {
 	s := new(WebSrv)
 	s.webChan = web
-	Testing = true
-	SendTestChain = sendTestChain
+	s.upgrader = websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	s.done = make(chan struct{})
+	s.clients = make(map[*webClient]bool)
+	s.sessions = NewSessions(nil)
+	s.SetLogger(defaultLogger)
+	s.cars = make(map[uint]CarMessage)
+	s.stopLights = make(map[uint]StopLightMessage)
+	s.surge = make(map[int]SurgeMessage)
+	s.roads = make(map[uint]RoadMessage)
 	return s
 }
 
-// LoopWebSrv - Begin the web server execution loop.
-func (s *WebSrv) LoopWebSrv(portAddress string) {
+// EnablePricing - Answer fare quote requests from clients using pricing.
+func (s *WebSrv) EnablePricing(pricing *PricingService) {
+	s.pricing = pricing
+}
+
+// EnableScheduling - Accept rides booked for a future pick up time and hold them in scheduler.
+func (s *WebSrv) EnableScheduling(scheduler *RideScheduler) {
+	s.scheduler = scheduler
+}
+
+// EnableGuests - While testing, let every client request rides as an anonymous guest without signing in.
+func (s *WebSrv) EnableGuests() {
+	s.guests = true
+}
+
+// EnableRoadControl - Let signed in admins close and open the edges of graph and slow traffic on them.
+func (s *WebSrv) EnableRoadControl(graph *Digraph) {
+	s.roadGraph = graph
+}
+
+// SetSessions - Sign riders in with sessions, shared with the REST API to grant admins their role.
+func (s *WebSrv) SetSessions(sessions *Sessions) {
+	s.sessions = sessions
+}
+
+// SetLogger - Log to the websrv component of logger.
+func (s *WebSrv) SetLogger(logger *Logger) {
+	s.logger = logger.Component("websrv")
+}
+
+// EnableMetrics - Serve metrics under /metrics and record the number of connected clients in them.
+func (s *WebSrv) EnableMetrics(metrics *Metrics) {
+	s.metrics = metrics
+}
+
+// EnableAPI - Serve the JSON REST API under /api/ alongside the websocket.
+func (s *WebSrv) EnableAPI(api *API) {
+	s.api = api
+}
+
+// Handler - Routes of this server: static frontend, websocket and, if enabled, the REST API and metrics.
+func (s *WebSrv) Handler() http.Handler {
+  mux := http.NewServeMux()
   // Create a simple file server
   fs := http.FileServer(http.Dir("public"))
-  http.Handle("/", fs)
+  mux.Handle("/", fs)
 
   // Configure websocket route
-  http.HandleFunc("/ws", handleConnections)
+  mux.HandleFunc("/ws", s.handleConnections)
+
+  // Configure REST API routes
+  if s.api != nil {
+    mux.Handle("/api/", s.api)
+  }
+  if s.metrics != nil {
+    mux.Handle("/metrics", s.metrics)
+  }
+  return mux
+}
+
+// LoopWebSrv - Begin the web server execution loop, until Shutdown.
+func (s *WebSrv) LoopWebSrv(portAddress string) {
+  s.mutex.Lock()
+  s.server = &http.Server{Addr:fmt.Sprintf(":%s",portAddress), Handler:s.Handler()}
+  server := s.server
+  s.mutex.Unlock()
 
   // Start the server on localhost portNo and log any errors
   go func() {
-		log.Printf("http server started on %s \n", portAddress)
-		err := http.ListenAndServe(fmt.Sprintf(":%s",portAddress), nil)
-		if err != nil {
-			log.Fatal("ListenAndServe: ", err)
+		s.logger.Info("http server started", Fields{"port":portAddress})
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Fatal("ListenAndServe", Fields{"error":err})
 		}
   }()
 
+  s.loopBroadcast()
+}
+
+// Shutdown - Stop serving, disconnect every client and end LoopWebSrv.
+func (s *WebSrv) Shutdown(ctx context.Context) (err error) {
+	s.mutex.Lock()
+	server := s.server
+	clients := s.clients
+	s.clients = make(map[*webClient]bool)
+	s.mutex.Unlock()
+
+	select {
+	case <-s.done: // Already shut down
+	default:
+		close(s.done)
+	}
+	if server != nil {
+		err = server.Shutdown(ctx)
+	}
+	for client := range clients {
+		client.close()
+	}
+	return
+}
+
+func (s *WebSrv) loopBroadcast() {
   // Handle any car info updates from World
   for {
     // Grab the next message from the broadcast channel
-    msg := <-s.webChan
-    //fmt.Println("Got msg:",msg)
-    // Send it out to every client that is currently connected
-    for client := range clients {
-      err := client.WriteJSON(msg)
-      if err != nil {
-        log.Printf("error: %v", err)
-        client.Close()
-        delete(clients, client)
-      }
+    select {
+    case msg := <-s.webChan:
+      //fmt.Println("Got msg:",msg)
+      s.broadcast(msg)
+    case <-s.done:
+      return
     }
   }
 }
 
-func handleConnections(w http.ResponseWriter, r *http.Request) {
+// broadcast - Queue msg for every client that is currently connected, never waiting on a client.
+func (s *WebSrv) broadcast(msg Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remember(msg)
+	for client := range s.clients {
+		client.send(msg)
+	}
+}
+
+// register - Start client off with a nonce to sign in with and the full world state, and add it to the
+//   broadcast. With guests enabled while testing, the client rides as an anonymous guest until it signs in.
+func (s *WebSrv) register(client *webClient) {
+	hello := HelloMessage{Testing:s.testing, MrmAddress:s.mrmAddress, Nonce:s.sessions.NewNonce()}
+	client.nonce = hello.Nonce
+	if s.testing && s.guests {
+		guest := s.sessions.Guest()
+		client.signIn(guest)
+		hello.Guest = guest.Address
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	client.reply(hello)
+	client.resetTo(s.snapshot())
+	s.clients[client] = true
+	s.metrics.SetWebClients(len(s.clients))
+}
+
+// unregister - Remove client from the broadcast, end its session and close it; safe to call more than once.
+func (s *WebSrv) unregister(client *webClient) {
+	s.mutex.Lock()
+	delete(s.clients, client)
+	s.metrics.SetWebClients(len(s.clients))
+	s.mutex.Unlock()
+	if session := client.currentSession(); session != nil {
+		s.sessions.End(session.Token)
+	}
+	client.close()
+}
+
+// resync - Reset client to the latest world state it subscribed to.
+func (s *WebSrv) resync(client *webClient) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	client.resetTo(s.snapshot())
+}
+
+func (s *WebSrv) handleConnections(w http.ResponseWriter, r *http.Request) {
+	// Refuse clients written against another protocol version
+	if version := r.URL.Query().Get("version"); version != "" && version != strconv.Itoa(ProtocolVersion) {
+		http.Error(w, fmt.Sprintf("unsupported protocol version %s, server speaks %d", version, ProtocolVersion), http.StatusBadRequest)
+		return
+	}
 	// Upgrade initial GET request to a websocket
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		s.logger.Warn("Could not upgrade to a websocket", Fields{"error":err})
+		return
 	}
+	// Register our new client, writing to it from its own goroutine
+	client := newWebClient(ws)
+	client.logger = s.logger.With(Fields{"remote":r.RemoteAddr})
+	s.register(client)
+	go client.writeLoop(func() { s.resync(client) }, func() { s.unregister(client) })
 	// Make sure we close the connection when the function returns
-	defer ws.Close()
-
-	// Register our new client
-	clients[ws] = true
-	if Testing {
-		ws.WriteJSON(HandshakeMessage{Testing:"true"})
-	} else {
-		ws.WriteJSON(HandshakeMessage{Testing:"false", MrmAddress:ExistingMrmAddress})
-	}
+	defer s.unregister(client)
 	for {
-		var rideReqMsg RideRequestMessage
-		// Read in a new message as JSON and map it to a Message object
-		err := ws.ReadJSON(&rideReqMsg)
-		if Testing && rideReqMsg.To != "" && rideReqMsg.From != "" {
-			fmt.Println("Received Ride Request", rideReqMsg.From, " ", rideReqMsg.To)
-			SendTestChain <- Ride{rideReqMsg.From, rideReqMsg.To}
-		}
+		var request ClientEnvelope
+		// Read in a new message as JSON and decode its data by type
+		err := ws.ReadJSON(&request)
 		if err != nil {
-			log.Printf("error: %v", err)
-			delete(clients, ws)
+			client.logger.Debug("Client disconnected", Fields{"error":err})
 			break
 		}
+		s.handleRequest(client, request)
+	}
+}
+
+func (s *WebSrv) handleRequest(client *webClient, request ClientEnvelope) {
+	switch request.Type {
+	case "Subscribe":
+		var subscription Subscription
+		if err := json.Unmarshal(request.Data, &subscription); err != nil {
+			client.logger.Warn("Invalid subscription", Fields{"error":err})
+			return
+		}
+		client.subscribe(subscription)
+		s.resync(client)
+	case "Authenticate":
+		var authReq AuthenticateRequest
+		if err := json.Unmarshal(request.Data, &authReq); err != nil {
+			client.logger.Warn("Invalid authentication", Fields{"error":err})
+			return
+		}
+		client.reply(s.authenticate(client, authReq))
+		s.resync(client)
+	case "QuoteRequest":
+		var quoteReq QuoteRequest
+		if err := json.Unmarshal(request.Data, &quoteReq); err != nil {
+			client.logger.Warn("Invalid quote request", Fields{"error":err})
+			return
+		}
+		client.reply(s.quote(quoteReq.From, quoteReq.To))
+	case "RideRequest":
+		var rideReqMsg RideRequestMessage
+		if err := json.Unmarshal(request.Data, &rideReqMsg); err != nil {
+			client.logger.Warn("Invalid ride request", Fields{"error":err})
+			return
+		}
+		session := client.currentSession()
+		if session == nil {
+			client.reply(ErrorMessage{Request:request.Type, Error:"sign in to request rides"})
+		} else if rideReqMsg.Count > 1 && session.Role != AdminRole {
+			client.reply(ErrorMessage{Request:request.Type, Error:"only admins may request rides in bulk"})
+		} else if rideReqMsg.Count > MaxBulkRides {
+			client.reply(ErrorMessage{Request:request.Type, Error:fmt.Sprintf("at most %d rides may be requested at once", MaxBulkRides)})
+		} else if rideReqMsg.PickUpTime != 0 {
+			client.reply(s.schedule(session.Address, rideReqMsg))
+		} else if s.testing && rideReqMsg.To != "" && rideReqMsg.From != "" {
+			client.logger.Info("Received ride request", Fields{RiderField:session.Address, "from":rideReqMsg.From, "to":rideReqMsg.To, "count":rideReqMsg.Count})
+			if rideReqMsg.Count > 1 {
+				// Simulated demand, each ride for an anonymous rider of the test chain
+				for i := 0; i < rideReqMsg.Count; i++ {
+					s.sendTestChain <- NewRide(rideReqMsg.From, rideReqMsg.To, rideReqMsg.Amount)
+				}
+			} else {
+				s.sendTestChain <- NewRiderRide(session.Address, rideReqMsg.From, rideReqMsg.To, rideReqMsg.Amount)
+			}
+		}
+	case "RoadCondition":
+		var roadReq RoadConditionRequest
+		if err := json.Unmarshal(request.Data, &roadReq); err != nil {
+			client.logger.Warn("Invalid road condition", Fields{"error":err})
+			return
+		}
+		if session := client.currentSession(); session == nil || session.Role != AdminRole {
+			client.reply(ErrorMessage{Request:request.Type, Error:"only admins may change road conditions"})
+		} else if s.roadGraph == nil {
+			client.reply(ErrorMessage{Request:request.Type, Error:"road control is not enabled"})
+		} else if condition, err := s.roadGraph.changeRoad(roadReq.Edge, roadReq.Closed, roadReq.Multiplier); err != nil {
+			client.reply(ErrorMessage{Request:request.Type, Error:err.Error()})
+		} else {
+			client.logger.Info("Changed road conditions", Fields{RiderField:session.Address, EdgeIDField:condition.EdgeID,
+				"closed":condition.Closed, "multiplier":condition.Multiplier})
+		}
+	default:
+		client.logger.Warn("Unknown message type", Fields{"type":request.Type})
+	}
+}
+
+// remember - keep the latest world state from msg for snapshots; caller must hold the mutex.
+func (s *WebSrv) remember(msg Message) {
+	switch update := msg.(type) {
+	case CarMessage:
+		s.cars[update.ID] = update
+	case StopLightMessage:
+		s.stopLights[update.ID] = update
+	case SurgeMessage:
+		s.surge[update.Zone] = update
+	case OnTimeMessage:
+		s.onTime = &update
+	case RoadMessage:
+		s.roads[update.Edge] = update
+	}
+}
+
+// snapshot - the latest world state; caller must hold the mutex.
+func (s *WebSrv) snapshot() (snapshot SnapshotMessage) {
+	snapshot.Cars = make([]CarMessage, 0, len(s.cars))
+	for _, car := range s.cars {
+		snapshot.Cars = append(snapshot.Cars, car)
+	}
+	sort.Slice(snapshot.Cars, func(i, j int) bool { return snapshot.Cars[i].ID < snapshot.Cars[j].ID })
+	snapshot.StopLights = make([]StopLightMessage, 0, len(s.stopLights))
+	for _, stopLight := range s.stopLights {
+		snapshot.StopLights = append(snapshot.StopLights, stopLight)
+	}
+	sort.Slice(snapshot.StopLights, func(i, j int) bool { return snapshot.StopLights[i].ID < snapshot.StopLights[j].ID })
+	snapshot.Surge = make([]SurgeMessage, 0, len(s.surge))
+	for _, zone := range s.surge {
+		snapshot.Surge = append(snapshot.Surge, zone)
+	}
+	sort.Slice(snapshot.Surge, func(i, j int) bool { return snapshot.Surge[i].Zone < snapshot.Surge[j].Zone })
+	snapshot.OnTime = s.onTime
+	snapshot.Roads = make([]RoadMessage, 0, len(s.roads))
+	for _, road := range s.roads {
+		snapshot.Roads = append(snapshot.Roads, road)
+	}
+	sort.Slice(snapshot.Roads, func(i, j int) bool { return snapshot.Roads[i].Edge < snapshot.Roads[j].Edge })
+	return
+}
+
+func (s *WebSrv) quote(from string, to string) (msg QuoteMessage) {
+	msg = QuoteMessage{From:from, To:to}
+	if s.pricing == nil {
+		msg.Error = "quotes are not enabled"
+		return
+	}
+	quote, err := s.pricing.Quote(from, to)
+	if err != nil {
+		msg.Error = err.Error()
+		return
+	}
+	msg.Distance = quote.Distance
+	msg.Duration = quote.Duration.Seconds()
+	msg.Fare = quote.Fare
+	msg.Surge = quote.Surge
+	return
+}
+
+// authenticate - sign client in if it signed its nonce, answering with the new session
+func (s *WebSrv) authenticate(client *webClient, authReq AuthenticateRequest) SessionMessage {
+	session, err := s.sessions.Authenticate(client.nonce, authReq.Address, authReq.Signature)
+	client.nonce = s.sessions.NewNonce()  // Each nonce signs in once
+	if err != nil {
+		return SessionMessage{Error:err.Error(), Nonce:client.nonce}
+	}
+	if previous := client.signIn(session); previous != nil {
+		s.sessions.End(previous.Token)
+	}
+	client.logger.Info("Signed in", Fields{RiderField:session.Address, "admin":session.Role == AdminRole})
+	return SessionMessage{Address:session.Address, Admin:session.Role == AdminRole, Token:session.Token}
+}
+
+// schedule - hold a ride request of rider for its pick up time, answering with the rider's new ride status
+func (s *WebSrv) schedule(rider string, rideReqMsg RideRequestMessage) RideStatusMessage {
+	status := RideStatusMessage{Address:rider}
+	if s.scheduler == nil {
+		status.State = "Schedule Failed: scheduling is not enabled"
+		return status
+	}
+	err := s.scheduler.Schedule(ScheduledRide{Rider:rider, From:rideReqMsg.From, To:rideReqMsg.To,
+		Amount:rideReqMsg.Amount, PickUpTime:time.Unix(rideReqMsg.PickUpTime, 0)})
+	if err != nil {
+		status.State = "Schedule Failed: " + err.Error()
+		return status
 	}
+	status.State = "Scheduled"
+	return status
 }
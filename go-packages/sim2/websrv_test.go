@@ -0,0 +1,149 @@
+package sim2
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebSrv_Instances(t *testing.T) {
+	testChainSrv := NewTestChainWebSrv(make(chan Message), make(chan Ride))
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	testChainSrv.EnableAPI(NewAPI(NewWorld(25, graph), graph, nil, nil))
+	chainSrv := NewWebSrv(make(chan Message), "0x1")
+	if !testChainSrv.testing || chainSrv.testing || chainSrv.mrmAddress != "0x1" || testChainSrv.mrmAddress != "" {
+		t.Errorf("Servers share their configuration \n")
+	}
+
+	recorder := httptest.NewRecorder()
+	testChainSrv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/map", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Server with the API enabled did not serve it, got %d \n", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	chainSrv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/map", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("Server without the API served it, got %d \n", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	chainSrv.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/ws?version=1", nil))
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unsupported protocol version to be refused, got %d \n", recorder.Code)
+	}
+}
+
+func TestWebSrv_Shutdown(t *testing.T) {
+	web := make(chan Message)
+	s := NewWebSrv(web, "")
+	stopped := make(chan bool)
+	go func() {
+		s.loopBroadcast()
+		stopped <- true
+	}()
+	web <- CarMessage{ID: 3}
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("Broadcast loop did not stop on shutdown \n")
+	}
+	if s.Shutdown(context.Background()) != nil {
+		t.Errorf("Second shutdown failed \n")
+	}
+	if len(s.snapshot().Cars) != 1 {
+		t.Errorf("Broadcast update was not kept for snapshots \n")
+	}
+}
+
+func TestWebSrv_RoadCondition(t *testing.T) {
+	graph := GetDigraphFromFile("../../maps/4by4.map")
+	world := NewWorld(25, graph)
+	web, _ := world.RegisterWeb()
+	s := NewWebSrv(web, "")
+	s.EnableRoadControl(graph)
+	client := newWebClient(nil)
+	request := ClientEnvelope{Type: "RoadCondition", Data: json.RawMessage(`{"edge":36,"closed":true}`)}
+
+	client.signIn(Session{Address: "0xa", Role: RiderRole})
+	s.handleRequest(client, request)
+	if graph.IsClosed(36) || len(client.queue) != 1 || client.queue[0].Type != "Error" {
+		t.Fatalf("Expected a rider's road change to be refused \n")
+	}
+
+	client.signIn(Session{Address: "0xb", Role: AdminRole})
+	s.handleRequest(client, request)
+	if !graph.IsClosed(36) {
+		t.Fatalf("Admin could not close edge 36 \n")
+	}
+	s.handleRequest(client, ClientEnvelope{Type: "RoadCondition", Data: json.RawMessage(`{"edge":1000,"closed":true}`)})
+	if len(client.queue) != 2 || client.queue[1].Type != "Error" {
+		t.Errorf("Expected closing an edge that is not on the map to be refused \n")
+	}
+
+	world.step()
+	var road RoadMessage
+	for len(web) > 0 {
+		if msg, ok := (<-web).(RoadMessage); ok {
+			road = msg
+		}
+	}
+	if road != (RoadMessage{Edge: 36, Closed: true, Multiplier: 1}) {
+		t.Errorf("World published %+v for the closed edge \n", road)
+	}
+	s.broadcast(road)
+	if roads := s.snapshot().Roads; len(roads) != 1 || roads[0] != road {
+		t.Errorf("Road update was not kept for snapshots, got %+v \n", roads)
+	}
+}
+
+func TestWebSrv_GuestSessions(t *testing.T) {
+	rides := make(chan Ride, 1)
+	s := NewTestChainWebSrv(make(chan Message), rides)
+	request := ClientEnvelope{Type: "RideRequest", Data: json.RawMessage(`{"from":"100,100","to":"200,200"}`)}
+
+	client := newWebClient(nil)
+	s.register(client)
+	s.handleRequest(client, request)
+	if client.currentSession() != nil || len(rides) != 0 {
+		t.Fatalf("Client requested a ride without signing in \n")
+	}
+	if last := client.queue[len(client.queue)-1]; last.Type != "Error" {
+		t.Errorf("Expected the ride request to be refused, got %s \n", last.Type)
+	}
+
+	s.EnableGuests()
+	guest := newWebClient(nil)
+	s.register(guest)
+	s.handleRequest(guest, request)
+	if session := guest.currentSession(); session == nil || !session.Guest || len(rides) != 1 {
+		t.Fatalf("Expected a guest to request a ride once guests are enabled \n")
+	}
+	if ride := <-rides; ride.address != guest.currentSession().Address {
+		t.Errorf("Ride requested for %s rather than the guest \n", ride.address)
+	}
+}
+
+func TestWebSrv_BulkRideLimit(t *testing.T) {
+	rides := make(chan Ride, MaxBulkRides)
+	s := NewTestChainWebSrv(make(chan Message), rides)
+	client := newWebClient(nil)
+	client.signIn(Session{Address: "0xa", Role: AdminRole})
+	bulk := func(count int) ClientEnvelope {
+		return ClientEnvelope{Type: "RideRequest", Data: json.RawMessage(fmt.Sprintf(`{"from":"100,100","to":"200,200","count":%d}`, count))}
+	}
+
+	s.handleRequest(client, bulk(MaxBulkRides+1))
+	if len(rides) != 0 || len(client.queue) != 1 || client.queue[0].Type != "Error" {
+		t.Fatalf("Expected a bulk request over the limit to be refused \n")
+	}
+	s.handleRequest(client, bulk(MaxBulkRides))
+	if len(rides) != MaxBulkRides {
+		t.Errorf("Expected %d rides requested, got %d \n", MaxBulkRides, len(rides))
+	}
+}
@@ -2,8 +2,7 @@ package sim2
 
 import (
   "time"
-  "strconv"
-
+  "sync"
 )
 
 // world - Describes world state: position and velocity of all cars in simulation
@@ -11,6 +10,9 @@ import (
 type TrafficInfo struct {
 	carStates  []CarInfo
 	stopLights []StopLightInfo
+	stopSignGrants map[uint]bool  // IDs of the cars with right of way at stop signs
+	reservationGrants map[uint]bool  // IDs of the cars holding a reservation at autonomous intersections
+	pedestrians []PedestrianInfo
 }
 
 // CarInfo - struct to contain position and velocity information for a simulated car.
@@ -20,14 +22,41 @@ type CarInfo struct {
   Vel Coords  // with respect to current position, offset for a single frame
   Dir float64  // unit vector with respect to current position
   EdgeId uint
+  State PathState
+  NextState PathState  // State resumed after Waiting
+  Parked bool  // Pulled over without a ride, not blocking other cars
+  BrokenDown bool  // Stopped where it is until repaired
+  Lane uint  // Of the edge, 0 for its rightmost lane
+  Reservation *ReservationRequest  // Requested approaching an autonomous intersection, nil otherwise
+  Route []uint  // IDs of the edges left on the car's route
+  Riders []string  // Riders with a pick up or drop off left, next stop first
+}
+
+// isIdle - true if the car has no ride, including while briefly waiting at an intersection.
+func (info CarInfo) isIdle() bool {
+  return info.State == DrivingAtRandom || (info.State == Waiting && info.NextState == DrivingAtRandom)
 }
 
 type StopLightInfo struct {
 	ID uint
 	lightstates [NumberOfDirections]LightState
 	alarm time.Time
+	plan SignalPlan
+	walk bool  // Red in every direction while pedestrians cross
+}
+
+// SignalPlan - how long a stop light stays green and orange for each direction in turn, and how long it
+//   stops every direction for pedestrians waiting to cross at the end of a cycle. With no Walk time
+//   pedestrians cross whenever the crosswalk is clear, as cars give way to them.
+type SignalPlan struct {
+	Green  time.Duration
+	Orange time.Duration
+	Walk   time.Duration
 }
 
+// DefaultSignalPlan - signal plan of every stop light until another is set.
+var DefaultSignalPlan = SignalPlan{Green:time.Second * 5, Orange:time.Second, Walk:time.Second * 8}
+
 type LightState int
 const (
 	Red     LightState = 0
@@ -35,6 +64,9 @@ const (
 	Green   LightState = 2
 )
 
+// WebChanSize - messages buffered for the web output before World drops them
+const WebChanSize = 1024
+
 // World - struct to contain all relevat world information in simulation.
 type World struct {
   graph *Digraph
@@ -44,6 +76,28 @@ type World struct {
   syncChans []chan TrafficInfo  // Index by actor ID for channel to/from that actor
   recvChan chan CarInfo  // Receive from all Cars registered on one channel
   webChan chan Message
+  droppedWebMessages uint  // Web messages dropped because webChan was full
+  carObservers []CarObserver  // Observe car states once per second
+  snapshotMutex sync.Mutex
+  snapshot TrafficInfo  // Copy of the world state at the end of the last frame
+  metrics *Metrics  // Records frame durations, nil to record nothing
+  logger *Logger
+  clock Clock  // Times the stop lights
+  frames uint64  // Frames simulated so far
+  roadsVersion uint64  // Version of the road conditions last published
+  travelTimes *TravelTimes  // Smoothed from the cars' traversals of each edge
+  traffic *trafficObserver
+  stopSigns *stopSignManager  // Grants right of way at stop signs
+  reservations *reservationManager  // Grants reservations at autonomous intersections
+  pedestrians []*Pedestrian
+  pedestrianMutex sync.Mutex
+  newPedestrians []*Pedestrian  // Added since the last frame, under pedestrianMutex
+  numPedestrians uint  // Total count of pedestrians added, under pedestrianMutex
+}
+
+// CarObserver - receives a snapshot of all car states; called from the World loop so it must not block.
+type CarObserver interface {
+  ObserveCars(cars []CarInfo)
 }
 
 // NewWorld - Constructor for valid World object.
@@ -52,10 +106,16 @@ func NewWorld(fps float64, graph *Digraph) *World {
   w.graph = graph
   w.fps = fps
   w.numRegisteredCars = 0
+  w.SetLogger(defaultLogger)
+  w.clock = systemClock
+  w.travelTimes = NewTravelTimes(graph, MovementPerFrame * fps, DefaultTravelTimeSmoothing)
+  w.traffic = newTrafficObserver(w.travelTimes)
+  w.stopSigns = newStopSignManager(graph)
+  w.reservations = newReservationManager(graph, MovementPerFrame * fps)
 
   for _, intersection := range graph.Intersections {
   	if intersection.intersectionType == StopLight {
-			w.trafficInfo.stopLights = append(w.trafficInfo.stopLights, StopLightInfo{ID:intersection.id})
+			w.trafficInfo.stopLights = append(w.trafficInfo.stopLights, StopLightInfo{ID:intersection.id, plan:DefaultSignalPlan})
 		}
 	}
   // NOTE recvChan is nil until cars are registered
@@ -76,7 +136,7 @@ func (w *World) RegisterCar() (uint, chan TrafficInfo, *chan CarInfo, bool) {
   //fmt.Println("numRegisteredCars:", w.numRegisteredCars)
 
   // Allocate new channels for registered car
-  w.trafficInfo.carStates = append(w.trafficInfo.carStates, CarInfo{ ID:ID }) // TODO: randomize/control car location on startup
+  w.trafficInfo.carStates = append(w.trafficInfo.carStates, CarInfo{ ID:ID }) // Cars report where they were placed after the first frame
   w.syncChans = append(w.syncChans, make(chan TrafficInfo, 1)) // Buffer up to one output
   w.recvChan = make(chan CarInfo, w.numRegisteredCars)  // Overwrite buffered allocation
   return ID, w.syncChans[ID], &w.recvChan, true
@@ -84,61 +144,130 @@ func (w *World) RegisterCar() (uint, chan TrafficInfo, *chan CarInfo, bool) {
 
 // TODO: an UnregisterCar func if necessary
 
+// stopCars - Close the sync channel of every registered car so its loop returns; the world cannot step afterwards.
+func (w *World) stopCars() {
+  for _, syncChan := range w.syncChans {
+    close(syncChan)
+  }
+}
+
 // LoopWorld - Begin the world simulation execution loop
 func (w *World) LoopWorld() {
+	w.startStopLights()
+  for {
+    frameStart := time.Now()
+    framePeriod := w.FramePeriod()
+    timer := time.NewTimer(framePeriod)
+
+    w.step()
+    w.metrics.ObserveFrame(time.Since(frameStart), framePeriod)
+
+    // Wait for frame update
+    <-timer.C
+
+    // World loop iterates
+  }
+}
+
+// FramePeriod - time simulated by one frame.
+func (w *World) FramePeriod() time.Duration {
+  return time.Duration(1000/w.fps) * time.Millisecond
+}
+
+// startStopLights - Turn every stop light green to the west.
+func (w *World) startStopLights() {
 	for idx := range w.trafficInfo.stopLights {
 		w.trafficInfo.stopLights[idx].lightstates[West] = Green
-		w.trafficInfo.stopLights[idx].alarm = time.Now().Add(time.Second * 5)
+		w.trafficInfo.stopLights[idx].alarm = w.clock.Now().Add(w.trafficInfo.stopLights[idx].plan.Green)
+		w.publish(w.stopLightMessage(idx))
 	}
+}
 
-	itercounter := uint64(0)
-  for {
-    //fmt.Println("Iteration", itercounter)
-    timer := time.NewTimer(time.Duration(1000/w.fps) * time.Millisecond)
+// step - Simulate one frame: sync every car with the world state and wait for all of them to report.
+func (w *World) step() {
+	w.updateStopLights()
+	w.publishRoads()
+	w.walkPedestrians()
+	w.trafficInfo.stopSignGrants = w.stopSigns.update(w.trafficInfo.carStates, w.clock.Now())
+	w.trafficInfo.reservationGrants = w.reservations.update(w.trafficInfo.carStates, w.clock.Now())
+  // Send out sync flag = true for each registered car
+  for ID := range w.trafficInfo.carStates {
+    cpyCarInfo := make([]CarInfo, len(w.trafficInfo.carStates))
+    copy(cpyCarInfo, w.trafficInfo.carStates)
+		cpyStopLightInfo := make([]StopLightInfo, len(w.trafficInfo.stopLights))
+		copy(cpyStopLightInfo, w.trafficInfo.stopLights)
+    w.syncChans[ID] <- TrafficInfo{cpyCarInfo,cpyStopLightInfo,w.trafficInfo.stopSignGrants,w.trafficInfo.reservationGrants,
+      w.trafficInfo.pedestrians}
+  }
+
+  // Car coroutines should now process current world state
+  for idx, car := range w.trafficInfo.carStates {
+    pos := car.lanePos(w.graph)
+    w.publish(CarMessage{
+      ID:uint(idx),
+      X:pos.X,
+      Y:pos.Y,
+      Orientation:car.Dir,
+    })
+  }
+
+  // Wait for all registered cars to report
+  for carRecvCt := uint(0); carRecvCt < w.numRegisteredCars ; {
+    data := <-w.recvChan
+    // TODO: deep copy is safer here
+		w.trafficInfo.carStates[data.ID] = data
+
+    carRecvCt++
+    //fmt.Println("World got new data on index", data.ID, ":", data)
+  }
+  w.traffic.observe(w.trafficInfo.carStates, w.clock.Now())
 
-		w.updateStopLights()
-    // Send out sync flag = true for each registered car
-    for ID := range w.trafficInfo.carStates {
+  // Share a snapshot of car states with observers once per second
+  if w.frames % uint64(w.fps) == 0 {
+    for _, observer := range w.carObservers {
       cpyCarInfo := make([]CarInfo, len(w.trafficInfo.carStates))
       copy(cpyCarInfo, w.trafficInfo.carStates)
-			cpyStopLightInfo := make([]StopLightInfo, len(w.trafficInfo.stopLights))
-			copy(cpyStopLightInfo, w.trafficInfo.stopLights)
-      w.syncChans[ID] <- TrafficInfo{cpyCarInfo,cpyStopLightInfo}
+      observer.ObserveCars(cpyCarInfo)
     }
+  }
 
-    // Car coroutines should now process current world state
-    for idx, car := range w.trafficInfo.carStates {
-      w.webChan <- Message{
-        Type:"Car",
-        ID:strconv.Itoa(int(idx)),
-        X:strconv.Itoa(int(car.Pos.X)),
-        Y:strconv.Itoa(int(car.Pos.Y)),
-        Orientation:strconv.Itoa(int(car.Dir)),
-      }
-    }
-
-
+  w.updateSnapshot()
+  w.frames++
+}
 
-    // Wait for all registered cars to report
-    for carRecvCt := uint(0); carRecvCt < w.numRegisteredCars ; {
-      data := <-w.recvChan
-      // TODO: deep copy is safer here
-			w.trafficInfo.carStates[data.ID] = data
 
-      carRecvCt++
-      //fmt.Println("World got new data on index", data.ID, ":", data)
-    }
 
-    itercounter++
+// SetLogger - Log to the world component of logger.
+func (w *World) SetLogger(logger *Logger) {
+  w.logger = logger.Component("world")
+}
 
-    // Wait for frame update
-    <-timer.C
+// SetClock - Time the stop lights by clock; call before LoopWorld.
+func (w *World) SetClock(clock Clock) {
+  w.clock = clock
+}
 
-    // World loop iterates
+// SetSignalPlan - Switch the stop light of intersection to plan from its next light change and true OK.
+//   Only call before LoopWorld or between steps, while no frame is being simulated.
+func (w *World) SetSignalPlan(intersection uint, plan SignalPlan) bool {
+  for idx := range w.trafficInfo.stopLights {
+    if w.trafficInfo.stopLights[idx].ID == intersection {
+      w.trafficInfo.stopLights[idx].plan = plan
+      return true
+    }
   }
+  return false
 }
 
+// TravelTimes - travel times of the edges smoothed from how long the cars took to drive them.
+func (w *World) TravelTimes() *TravelTimes {
+  return w.travelTimes
+}
 
+// SetMetrics - Record the duration of every frame in metrics.
+func (w *World) SetMetrics(metrics *Metrics) {
+  w.metrics = metrics
+}
 
 // TODO: an UnregisterWeb func if necessary
 
@@ -150,34 +279,98 @@ func (w *World) RegisterWeb() (chan Message, bool) {
   }
 
   // Allocate new channel for registered web output
-  w.webChan = make(chan Message)
+  w.webChan = make(chan Message, WebChanSize)
   return w.webChan, true
 }
 
+// publish - Send msg to the web output without blocking, dropping it if the web layer has fallen behind.
+func (w *World) publish(msg Message) {
+  select {
+  case w.webChan <- msg:
+  default:
+    w.droppedWebMessages++
+    if w.droppedWebMessages % WebChanSize == 1 {
+      w.logger.Warn("Dropped web messages, web output is not keeping up", Fields{"dropped":w.droppedWebMessages})
+    }
+  }
+}
+
+// RegisterCarObserver - Share car states with observer once per second and true OK.
+func (w *World) RegisterCarObserver(observer CarObserver) bool {
+  if w == nil || observer == nil {
+    return false
+  }
+  w.carObservers = append(w.carObservers, observer)
+  return true
+}
+
+// Snapshot - Copy of the car and stop light states at the end of the last frame.
+func (w *World) Snapshot() (cars []CarInfo, stopLights []StopLightInfo) {
+  w.snapshotMutex.Lock()
+  defer w.snapshotMutex.Unlock()
+  cars = make([]CarInfo, len(w.snapshot.carStates))
+  copy(cars, w.snapshot.carStates)
+  stopLights = make([]StopLightInfo, len(w.snapshot.stopLights))
+  copy(stopLights, w.snapshot.stopLights)
+  return
+}
+
+func (w *World) updateSnapshot() {
+  w.snapshotMutex.Lock()
+  defer w.snapshotMutex.Unlock()
+  w.snapshot.carStates = append(w.snapshot.carStates[:0], w.trafficInfo.carStates...)
+  w.snapshot.stopLights = append(w.snapshot.stopLights[:0], w.trafficInfo.stopLights...)
+}
 
 func (w *World) updateStopLights() {
 	for idx, stopLight := range w.trafficInfo.stopLights {
-		if time.Now().After(stopLight.alarm) {
+		if w.clock.Now().After(stopLight.alarm) && stopLight.walk {
+			w.trafficInfo.stopLights[idx].walk = false
+			w.trafficInfo.stopLights[idx].lightstates[West] = Green
+			w.trafficInfo.stopLights[idx].alarm = w.clock.Now().Add(stopLight.plan.Green)
+			w.publish(w.stopLightMessage(idx))
+		} else if w.clock.Now().After(stopLight.alarm) {
 			for direction, lightState := range w.trafficInfo.stopLights[idx].lightstates {
 				if lightState == Green {
 					w.trafficInfo.stopLights[idx].lightstates[direction] = Orange //TODO: Maybe switch this to orange too?
-					w.trafficInfo.stopLights[idx].alarm = time.Now().Add(time.Second)
+					w.trafficInfo.stopLights[idx].alarm = w.clock.Now().Add(stopLight.plan.Orange)
 					break;
 				} else if lightState == Orange {
 					w.trafficInfo.stopLights[idx].lightstates[direction] = Red
+					if Direction(direction) == North && stopLight.plan.Walk > 0 && w.pedestriansWaitingAt(stopLight.ID) {
+						w.trafficInfo.stopLights[idx].walk = true
+						w.trafficInfo.stopLights[idx].alarm = w.clock.Now().Add(stopLight.plan.Walk)
+						break;
+					}
 					w.trafficInfo.stopLights[idx].lightstates[(direction+1)%NumberOfDirections] = Green
-					w.trafficInfo.stopLights[idx].alarm = time.Now().Add(time.Second * 5)
+					w.trafficInfo.stopLights[idx].alarm = w.clock.Now().Add(stopLight.plan.Green)
 					break;
 				}
 			}
-			w.webChan <- Message{
-				Type:"Stoplight",
-				ID:strconv.Itoa(int(idx)),
-				West:strconv.Itoa(int(w.trafficInfo.stopLights[idx].lightstates[West])),
-				South:strconv.Itoa(int(w.trafficInfo.stopLights[idx].lightstates[South])),
-				East:strconv.Itoa(int(w.trafficInfo.stopLights[idx].lightstates[East])),
-				North:strconv.Itoa(int(w.trafficInfo.stopLights[idx].lightstates[North])),
-			}
+			w.publish(w.stopLightMessage(idx))
 		}
 	}
 }
+
+// publishRoads - Publish the road conditions of the edges changed since they were last published.
+func (w *World) publishRoads() {
+	if w.graph.roadsVersion() == w.roadsVersion {
+		return
+	}
+	version, changed := w.graph.RoadConditions(w.roadsVersion)
+	for _, condition := range changed {
+		w.publish(RoadMessage{Edge:condition.EdgeID, Closed:condition.Closed, Multiplier:condition.Multiplier})
+	}
+	w.roadsVersion = version
+}
+
+func (w *World) stopLightMessage(idx int) StopLightMessage {
+	lightstates := w.trafficInfo.stopLights[idx].lightstates
+	return StopLightMessage{
+		ID:uint(idx),
+		West:lightstates[West],
+		South:lightstates[South],
+		East:lightstates[East],
+		North:lightstates[North],
+	}
+}
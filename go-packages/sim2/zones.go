@@ -0,0 +1,49 @@
+package sim2
+
+import (
+	"math"
+)
+
+// zones - Describes a grid of square zones laid over the map
+
+// zoneGrid - square zones covering every vertex of a graph, indexed row by row.
+type zoneGrid struct {
+	size    float64
+	columns int
+	rows    int
+}
+
+func newZoneGrid(graph *Digraph, size float64) (grid zoneGrid) {
+	grid.size = size
+	for _, vertex := range graph.Vertices {
+		grid.columns = int(math.Max(float64(grid.columns), math.Floor(vertex.Pos.X/size)+1))
+		grid.rows = int(math.Max(float64(grid.rows), math.Floor(vertex.Pos.Y/size)+1))
+	}
+	return
+}
+
+// numZones - total number of zones in the grid.
+func (grid zoneGrid) numZones() int {
+	return grid.columns * grid.rows
+}
+
+// zone - ID of the zone containing pos, false if pos is off the map.
+func (grid zoneGrid) zone(pos Coords) (int, bool) {
+	column := int(math.Floor(pos.X / grid.size))
+	row := int(math.Floor(pos.Y / grid.size))
+	if column < 0 || column >= grid.columns || row < 0 || row >= grid.rows {
+		return 0, false
+	}
+	return row*grid.columns + column, true
+}
+
+// origin - top left corner of a zone.
+func (grid zoneGrid) origin(zone int) Coords {
+	return Coords{float64(zone%grid.columns) * grid.size, float64(zone/grid.columns) * grid.size}
+}
+
+// center - middle of a zone.
+func (grid zoneGrid) center(zone int) Coords {
+	origin := grid.origin(zone)
+	return Coords{origin.X + grid.size/2, origin.Y + grid.size/2}
+}
@@ -7,15 +7,29 @@ const mrmContractABI =  [ { "anonymous": false, "inputs": [ { "indexed": false,
 const moovCoinABI = [{"constant":false,"inputs":[],"name":"corruptExchange","outputs":[],"payable":true,"stateMutability":"payable","type":"function"},{"constant":true,"inputs":[],"name":"name","outputs":[{"name":"","type":"string"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"_spender","type":"address"},{"name":"_value","type":"uint256"}],"name":"approve","outputs":[{"name":"","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"},{"constant":true,"inputs":[],"name":"totalSupply","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"_from","type":"address"},{"name":"_to","type":"address"},{"name":"_value","type":"uint256"}],"name":"transferFrom","outputs":[{"name":"","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"},{"constant":true,"inputs":[],"name":"INITIAL_SUPPLY","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[],"name":"decimals","outputs":[{"name":"","type":"uint8"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"_spender","type":"address"},{"name":"_subtractedValue","type":"uint256"}],"name":"decreaseApproval","outputs":[{"name":"","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"},{"constant":true,"inputs":[{"name":"_owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":true,"inputs":[],"name":"symbol","outputs":[{"name":"","type":"string"}],"payable":false,"stateMutability":"view","type":"function"},{"constant":false,"inputs":[{"name":"_to","type":"address"},{"name":"_value","type":"uint256"}],"name":"transfer","outputs":[{"name":"","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"},{"constant":false,"inputs":[{"name":"_spender","type":"address"},{"name":"_addedValue","type":"uint256"}],"name":"increaseApproval","outputs":[{"name":"","type":"bool"}],"payable":false,"stateMutability":"nonpayable","type":"function"},{"constant":true,"inputs":[{"name":"_owner","type":"address"},{"name":"_spender","type":"address"}],"name":"allowance","outputs":[{"name":"","type":"uint256"}],"payable":false,"stateMutability":"view","type":"function"},{"inputs":[],"payable":false,"stateMutability":"nonpayable","type":"constructor"},{"anonymous":false,"inputs":[{"indexed":true,"name":"owner","type":"address"},{"indexed":true,"name":"spender","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Approval","type":"event"},{"anonymous":false,"inputs":[{"indexed":true,"name":"from","type":"address"},{"indexed":true,"name":"to","type":"address"},{"indexed":false,"name":"value","type":"uint256"}],"name":"Transfer","type":"event"}];
 var mrmAddress;
 
-ws = new WebSocket('ws://' + window.location.host + '/ws');
+const protocolVersion = 4;
+ws = new WebSocket('ws://' + window.location.host + '/ws?version=' + protocolVersion);
 ws.addEventListener('message', saveAddress);
 testing = false;
+lastSeq = 0;
+nonce = "";
+riderAddress = "";
 function saveAddress(e) {
-  var msg = JSON.parse(e.data);
-  if (msg.testing == "true") {
+  var envelope = JSON.parse(e.data);
+  if (envelope.type != "Hello") {
+    return;
+  }
+  var msg = envelope.data;
+  nonce = msg.nonce;
+  if (msg.testing) {
     testing = true;
+    // Rides are requested as this connection's anonymous rider, if the server opens guest sessions, until someone signs in
+    riderAddress = msg.guest;
     document.getElementById("get-ride-button").onclick = getTestChainRide;
     document.getElementById("non-blockchain-version").style.display = "none";
+    if (typeof web3 !== 'undefined') {
+      document.getElementById("sign-in-button").style.display = "inline";
+    }
   } else {
     document.getElementById("blockchain-version").style.display = "none";
     mrmAddress = msg.mrmAddress
@@ -41,42 +55,174 @@ function saveAddress(e) {
 }
 
 function updateCarPosition(e) {
-  var msg = JSON.parse(e.data);
-  if (msg.type == "Car") {
-    document.getElementById('Car'+msg.id).style.top = parseInt(msg.y)+"px"
-    document.getElementById('Car'+msg.id).style.left = parseInt(msg.x)+"px"
-    document.getElementById('Car'+msg.id).style.transform  = "rotate("+(parseInt(msg.orientation)+180)+"deg)";
-  } else if (msg.type == "Stoplight"){
-      var lightMap = {
-          "0": "#c70101",
-          "1": "Orange",
-          "2": "Green"
-      };
-      document.getElementById('StopLight'+msg.id).querySelector('div[name="West"]').style.background = lightMap[msg.north];
-      document.getElementById('StopLight'+msg.id).querySelector('div[name="South"]').style.background = lightMap[msg.west];
-      document.getElementById('StopLight'+msg.id).querySelector('div[name="East"]').style.background = lightMap[msg.south];
-      document.getElementById('StopLight'+msg.id).querySelector('div[name="North"]').style.background = lightMap[msg.east];
-  } else if (msg.type == "RideStatus" && (testing || msg.address.toLowerCase() == coinbase)) {
+  var envelope = JSON.parse(e.data);
+  if (envelope.seq != 0) {
+    if (envelope.type != "Snapshot" && lastSeq != 0 && envelope.seq != lastSeq + 1) {
+      console.log("missed " + (envelope.seq - lastSeq - 1) + " updates");
+    }
+    lastSeq = envelope.seq;
+  }
+  var msg = envelope.data;
+  if (envelope.type == "Snapshot") {
+    msg.cars.forEach(updateCar);
+    msg.stopLights.forEach(updateStopLight);
+    msg.surge.forEach(updateSurgeZone);
+    if (msg.onTime) {
+      updateOnTime(msg.onTime);
+    }
+  } else if (envelope.type == "Car") {
+    updateCar(msg);
+  } else if (envelope.type == "Stoplight"){
+    updateStopLight(msg);
+  } else if (envelope.type == "Surge") {
+    updateSurgeZone(msg);
+  } else if (envelope.type == "Quote") {
+    if (msg.error) {
+      document.getElementById("get-ride-debug").innerHTML = "Could not quote ride: " + msg.error;
+    } else {
+      document.getElementById("get-ride-debug").innerHTML = "Fare " + msg.fare + " MC (surge x" + msg.surge.toFixed(2) + ") for about " + Math.round(msg.duration) + " seconds";
+      document.getElementById("get-ride-amount-field").value = msg.fare;
+    }
+  } else if (envelope.type == "Session") {
+    updateSession(msg);
+  } else if (envelope.type == "Error") {
+    document.getElementById("get-ride-debug").innerHTML = msg.error;
+  } else if (envelope.type == "RideStatus") {
+    // Admins follow every rider, only report on this rider's own ride
+    if (msg.address.toLowerCase() != riderAddress) {
+      return;
+    }
     switch(msg.state) {
         case "To Pick Up":
-            var carName = document.getElementById('Car' + msg.id).name;
+            var carName = document.getElementById('Car' + msg.carId).name;
             document.getElementById("get-ride-debug").innerHTML = carName + " is on the way";
             break;
+        case "Ride Shared":
+            var carName = document.getElementById('Car' + msg.carId).name;
+            document.getElementById("get-ride-debug").innerHTML = carName + " is sharing your ride with another rider";
+            break;
         case "At Pick Up":
-            var carName = document.getElementById('Car' + msg.id).name;
+            var carName = document.getElementById('Car' + msg.carId).name;
             document.getElementById("get-ride-debug").innerHTML = carName + " is at Pickup";
             break;
+        case "Scheduled":
+            document.getElementById("get-ride-debug").innerHTML = "Ride scheduled, a car will be dispatched ahead of your pick up time";
+            break;
+        case "Dispatching":
+            document.getElementById("get-ride-debug").innerHTML = "Dispatching a car for your scheduled ride";
+            break;
+        case "Request Now":
+            if (!testing && scheduledRide != null) {
+                requestScheduledRide();
+            }
+            break;
         case "At Drop Off":
-            var carName = document.getElementById('Car' + msg.id).name;
+            var carName = document.getElementById('Car' + msg.carId).name;
             document.getElementById("get-ride-debug").innerHTML = carName + " is at Dropoff";
-            if (!testing && msg.address.toLowerCase() == coinbase) {
+            if (!testing) {
                 document.getElementById("finish-ride-button").style.visibility = "visible";
             }
             break;
+        default:
+            if (msg.state.startsWith("Schedule Failed")) {
+                document.getElementById("get-ride-debug").innerHTML = msg.state;
+            }
     }
+  } else if (envelope.type == "OnTime") {
+    updateOnTime(msg);
   }
 };
 
+// signIn - sign this connection's nonce with the wallet to prove we hold the key of coinbase
+async function signIn() {
+  if (typeof eth === 'undefined') {
+    eth = new Eth(web3.currentProvider);
+  }
+  if (typeof coinbase === 'undefined') {
+    coinbase = await eth.coinbase();
+  }
+  const message = "Sign in to the Moov simulator with nonce " + nonce;
+  web3.currentProvider.sendAsync({
+    method: "personal_sign",
+    params: [Eth.fromUtf8(message), coinbase],
+    from: coinbase
+  }, function (err, result) {
+    if (err || result.error) {
+      document.getElementById("get-ride-debug").innerHTML = "Could not sign in";
+      return;
+    }
+    ws.send(JSON.stringify({
+                        type: "Authenticate",
+                        data: {
+                          address: coinbase,
+                          signature: result.result}}));
+  });
+}
+
+function updateSession(msg) {
+  if (msg.error) {
+    nonce = msg.nonce;
+    document.getElementById("get-ride-debug").innerHTML = "Could not sign in: " + msg.error;
+    return;
+  }
+  riderAddress = msg.address;
+  document.getElementById("sign-in-button").style.display = "none";
+  if (msg.admin) {
+    document.getElementById("burst-button").style.display = "inline";
+    subscribe(["*"]);
+  }
+}
+
+function subscribe(riders) {
+  ws.send(JSON.stringify({
+                      type: "Subscribe",
+                      data: {
+                        allCars: true,
+                        stopLights: true,
+                        surge: true,
+                        onTime: true,
+                        riders: riders}}));
+}
+
+function updateCar(msg) {
+  document.getElementById('Car'+msg.id).style.top = parseInt(msg.y)+"px"
+  document.getElementById('Car'+msg.id).style.left = parseInt(msg.x)+"px"
+  document.getElementById('Car'+msg.id).style.transform  = "rotate("+(parseInt(msg.orientation)+180)+"deg)";
+}
+
+function updateStopLight(msg) {
+  var lightMap = {
+      0: "#c70101",
+      1: "Orange",
+      2: "Green"
+  };
+  document.getElementById('StopLight'+msg.id).querySelector('div[name="West"]').style.background = lightMap[msg.north];
+  document.getElementById('StopLight'+msg.id).querySelector('div[name="South"]').style.background = lightMap[msg.west];
+  document.getElementById('StopLight'+msg.id).querySelector('div[name="East"]').style.background = lightMap[msg.south];
+  document.getElementById('StopLight'+msg.id).querySelector('div[name="North"]').style.background = lightMap[msg.east];
+}
+
+function updateOnTime(msg) {
+  document.getElementById("on-time-report").innerHTML = "Scheduled pick ups: " + msg.onTime + " on time, " + msg.late + " late (" + Math.round(msg.averageLateness) + "s late on average)";
+}
+
+function updateSurgeZone(msg) {
+  var zone = document.getElementById('Surge' + msg.zone);
+  if (zone == null) {
+    zone = document.createElement('div');
+    zone.id = 'Surge' + msg.zone;
+    zone.className = 'SurgeZone';
+    zone.style.left = parseInt(msg.x) + "px";
+    zone.style.top = parseInt(msg.y) + "px";
+    zone.style.width = parseInt(msg.size) + "px";
+    zone.style.height = parseInt(msg.size) + "px";
+    document.getElementById('SurgeZones').appendChild(zone);
+  }
+  var multiplier = msg.multiplier;
+  zone.style.background = "rgba(255, 0, 0, " + Math.min((multiplier - 1) / 4, 0.5) + ")";
+  zone.innerHTML = multiplier > 1 ? "x" + multiplier.toFixed(2) + " (" + msg.requests + " requests, " + msg.idleCars + " idle cars)" : "";
+}
+
 window.addEventListener('load', function() {
   document.getElementById("set-start-point-button").onclick =
     function (e) {
@@ -88,6 +234,10 @@ window.addEventListener('load', function() {
       document.getElementById('Map').onclick = setEndPoint;
       document.getElementById("get-ride-debug").innerHTML = " Click anywhere on map to select end point";
     };
+  document.getElementById("get-quote-button").onclick = getQuote;
+  document.getElementById("burst-button").onclick = getTestChainRideBurst;
+  document.getElementById("schedule-ride-button").onclick = scheduleRide;
+  document.getElementById("sign-in-button").onclick = signIn;
 })
 
 async function startApp(web3) {
@@ -98,6 +248,7 @@ async function startApp(web3) {
       const moovCoinAddress = await mrm.moovCoin();
       moovCoin = eth.contract(moovCoinABI).at(moovCoinAddress[0]);
       coinbase = await eth.coinbase();
+      signIn();
       updateView();
     } else {
       document.getElementById("ui").innerHTML = "Change network to Ropsten";
@@ -228,7 +379,11 @@ async function finishRide(){
   document.getElementById("finish-ride-button").style.visibility = "hidden";
 }
 
-function getTestChainRide() {
+function getTestChainRideBurst() {
+  getTestChainRide(10);
+}
+
+function getTestChainRide(count) {
   console.log("trying to get ride");
     var debugElement = document.getElementById("get-ride-debug");
     debugElement.innerHTML = "";
@@ -247,8 +402,74 @@ function getTestChainRide() {
     }
     console.log(start+" "+end);
     ws.send(JSON.stringify({
-                        from: start,
-                        to: end}));
+                        type: "RideRequest",
+                        data: {
+                          from: start,
+                          to: end,
+                          amount: amount,
+                          count: Number.isInteger(count) ? count : 1}}));
+}
+
+var scheduledRide = null;
+
+function scheduleRide() {
+    var debugElement = document.getElementById("get-ride-debug");
+    const start = getLocations('start-point')
+    const end = getLocations('end-point')
+    const amount = parseInt(document.getElementById("get-ride-amount-field").value);
+    const pickUpTime = Date.parse(document.getElementById("pick-up-time-field").value);
+    if (start == "location not set"){
+      debugElement.innerHTML = "Set Start Point before scheduling a ride";
+      return;
+    }else if (end == "location not set"){
+      debugElement.innerHTML = "Set End Point before scheduling a ride";
+      return;
+    }else if (amount <= 0 ) {
+      debugElement.innerHTML = "Enter a ride amount greater than 0";
+      return;
+    }else if (isNaN(pickUpTime) || pickUpTime <= Date.now()) {
+      debugElement.innerHTML = "Choose a pick up time in the future";
+      return;
+    }
+    if (!testing) {
+      // The ride request is sent to the contract from this account once the server dispatches it
+      scheduledRide = {from: start, to: end, amount: amount};
+    }
+    ws.send(JSON.stringify({
+                        type: "RideRequest",
+                        data: {
+                          from: start,
+                          to: end,
+                          amount: amount,
+                          pickUpTime: Math.floor(pickUpTime / 1000)}}));
+}
+
+function requestScheduledRide() {
+    const ride = scheduledRide;
+    scheduledRide = null;
+    mrm.newRideRequest(ride.from, ride.to, ride.amount, { from: coinbase }).then(function (txHash) {
+      console.log('Transaction sent');
+      console.dir(txHash);
+      waitForTxToBeMined(txHash);
+    });
+}
+
+function getQuote() {
+    var debugElement = document.getElementById("get-ride-debug");
+    const start = getLocations('start-point')
+    const end = getLocations('end-point')
+    if (start == "location not set"){
+      debugElement.innerHTML = "Set Start Point before getting a quote";
+      return;
+    }else if (end == "location not set"){
+      debugElement.innerHTML = "Set End Point before getting a quote";
+      return;
+    }
+    ws.send(JSON.stringify({
+                        type: "QuoteRequest",
+                        data: {
+                          from: start,
+                          to: end}}));
 }
 
 function getLocations(locString) {